@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/albsko/learn-pub-sub/internal/gamelogic"
+	"github.com/albsko/learn-pub-sub/internal/pubsub"
+	"github.com/albsko/learn-pub-sub/internal/routing"
+)
+
+// TestMoveIntoWarIsLogged plays a war between two clients on a
+// MemoryBroker: alice moves into bob's territory, bob recognizes the war,
+// alice fights it and publishes the outcome, and the server writes it to
+// the game log. carol looks on without using up the war's attempts.
+func TestMoveIntoWarIsLogged(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker, err := pubsub.NewConnectionManager(pubsub.NewMemoryBroker().Dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	if err := pubsub.DeclareTopology(broker, routing.PerilTopology()); err != nil {
+		t.Fatal(err)
+	}
+	publishCh, err := broker.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := gamelogic.NewGameState("alice")
+	bob := gamelogic.NewGameState("bob")
+	carol := gamelogic.NewGameState("carol")
+	if err := alice.CommandSpawn([]string{"spawn", "asia", "infantry"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.CommandSpawn([]string{"spawn", "europe", "artillery"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, gs := range []*gamelogic.GameState{alice, bob, carol} {
+		subscribe(ctx, t, broker, routing.ArmyMovesPrefix+"."+gs.GetUsername(), routing.ArmyMovesPrefix+".*",
+			pubsub.TransientSimpleQueue, handlerMove(gs, publishCh))
+		// a war that is retried at all is dead-lettered
+		subscribe(ctx, t, broker, routing.WarRecognitionsPrefix+"."+gs.GetUsername(), routing.WarRecognitionsPrefix+".*",
+			pubsub.DurableSimpleQueue, handlerWar(gs, publishCh), pubsub.WithRetry(pubsub.RetryPolicy{MaxAttempts: 1}))
+	}
+
+	// the server's side of the game logs
+	logPath := filepath.Join(t.TempDir(), "game.log")
+	logWriter, err := gamelogic.NewLogWriter(logPath, 10, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logWriter.Close()
+	written := make(chan routing.GameLog, 1)
+	subscribe(ctx, t, broker, routing.GameLogSlug, routing.GameLogSlug+".*", pubsub.DurableSimpleQueue,
+		func(d pubsub.Delivery[routing.GameLog]) pubsub.AckType {
+			if err := logWriter.Write(d.Context(), d.Body); err != nil {
+				t.Errorf("could not write game log: %v", err)
+				return pubsub.NackDiscard
+			}
+			written <- d.Body
+			return pubsub.Ack
+		})
+
+	mv, err := alice.CommandMove([]string{"move", "europe", "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pubsub.Publish(ctx, publishCh, routing.ExchangePerilTopic, routing.ArmyMovesPrefix+"."+alice.GetUsername(), mv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case gl := <-written:
+		want := "bob won a war against alice"
+		if gl.Username != "alice" || gl.Message != want {
+			t.Errorf("got game log %q from %s, want %q from alice", gl.Message, gl.Username, want)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no game log was written")
+	}
+
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(data), " alice: bob won a war against alice\n") {
+		t.Errorf("game log file holds %q", data)
+	}
+	if msg, ok, err := publishCh.Get(routing.DeadLetterQueue(routing.WarRecognitionsPrefix), true); err != nil || ok {
+		t.Errorf("the war was dead-lettered: %q, %v", msg.Body, err)
+	}
+}
+
+func subscribe[T any](ctx context.Context, t *testing.T, broker pubsub.Broker, queue, key string, queueType pubsub.SimpleQueueType, handler pubsub.Handler[T], opts ...pubsub.SubscribeOption) {
+	t.Helper()
+	_, err := pubsub.Subscribe(ctx, broker, routing.ExchangePerilTopic, queue, key, queueType, handler,
+		append(opts, pubsub.WithDefaultCodec(pubsub.JSONCodec))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -2,38 +2,35 @@ package main
 
 import (
 	"fmt"
+	"log/slog"
+	"time"
 
 	"github.com/albsko/learn-pub-sub/internal/gamelogic"
 	"github.com/albsko/learn-pub-sub/internal/pubsub"
 	"github.com/albsko/learn-pub-sub/internal/routing"
-	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-func handlerMove(gs *gamelogic.GameState, publishCh *amqp.Channel) func(gamelogic.ArmyMove) pubsub.AckType {
-	return func(move gamelogic.ArmyMove) pubsub.AckType {
-		defer fmt.Print("> ")
-
-		moveOutcome := gs.HandleMove(move)
+func handlerMove(gs *gamelogic.GameState, publishCh pubsub.Publisher) pubsub.Handler[gamelogic.ArmyMove] {
+	return func(d pubsub.Delivery[gamelogic.ArmyMove]) pubsub.AckType {
+		moveOutcome := gs.HandleMove(d.Body)
 		switch moveOutcome {
 		case gamelogic.MoveOutcomeSamePlayer:
 			return pubsub.Ack
 		case gamelogic.MoveOutComeSafe:
 			return pubsub.Ack
 		case gamelogic.MoveOutcomeMakeWar:
-			err := pubsub.PublishJSON(
+			err := pubsub.Publish(
+				d.Context(),
 				publishCh,
 				routing.ExchangePerilTopic,
 				routing.WarRecognitionsPrefix+"."+gs.GetUsername(),
 				gamelogic.RecognitionOfWar{
-					Attacker: move.Player,
+					Attacker: d.Body.Player,
 					Defender: gs.GetPlayerSnap(),
 				},
+				pubsub.WithCorrelationID(d.Cause()),
 			)
-			if err != nil {
-				fmt.Printf("error: %s\n", err)
-				return pubsub.NackRequeue
-			}
-			return pubsub.Ack
+			return settle(err)
 		}
 
 		fmt.Println("error: unknown move outcome")
@@ -41,48 +38,42 @@ func handlerMove(gs *gamelogic.GameState, publishCh *amqp.Channel) func(gamelogi
 	}
 }
 
-func handlerWar(gs *gamelogic.GameState, publishCh *amqp.Channel) func(dw gamelogic.RecognitionOfWar) pubsub.AckType {
-	return func(dw gamelogic.RecognitionOfWar) pubsub.AckType {
-		defer fmt.Print("> ")
-		warOutcome, winner, loser := gs.HandleWar(dw)
+func handlerWar(gs *gamelogic.GameState, publishCh pubsub.Publisher) pubsub.Handler[gamelogic.RecognitionOfWar] {
+	return func(d pubsub.Delivery[gamelogic.RecognitionOfWar]) pubsub.AckType {
+		warOutcome, winner, loser := gs.HandleWar(d.Body)
 		switch warOutcome {
 		case gamelogic.WarOutcomeNotInvolved:
-			return pubsub.NackRequeue
+			// the attacker fights it from their own copy
+			return pubsub.Ack
 		case gamelogic.WarOutcomeNoUnits:
 			return pubsub.NackDiscard
 		case gamelogic.WarOutcomeOpponentWon:
 			err := publishGameLog(
+				d.Context(),
 				publishCh,
 				gs.GetUsername(),
 				fmt.Sprintf("%s won a war against %s", winner, loser),
+				pubsub.WithCorrelationID(d.Cause()),
 			)
-			if err != nil {
-				fmt.Printf("error: %s\n", err)
-				return pubsub.NackRequeue
-			}
-			return pubsub.Ack
+			return settle(err)
 		case gamelogic.WarOutcomeYouWon:
 			err := publishGameLog(
+				d.Context(),
 				publishCh,
 				gs.GetUsername(),
 				fmt.Sprintf("%s won a war against %s", winner, loser),
+				pubsub.WithCorrelationID(d.Cause()),
 			)
-			if err != nil {
-				fmt.Printf("error: %s\n", err)
-				return pubsub.NackRequeue
-			}
-			return pubsub.Ack
+			return settle(err)
 		case gamelogic.WarOutcomeDraw:
 			err := publishGameLog(
+				d.Context(),
 				publishCh,
 				gs.GetUsername(),
 				fmt.Sprintf("A war between %s and %s resulted in a draw", winner, loser),
+				pubsub.WithCorrelationID(d.Cause()),
 			)
-			if err != nil {
-				fmt.Printf("error: %s\n", err)
-				return pubsub.NackRequeue
-			}
-			return pubsub.Ack
+			return settle(err)
 		}
 
 		fmt.Println("error: unknown war outcome")
@@ -90,10 +81,32 @@ func handlerWar(gs *gamelogic.GameState, publishCh *amqp.Channel) func(dw gamelo
 	}
 }
 
-func handlerPause(gs *gamelogic.GameState) func(routing.PlayingState) pubsub.AckType {
-	return func(ps routing.PlayingState) pubsub.AckType {
-		defer fmt.Print("> ")
-		gs.HandlePause(ps)
+func handlerPause(gs *gamelogic.GameState) pubsub.Handler[routing.PlayingState] {
+	return func(d pubsub.Delivery[routing.PlayingState]) pubsub.AckType {
+		gs.HandlePause(d.Body)
 		return pubsub.Ack
 	}
 }
+
+// handlerMiddleware is pubsub.HandlerMiddleware with the prompt reprinted
+// after every handler.
+func handlerMiddleware[T any](logger *slog.Logger, dedup pubsub.DedupStore, timeout time.Duration) []pubsub.Middleware[T] {
+	return append([]pubsub.Middleware[T]{withPrompt[T]}, pubsub.HandlerMiddleware[T](logger, dedup, timeout)...)
+}
+
+// withPrompt reprints the REPL prompt after a handler has written over it.
+func withPrompt[T any](next pubsub.Handler[T]) pubsub.Handler[T] {
+	return func(d pubsub.Delivery[T]) pubsub.AckType {
+		defer fmt.Print("> ")
+		return next(d)
+	}
+}
+
+// settle acks a message whose follow-up publish succeeded and reports the
+// error otherwise.
+func settle(err error) pubsub.AckType {
+	if err != nil {
+		fmt.Printf("error: %s\n", err)
+	}
+	return pubsub.SettleFollowUp(err)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/albsko/learn-pub-sub/internal/config"
+	"github.com/albsko/learn-pub-sub/internal/pubsub"
+	"github.com/albsko/learn-pub-sub/internal/routing"
+	"github.com/gorilla/websocket"
+)
+
+// newTestGateway serves a gateway on a memory broker. No server answers the
+// lobby calls, so sessions play without a lobby.
+func newTestGateway(t *testing.T, password string) string {
+	t.Helper()
+	b := pubsub.NewMemoryBroker()
+	broker, err := pubsub.NewConnectionManager(b.Dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { broker.Close() })
+	if err := pubsub.DeclareTopology(broker, routing.PerilTopology()); err != nil {
+		t.Fatal(err)
+	}
+	ch, err := broker.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher, err := pubsub.NewConfirmingPublisher(ch, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpc, err := pubsub.NewRPCClient(broker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rpc.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cfg := config.Default()
+	cfg.Gateway.Password = password
+	g := &gateway{
+		cfg:       cfg,
+		broker:    broker,
+		publisher: publisher,
+		rpc:       rpc,
+		logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		ctx:       ctx,
+		players:   map[string]bool{},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(g.serveWS))
+	t.Cleanup(func() {
+		srv.Close()
+		cancel()
+		g.sessions.Wait()
+	})
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func dialGateway(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// expectMessage skips messages until one of the given type arrives. An
+// unexpected error message fails the test.
+func expectMessage(t *testing.T, conn *websocket.Conn, typ string) serverMessage {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg serverMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("waiting for a %s message: %v", typ, err)
+		}
+		if msg.Type == typ {
+			return msg
+		}
+		if msg.Type == "error" {
+			t.Fatalf("waiting for a %s message: got error %q", typ, msg.Text)
+		}
+	}
+}
+
+func login(t *testing.T, url, username, password string) *websocket.Conn {
+	t.Helper()
+	conn := dialGateway(t, url)
+	err := conn.WriteJSON(clientMessage{Type: "login", Username: username, Password: password})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestGatewayLogin(t *testing.T) {
+	url := newTestGateway(t, "secret")
+
+	conn := dialGateway(t, url)
+	if err := conn.WriteJSON(clientMessage{Type: "status"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := expectMessage(t, conn, "error"); msg.Text != "log in first" {
+		t.Errorf("command before login: got %q", msg.Text)
+	}
+
+	for _, tc := range []struct {
+		username, password string
+		want               string
+	}{
+		{username: "army_moves.*", password: "secret", want: "a username is"},
+		{username: "", password: "secret", want: "a username is"},
+		{username: "alice", password: "guess", want: "wrong password"},
+	} {
+		conn := login(t, url, tc.username, tc.password)
+		if msg := expectMessage(t, conn, "error"); !strings.Contains(msg.Text, tc.want) {
+			t.Errorf("%q with password %q: got %q, want %q", tc.username, tc.password, msg.Text, tc.want)
+		}
+	}
+
+	alice := login(t, url, "alice", "secret")
+	msg := expectMessage(t, alice, "state")
+	if msg.Player == nil || msg.Player.Username != "alice" {
+		t.Fatalf("alice got state %+v", msg.Player)
+	}
+
+	other := login(t, url, "alice", "secret")
+	if msg := expectMessage(t, other, "error"); !strings.Contains(msg.Text, "already playing") {
+		t.Errorf("second alice: got %q", msg.Text)
+	}
+
+	// the name is free again once alice's session is over
+	alice.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn := login(t, url, "alice", "secret")
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var msg serverMessage
+		for msg.Type != "state" && msg.Type != "error" {
+			if err := conn.ReadJSON(&msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if msg.Type == "state" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("alice could not log in again: %s", msg.Text)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGatewayCommands(t *testing.T) {
+	url := newTestGateway(t, "")
+	alice := login(t, url, "alice", "")
+	expectMessage(t, alice, "state")
+
+	for _, tc := range []struct {
+		cmd  clientMessage
+		want string
+	}{
+		{cmd: clientMessage{Type: "spawn", Location: "atlantis", Rank: "infantry"}, want: "error"},
+		{cmd: clientMessage{Type: "move", Location: "asia", Units: []int{1}}, want: "error"},
+		{cmd: clientMessage{Type: "dance"}, want: "error"},
+		{cmd: clientMessage{Type: "spawn", Location: "europe", Rank: "infantry"}, want: "state"},
+		{cmd: clientMessage{Type: "status"}, want: "state"},
+	} {
+		if err := alice.WriteJSON(tc.cmd); err != nil {
+			t.Fatal(err)
+		}
+		alice.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var msg serverMessage
+		if err := alice.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type != tc.want {
+			t.Errorf("%+v: got %s %q, want %s", tc.cmd, msg.Type, msg.Text, tc.want)
+		}
+	}
+
+	if err := alice.WriteJSON(clientMessage{Type: "status"}); err != nil {
+		t.Fatal(err)
+	}
+	msg := expectMessage(t, alice, "state")
+	if units := msg.Player.Units; len(units) != 1 || units[1].Location != "europe" {
+		t.Errorf("alice has units %+v", units)
+	}
+}
+
+func TestGatewayForwardsMoves(t *testing.T) {
+	url := newTestGateway(t, "")
+	alice := login(t, url, "alice", "")
+	expectMessage(t, alice, "state")
+	// bob's state comes after bob's subscriptions are in place
+	bob := login(t, url, "bob", "")
+	expectMessage(t, bob, "state")
+
+	for _, cmd := range []clientMessage{
+		{Type: "spawn", Location: "europe", Rank: "infantry"},
+		{Type: "move", Location: "asia", Units: []int{1}},
+	} {
+		if err := alice.WriteJSON(cmd); err != nil {
+			t.Fatal(err)
+		}
+		expectMessage(t, alice, "state")
+	}
+
+	msg := expectMessage(t, bob, "move")
+	if msg.Move == nil || msg.Move.Player.Username != "alice" || msg.Move.ToLocation != "asia" {
+		t.Errorf("bob got move %+v", msg.Move)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/albsko/learn-pub-sub/internal/gamelogic"
+	"github.com/albsko/learn-pub-sub/internal/pubsub"
+	"github.com/albsko/learn-pub-sub/internal/routing"
+)
+
+func (s *session) handlerMove() pubsub.Handler[gamelogic.ArmyMove] {
+	return func(d pubsub.Delivery[gamelogic.ArmyMove]) pubsub.AckType {
+		mv := d.Body
+		msg := serverMessage{
+			Type: "move",
+			Text: fmt.Sprintf("%s is moving %d unit(s) to %s", mv.Player.Username, len(mv.Units), mv.ToLocation),
+			Move: &mv,
+		}
+		switch s.gs.HandleMove(d.Body) {
+		case gamelogic.MoveOutcomeSamePlayer:
+			return pubsub.Ack
+		case gamelogic.MoveOutComeSafe:
+			s.send(msg)
+			return pubsub.Ack
+		case gamelogic.MoveOutcomeMakeWar:
+			msg.Text += fmt.Sprintf(", you are at war with %s!", mv.Player.Username)
+			s.send(msg)
+			err := pubsub.Publish(
+				d.Context(),
+				s.g.publisher,
+				routing.ExchangePerilTopic,
+				routing.WarRecognitionsPrefix+"."+s.gs.GetUsername(),
+				gamelogic.RecognitionOfWar{
+					Attacker: d.Body.Player,
+					Defender: s.gs.GetPlayerSnap(),
+				},
+				pubsub.WithCorrelationID(d.Cause()),
+			)
+			return s.settle(err)
+		}
+
+		s.send(serverMessage{Type: "error", Text: "unknown move outcome"})
+		return pubsub.NackDiscard
+	}
+}
+
+func (s *session) handlerWar() pubsub.Handler[gamelogic.RecognitionOfWar] {
+	return func(d pubsub.Delivery[gamelogic.RecognitionOfWar]) pubsub.AckType {
+		warOutcome, winner, loser := s.gs.HandleWar(d.Body)
+		var text string
+		switch warOutcome {
+		case gamelogic.WarOutcomeNotInvolved:
+			// the attacker fights it from their own copy
+			return pubsub.Ack
+		case gamelogic.WarOutcomeNoUnits:
+			return pubsub.NackDiscard
+		case gamelogic.WarOutcomeOpponentWon, gamelogic.WarOutcomeYouWon:
+			text = fmt.Sprintf("%s won a war against %s", winner, loser)
+		case gamelogic.WarOutcomeDraw:
+			text = fmt.Sprintf("A war between %s and %s resulted in a draw", winner, loser)
+		default:
+			s.send(serverMessage{Type: "error", Text: "unknown war outcome"})
+			return pubsub.NackDiscard
+		}
+
+		s.send(serverMessage{Type: "war", Text: text})
+		s.sendState()
+		err := pubsub.Publish(
+			d.Context(),
+			s.g.publisher,
+			routing.ExchangePerilTopic,
+			routing.GameLogSlug+"."+s.gs.GetUsername(),
+			routing.GameLog{
+				Username:    s.gs.GetUsername(),
+				CurrentTime: time.Now(),
+				Message:     text,
+			},
+			pubsub.WithCodec(pubsub.JSONCodec),
+			pubsub.WithCorrelationID(d.Cause()),
+		)
+		return s.settle(err)
+	}
+}
+
+func (s *session) handlerPause() pubsub.Handler[routing.PlayingState] {
+	return func(d pubsub.Delivery[routing.PlayingState]) pubsub.AckType {
+		s.gs.HandlePause(d.Body)
+		text := "The game is resumed"
+		if d.Body.IsPaused {
+			text = "The game is paused"
+		}
+		s.send(serverMessage{Type: "pause", Text: text, Paused: d.Body.IsPaused})
+		return pubsub.Ack
+	}
+}
+
+// settle acks a message whose follow-up publish succeeded and tells the
+// player about the error otherwise.
+func (s *session) settle(err error) pubsub.AckType {
+	if err != nil {
+		s.send(serverMessage{Type: "error", Text: err.Error()})
+	}
+	return pubsub.SettleFollowUp(err)
+}
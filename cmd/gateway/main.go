@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/albsko/learn-pub-sub/internal/config"
+	"github.com/albsko/learn-pub-sub/internal/pubsub"
+	"github.com/albsko/learn-pub-sub/internal/routing"
+	"github.com/gorilla/websocket"
+)
+
+//go:embed static
+var static embed.FS
+
+// gateway lets browsers play Peril. Each WebSocket is one player, for whom
+// the gateway does what cmd/client does for a terminal.
+type gateway struct {
+	cfg       config.Config
+	broker    *pubsub.ConnectionManager
+	publisher *pubsub.ConfirmingPublisher
+	rpc       *pubsub.RPCClient
+	logger    *slog.Logger
+	upgrader  websocket.Upgrader
+
+	// ctx ends every session when the gateway shuts down
+	ctx      context.Context
+	sessions sync.WaitGroup
+
+	mu      sync.Mutex
+	players map[string]bool
+}
+
+func main() {
+	cfg, err := config.Load(os.Args[0], os.Args[1:])
+	if errors.Is(err, config.ErrPrintConfig) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println("Starting Peril gateway...")
+
+	dial, err := cfg.Broker.Dial()
+	if err != nil {
+		log.Fatalf("failed preparing connection: %+v", err)
+	}
+	broker, err := pubsub.NewConnectionManager(
+		dial,
+		pubsub.WithBackoff(cfg.Broker.ReconnectInitial, cfg.Broker.ReconnectMax),
+	)
+	if err != nil {
+		log.Fatalf("failed connecting to broker: %+v", err)
+	}
+	defer broker.Close()
+
+	if cfg.Broker.STOMP() || cfg.Broker.MQTT() {
+		// neither STOMP nor MQTT can declare exchanges
+		fmt.Println("Connected over STOMP or MQTT, expecting the topology to exist (perilctl topology declare)")
+	} else {
+		err = pubsub.DeclareTopology(broker, routing.PerilTopology())
+		if err != nil {
+			log.Fatalf("failed declaring topology (run perilctl topology verify for details): %+v", err)
+		}
+	}
+
+	confirmCh, err := broker.Channel()
+	if err != nil {
+		log.Fatalf("failed creating channel: %+v", err)
+	}
+	publisher, err := pubsub.NewConfirmingPublisher(confirmCh, 5*time.Second)
+	if err != nil {
+		log.Fatalf("failed creating confirming publisher: %+v", err)
+	}
+
+	rpc, err := pubsub.NewRPCClient(broker)
+	if err != nil {
+		log.Fatalf("failed creating rpc client: %+v", err)
+	}
+	defer rpc.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	g := &gateway{
+		cfg:       cfg,
+		broker:    broker,
+		publisher: publisher,
+		rpc:       rpc,
+		logger:    slog.New(slog.NewTextHandler(os.Stderr, nil)),
+		ctx:       ctx,
+		players:   map[string]bool{},
+	}
+
+	files, err := fs.Sub(static, "static")
+	if err != nil {
+		log.Fatalf("failed loading the browser client: %+v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.FS(files)))
+	mux.HandleFunc("/ws", g.serveWS)
+
+	srv := &http.Server{
+		Addr:              cfg.Gateway.Listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("failed serving: %v", err)
+		}
+	}()
+	fmt.Printf("Serving the game on http://%s/\n", cfg.Gateway.Listen)
+
+	<-ctx.Done()
+	fmt.Println("\nShutting down gateway...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("error: %v", err)
+	}
+	// WebSockets are not closed by Shutdown, the sessions end with ctx
+	g.sessions.Wait()
+}
+
+func (g *gateway) serveWS(w http.ResponseWriter, r *http.Request) {
+	conn, err := g.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has replied with the error
+		return
+	}
+	g.sessions.Add(1)
+	go func() {
+		defer g.sessions.Done()
+		newSession(g, conn).run()
+	}()
+}
+
+// claim reserves a username for one session of this gateway. The server's
+// lobby rejects names taken through other clients.
+func (g *gateway) claim(username string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.players[username] {
+		return false
+	}
+	g.players[username] = true
+	return true
+}
+
+func (g *gateway) release(username string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.players, username)
+}
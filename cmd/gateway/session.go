@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/albsko/learn-pub-sub/internal/gamelogic"
+	"github.com/albsko/learn-pub-sub/internal/pubsub"
+	"github.com/albsko/learn-pub-sub/internal/routing"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	loginTimeout = 30 * time.Second
+	pongWait     = 60 * time.Second
+	pingPeriod   = pongWait * 9 / 10
+	writeWait    = 10 * time.Second
+)
+
+// usernames end up in routing keys, where dots and wildcards would match
+// other players' messages
+var validUsername = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// clientMessage is what the browser sends. The first message has to be a
+// login; after that:
+//
+//	{"type": "spawn", "location": "europe", "rank": "infantry"}
+//	{"type": "move", "location": "asia", "units": [1, 2]}
+//	{"type": "status"}
+//	{"type": "players"}
+type clientMessage struct {
+	Type     string `json:"type"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Location string `json:"location,omitempty"`
+	Rank     string `json:"rank,omitempty"`
+	Units    []int  `json:"units,omitempty"`
+}
+
+// serverMessage is what the gateway sends: the player's state after every
+// change, the game events behind those changes, and errors.
+type serverMessage struct {
+	// Type is state, move, war, pause, players, info or error.
+	Type    string              `json:"type"`
+	Text    string              `json:"text,omitempty"`
+	Player  *gamelogic.Player   `json:"player,omitempty"`
+	Paused  bool                `json:"paused,omitempty"`
+	Move    *gamelogic.ArmyMove `json:"move,omitempty"`
+	Players []string            `json:"players,omitempty"`
+}
+
+type session struct {
+	g    *gateway
+	conn *websocket.Conn
+	out  chan serverMessage
+	gs   *gamelogic.GameState
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newSession(g *gateway, conn *websocket.Conn) *session {
+	ctx, cancel := context.WithCancel(g.ctx)
+	return &session{
+		g:      g,
+		conn:   conn,
+		out:    make(chan serverMessage, 64),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+func (s *session) run() {
+	defer s.conn.Close()
+
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		s.write()
+	}()
+	defer func() {
+		s.cancel()
+		<-writerDone
+	}()
+	go func() {
+		// unblocks the reader when the gateway shuts down
+		<-s.ctx.Done()
+		s.conn.SetReadDeadline(time.Now())
+	}()
+
+	s.conn.SetReadLimit(4096)
+	username, err := s.login()
+	if err != nil {
+		s.send(serverMessage{Type: "error", Text: err.Error()})
+		return
+	}
+	defer s.g.release(username)
+	fmt.Printf("%s joined from %s\n", username, s.conn.RemoteAddr())
+
+	s.gs = gamelogic.NewGameState(username)
+	s.gs.Rules = s.g.cfg.Game.Rules()
+	if err := s.joinLobby(); err != nil {
+		s.send(serverMessage{Type: "error", Text: err.Error()})
+		return
+	}
+	defer s.leaveLobby()
+
+	subs, err := s.subscribe()
+	for _, sub := range subs {
+		defer func(sub *pubsub.Subscription) { <-sub.Done() }(sub)
+	}
+	// ending the context stops the subscriptions before they are waited for
+	defer s.cancel()
+	if err != nil {
+		s.send(serverMessage{Type: "error", Text: err.Error()})
+		return
+	}
+	s.sendState()
+
+	s.conn.SetReadDeadline(time.Now().Add(pongWait))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	for {
+		_, data, err := s.conn.ReadMessage()
+		if err != nil {
+			fmt.Printf("%s left\n", username)
+			return
+		}
+		var msg clientMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			s.send(serverMessage{Type: "error", Text: fmt.Sprintf("could not decode command: %v", err)})
+			continue
+		}
+		s.handle(msg)
+	}
+}
+
+// write sends the queued messages and keeps the connection alive until the
+// session ends. A slow browser holds up only its own session.
+func (s *session) write() {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg := <-s.out:
+			s.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := s.conn.WriteJSON(msg); err != nil {
+				s.cancel()
+				return
+			}
+		case <-ticker.C:
+			if err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				s.cancel()
+				return
+			}
+		case <-s.ctx.Done():
+			// flush what the session said last, such as why it ended
+			for {
+				select {
+				case msg := <-s.out:
+					s.conn.SetWriteDeadline(time.Now().Add(writeWait))
+					if s.conn.WriteJSON(msg) != nil {
+						return
+					}
+				default:
+					s.conn.WriteControl(websocket.CloseMessage,
+						websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+						time.Now().Add(writeWait))
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *session) send(msg serverMessage) {
+	select {
+	case s.out <- msg:
+	case <-s.ctx.Done():
+	}
+}
+
+func (s *session) sendState() {
+	p := s.gs.GetPlayerSnap()
+	s.send(serverMessage{Type: "state", Player: &p, Paused: s.gs.IsPaused()})
+}
+
+func (s *session) login() (string, error) {
+	s.conn.SetReadDeadline(time.Now().Add(loginTimeout))
+	var msg clientMessage
+	if err := s.conn.ReadJSON(&msg); err != nil {
+		return "", fmt.Errorf("could not read login: %v", err)
+	}
+	if msg.Type != "login" {
+		return "", errors.New("log in first")
+	}
+	if !validUsername.MatchString(msg.Username) {
+		return "", errors.New("a username is 1 to 32 letters, digits, _ or -")
+	}
+	want := s.g.cfg.Gateway.Password
+	if want != "" && subtle.ConstantTimeCompare([]byte(msg.Password), []byte(want)) != 1 {
+		return "", errors.New("wrong password")
+	}
+	if !s.g.claim(msg.Username) {
+		return "", fmt.Errorf("username %s is already playing", msg.Username)
+	}
+	return msg.Username, nil
+}
+
+// joinLobby registers the player with the server and catches up on the pause
+// state, like cmd/client does. The game can still be played if the server is
+// not answering.
+func (s *session) joinLobby() error {
+	ctx, cancel := context.WithTimeout(s.ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := pubsub.Call[routing.JoinRequest, routing.PlayersResponse](
+		ctx,
+		s.g.rpc,
+		routing.ExchangePerilDirect,
+		routing.RPCJoinKey,
+		routing.JoinRequest{Username: s.gs.GetUsername()},
+	)
+	var remote *pubsub.RemoteError
+	if errors.As(err, &remote) {
+		return fmt.Errorf("could not join the game: %s", remote.Message)
+	}
+	if err != nil {
+		s.send(serverMessage{Type: "info", Text: fmt.Sprintf("server is not answering (%s), playing without a lobby", err)})
+		return nil
+	}
+
+	state, err := pubsub.Call[routing.PauseStateRequest, routing.PlayingState](
+		ctx,
+		s.g.rpc,
+		routing.ExchangePerilDirect,
+		routing.RPCPauseStateKey,
+		routing.PauseStateRequest{},
+	)
+	if err != nil {
+		s.send(serverMessage{Type: "info", Text: fmt.Sprintf("could not fetch pause state: %s", err)})
+		return nil
+	}
+	s.gs.HandlePause(state)
+	return nil
+}
+
+func (s *session) leaveLobby() {
+	// the session's context may be over already
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	_, err := pubsub.Call[routing.LeaveRequest, routing.PlayersResponse](
+		ctx,
+		s.g.rpc,
+		routing.ExchangePerilDirect,
+		routing.RPCLeaveKey,
+		routing.LeaveRequest{Username: s.gs.GetUsername()},
+	)
+	if err != nil {
+		log.Printf("%s could not leave the lobby: %s", s.gs.GetUsername(), err)
+	}
+}
+
+func (s *session) subscribe() ([]*pubsub.Subscription, error) {
+	cfg := s.g.cfg.Subscriptions
+	// a war handled twice would kill the same units twice
+	dedup := pubsub.NewMemoryDedupStore(10000, time.Hour)
+	username := s.gs.GetUsername()
+	var subs []*pubsub.Subscription
+
+	sub, err := pubsub.Subscribe(
+		s.ctx,
+		s.g.broker,
+		routing.ExchangePerilTopic,
+		routing.ArmyMovesPrefix+"."+username,
+		routing.ArmyMovesPrefix+".*",
+		pubsub.TransientSimpleQueue,
+		pubsub.Chain(s.handlerMove(), pubsub.HandlerMiddleware[gamelogic.ArmyMove](s.g.logger, dedup, cfg.Moves.Timeout)...),
+		append(cfg.Moves.Options(), pubsub.WithDefaultCodec(pubsub.JSONCodec))...,
+	)
+	if err != nil {
+		return subs, fmt.Errorf("could not subscribe to army moves: %v", err)
+	}
+	subs = append(subs, sub)
+
+	sub, err = pubsub.Subscribe(
+		s.ctx,
+		s.g.broker,
+		routing.ExchangePerilTopic,
+		routing.WarRecognitionsPrefix+"."+username,
+		routing.WarRecognitionsPrefix+".*",
+		pubsub.DurableSimpleQueue,
+		pubsub.Chain(s.handlerWar(), pubsub.HandlerMiddleware[gamelogic.RecognitionOfWar](s.g.logger, dedup, cfg.War.Timeout)...),
+		append(
+			cfg.War.Options(),
+			pubsub.WithDefaultCodec(pubsub.JSONCodec),
+			pubsub.WithDecodeFailurePolicy(pubsub.DecodeQuarantine),
+		)...,
+	)
+	if err != nil {
+		return subs, fmt.Errorf("could not subscribe to war declarations: %v", err)
+	}
+	subs = append(subs, sub)
+
+	sub, err = pubsub.Subscribe(
+		s.ctx,
+		s.g.broker,
+		routing.ExchangePerilDirect,
+		routing.PauseKey+"."+username,
+		routing.PauseKey,
+		pubsub.TransientSimpleQueue,
+		pubsub.Chain(
+			s.handlerPause(),
+			pubsub.Recover[routing.PlayingState](s.g.logger, pubsub.NackDiscard),
+			pubsub.Logging[routing.PlayingState](s.g.logger),
+		),
+		pubsub.WithDefaultCodec(pubsub.JSONCodec),
+	)
+	if err != nil {
+		return subs, fmt.Errorf("could not subscribe to pause: %v", err)
+	}
+	return append(subs, sub), nil
+}
+
+// handle carries out a command from the browser the way the terminal client
+// carries out the same command typed at its prompt.
+func (s *session) handle(msg clientMessage) {
+	switch msg.Type {
+	case "spawn":
+		if err := s.gs.CommandSpawn([]string{"spawn", msg.Location, msg.Rank}); err != nil {
+			s.send(serverMessage{Type: "error", Text: err.Error()})
+			return
+		}
+		s.sendState()
+	case "move":
+		words := []string{"move", msg.Location}
+		for _, id := range msg.Units {
+			words = append(words, strconv.Itoa(id))
+		}
+		mv, err := s.gs.CommandMove(words)
+		if err != nil {
+			s.send(serverMessage{Type: "error", Text: err.Error()})
+			return
+		}
+		err = pubsub.Publish(
+			s.ctx,
+			s.g.publisher,
+			routing.ExchangePerilTopic,
+			routing.ArmyMovesPrefix+"."+mv.Player.Username,
+			mv,
+			pubsub.WithCodec(pubsub.JSONCodec),
+		)
+		if err != nil {
+			s.send(serverMessage{Type: "error", Text: fmt.Sprintf("could not publish move: %s", err)})
+			return
+		}
+		s.sendState()
+	case "status":
+		s.sendState()
+	case "players":
+		ctx, cancel := context.WithTimeout(s.ctx, 5*time.Second)
+		resp, err := pubsub.Call[routing.PlayersRequest, routing.PlayersResponse](
+			ctx,
+			s.g.rpc,
+			routing.ExchangePerilDirect,
+			routing.RPCPlayersKey,
+			routing.PlayersRequest{},
+		)
+		cancel()
+		if err != nil {
+			s.send(serverMessage{Type: "error", Text: fmt.Sprintf("could not list players: %s", err)})
+			return
+		}
+		s.send(serverMessage{Type: "players", Players: resp.Players})
+	default:
+		s.send(serverMessage{Type: "error", Text: fmt.Sprintf("unknown command %q", msg.Type)})
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/albsko/learn-pub-sub/internal/config"
+	"github.com/albsko/learn-pub-sub/internal/perilpb"
+	"github.com/albsko/learn-pub-sub/internal/pubsub"
+	"github.com/albsko/learn-pub-sub/internal/routing"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// grpcgateway serves the Peril gRPC API in internal/perilpb for tools that
+// do not speak AMQP.
+func main() {
+	cfg, err := config.Load(os.Args[0], os.Args[1:])
+	if errors.Is(err, config.ErrPrintConfig) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println("Starting Peril gRPC gateway...")
+
+	dial, err := cfg.Broker.Dial()
+	if err != nil {
+		log.Fatalf("failed preparing connection: %+v", err)
+	}
+	broker, err := pubsub.NewConnectionManager(
+		dial,
+		pubsub.WithBackoff(cfg.Broker.ReconnectInitial, cfg.Broker.ReconnectMax),
+	)
+	if err != nil {
+		log.Fatalf("failed connecting to broker: %+v", err)
+	}
+	defer broker.Close()
+
+	if cfg.Broker.STOMP() || cfg.Broker.MQTT() {
+		// neither STOMP nor MQTT can declare exchanges
+		fmt.Println("Connected over STOMP or MQTT, expecting the topology to exist (perilctl topology declare)")
+	} else {
+		err = pubsub.DeclareTopology(broker, routing.PerilTopology())
+		if err != nil {
+			log.Fatalf("failed declaring topology (run perilctl topology verify for details): %+v", err)
+		}
+	}
+
+	confirmCh, err := broker.Channel()
+	if err != nil {
+		log.Fatalf("failed creating channel: %+v", err)
+	}
+	publisher, err := pubsub.NewConfirmingPublisher(confirmCh, 5*time.Second)
+	if err != nil {
+		log.Fatalf("failed creating confirming publisher: %+v", err)
+	}
+
+	var opts []grpc.ServerOption
+	if cfg.GRPC.Token != "" {
+		opts = append(opts,
+			grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+				if err := authorize(ctx, cfg.GRPC.Token); err != nil {
+					return nil, err
+				}
+				return handler(ctx, req)
+			}),
+			grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+				if err := authorize(ss.Context(), cfg.GRPC.Token); err != nil {
+					return err
+				}
+				return handler(srv, ss)
+			}),
+		)
+	}
+	srv := grpc.NewServer(opts...)
+	perilpb.RegisterPerilServer(srv, &service{
+		broker:    broker,
+		publisher: publisher,
+		logger:    slog.New(slog.NewTextHandler(os.Stderr, nil)),
+	})
+
+	ln, err := net.Listen("tcp", cfg.GRPC.Listen)
+	if err != nil {
+		log.Fatalf("failed to listen: %v", err)
+	}
+	go func() {
+		if err := srv.Serve(ln); err != nil {
+			log.Fatalf("failed serving: %v", err)
+		}
+	}()
+	fmt.Printf("Serving gRPC on %s\n", ln.Addr())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	<-ctx.Done()
+	fmt.Println("\nShutting down gRPC gateway...")
+	// ends the Watch streams, which GracefulStop would wait for
+	srv.Stop()
+}
+
+func authorize(ctx context.Context, want string) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		token, ok := strings.CutPrefix(v, "Bearer ")
+		if ok && subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "missing or wrong bearer token")
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"github.com/albsko/learn-pub-sub/internal/gamelogic"
+	"github.com/albsko/learn-pub-sub/internal/perilpb"
+	"github.com/albsko/learn-pub-sub/internal/pubsub"
+	"github.com/albsko/learn-pub-sub/internal/routing"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type service struct {
+	perilpb.UnimplementedPerilServer
+
+	broker    *pubsub.ConnectionManager
+	publisher *pubsub.ConfirmingPublisher
+	logger    *slog.Logger
+}
+
+func (s *service) PublishMove(ctx context.Context, mv *perilpb.ArmyMove) (*perilpb.PublishResponse, error) {
+	if err := checkUsername(mv.GetPlayer().GetUsername(), "player.username"); err != nil {
+		return nil, err
+	}
+	key := routing.ArmyMovesPrefix + "." + mv.GetPlayer().GetUsername()
+	return s.publish(ctx, routing.ExchangePerilTopic, key, gamelogic.ArmyMove{
+		Player:     fromPBPlayer(mv.GetPlayer()),
+		Units:      fromPBUnits(mv.GetUnits()),
+		ToLocation: gamelogic.Location(mv.GetToLocation()),
+	})
+}
+
+func (s *service) DeclareWar(ctx context.Context, rw *perilpb.RecognitionOfWar) (*perilpb.PublishResponse, error) {
+	if err := checkUsername(rw.GetAttacker().GetUsername(), "attacker.username"); err != nil {
+		return nil, err
+	}
+	if err := checkUsername(rw.GetDefender().GetUsername(), "defender.username"); err != nil {
+		return nil, err
+	}
+	key := routing.WarRecognitionsPrefix + "." + rw.GetDefender().GetUsername()
+	return s.publish(ctx, routing.ExchangePerilTopic, key, gamelogic.RecognitionOfWar{
+		Attacker: fromPBPlayer(rw.GetAttacker()),
+		Defender: fromPBPlayer(rw.GetDefender()),
+	})
+}
+
+func (s *service) PublishGameLog(ctx context.Context, gl *perilpb.GameLog) (*perilpb.PublishResponse, error) {
+	if err := checkUsername(gl.GetUsername(), "username"); err != nil {
+		return nil, err
+	}
+	if gl.GetCurrentTime() == nil {
+		return nil, status.Error(codes.InvalidArgument, "current_time is required")
+	}
+	key := routing.GameLogSlug + "." + gl.GetUsername()
+	return s.publish(ctx, routing.ExchangePerilTopic, key, routing.GameLog{
+		CurrentTime: gl.GetCurrentTime().AsTime(),
+		Message:     gl.GetMessage(),
+		Username:    gl.GetUsername(),
+	})
+}
+
+// SetPlayingState reaches the clients but not the server's lobby, which
+// tells joining clients whether the game is paused. The server's admin API
+// does both.
+func (s *service) SetPlayingState(ctx context.Context, ps *perilpb.PlayingState) (*perilpb.PublishResponse, error) {
+	return s.publish(ctx, routing.ExchangePerilDirect, routing.PauseKey, routing.PlayingState{
+		IsPaused: ps.GetIsPaused(),
+	})
+}
+
+func (s *service) publish(ctx context.Context, exchange, key string, val interface{}) (*perilpb.PublishResponse, error) {
+	err := pubsub.Publish(ctx, s.publisher, exchange, key, val, pubsub.WithCodec(pubsub.JSONCodec))
+	var unroutable *pubsub.UnroutableError
+	if errors.As(err, &unroutable) {
+		return nil, status.Errorf(codes.FailedPrecondition, "no queue is bound for %s: %v", key, err)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "could not publish: %v", err)
+	}
+	return &perilpb.PublishResponse{RoutingKey: key}, nil
+}
+
+func (s *service) WatchArmyMoves(req *perilpb.WatchArmyMovesRequest, stream grpc.ServerStreamingServer[perilpb.ArmyMove]) error {
+	key := routing.ArmyMovesPrefix + ".*"
+	if req.GetUsername() != "" {
+		if err := checkUsername(req.GetUsername(), "username"); err != nil {
+			return err
+		}
+		key = routing.ArmyMovesPrefix + "." + req.GetUsername()
+	}
+	return watch(stream.Context(), s, routing.ExchangePerilTopic, watcherQueue(routing.ArmyMovesPrefix), key, pubsub.TransientSimpleQueue,
+		func(mv gamelogic.ArmyMove) error {
+			return stream.Send(&perilpb.ArmyMove{
+				Player:     toPBPlayer(mv.Player),
+				Units:      toPBUnits(mv.Units),
+				ToLocation: string(mv.ToLocation),
+			})
+		},
+		pubsub.WithDefaultCodec(pubsub.JSONCodec),
+	)
+}
+
+func (s *service) WatchWars(_ *perilpb.WatchWarsRequest, stream grpc.ServerStreamingServer[perilpb.RecognitionOfWar]) error {
+	// a queue of its own, so watching does not take wars from the players
+	return watch(stream.Context(), s, routing.ExchangePerilTopic, watcherQueue(routing.WarRecognitionsPrefix), routing.WarRecognitionsPrefix+".*", pubsub.TransientSimpleQueue,
+		func(rw gamelogic.RecognitionOfWar) error {
+			return stream.Send(&perilpb.RecognitionOfWar{
+				Attacker: toPBPlayer(rw.Attacker),
+				Defender: toPBPlayer(rw.Defender),
+			})
+		},
+		pubsub.WithDefaultCodec(pubsub.JSONCodec),
+	)
+}
+
+func (s *service) WatchGameLogs(req *perilpb.WatchGameLogsRequest, stream grpc.ServerStreamingServer[perilpb.GameLog]) error {
+	send := func(gl routing.GameLog) error {
+		return stream.Send(&perilpb.GameLog{
+			CurrentTime: timestamppb.New(gl.CurrentTime),
+			Message:     gl.Message,
+			Username:    gl.Username,
+		})
+	}
+	// game logs are decoded by content type; older clients publish gob
+	if req.GetSince() != nil {
+		return watch(stream.Context(), s, routing.ExchangePerilTopic, routing.GameLogStream, routing.GameLogSlug+".*", pubsub.StreamQueue, send,
+			pubsub.WithDefaultCodec(pubsub.GobCodec),
+			pubsub.WithPrefetch(100, 0),
+			pubsub.WithStreamOffset(pubsub.StreamAt(req.GetSince().AsTime())),
+		)
+	}
+	return watch(stream.Context(), s, routing.ExchangePerilTopic, watcherQueue(routing.GameLogSlug), routing.GameLogSlug+".*", pubsub.TransientSimpleQueue, send,
+		pubsub.WithDefaultCodec(pubsub.GobCodec),
+	)
+}
+
+// watch sends what a subscription receives to a gRPC stream until the
+// client goes away or the subscription fails. Deliveries are handled one at
+// a time, as a stream may only be sent to by one goroutine.
+func watch[T any](ctx context.Context, s *service, exchange, queue, key string, queueType pubsub.SimpleQueueType, send func(T) error, opts ...pubsub.SubscribeOption) error {
+	sub, err := pubsub.Subscribe(
+		ctx,
+		s.broker,
+		exchange,
+		queue,
+		key,
+		queueType,
+		pubsub.Chain(
+			func(d pubsub.Delivery[T]) pubsub.AckType {
+				// a failed send means the stream is gone and its context with
+				// it. The delivery was only ever meant for this watcher, so it
+				// is acked rather than dead-lettered like a game event
+				// nobody could handle.
+				send(d.Body)
+				return pubsub.Ack
+			},
+			pubsub.Recover[T](s.logger, pubsub.NackDiscard),
+		),
+		append(opts, pubsub.WithConcurrency(1))...,
+	)
+	if err != nil {
+		return status.Errorf(codes.Unavailable, "could not subscribe: %v", err)
+	}
+	<-sub.Done()
+	if err := sub.Err(); err != nil {
+		return status.Errorf(codes.Unavailable, "subscription failed: %v", err)
+	}
+	return status.FromContextError(ctx.Err()).Err()
+}
+
+// watcherQueue names the queue of one Watch call, e.g. army_moves.grpc-1a2b3c4d.
+func watcherQueue(prefix string) string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return prefix + ".grpc-" + hex.EncodeToString(b)
+}
+
+// checkUsername rejects usernames that would change the meaning of the
+// routing keys they end up in.
+func checkUsername(username, field string) error {
+	if username == "" {
+		return status.Errorf(codes.InvalidArgument, "%s is required", field)
+	}
+	if strings.ContainsAny(username, ".*# ") {
+		return status.Errorf(codes.InvalidArgument, "%s must not contain dots, wildcards or spaces", field)
+	}
+	return nil
+}
+
+func toPBPlayer(p gamelogic.Player) *perilpb.Player {
+	units := make([]gamelogic.Unit, 0, len(p.Units))
+	for _, u := range p.Units {
+		units = append(units, u)
+	}
+	sort.Slice(units, func(i, j int) bool { return units[i].ID < units[j].ID })
+	return &perilpb.Player{Username: p.Username, Units: toPBUnits(units)}
+}
+
+func toPBUnits(units []gamelogic.Unit) []*perilpb.Unit {
+	pb := make([]*perilpb.Unit, 0, len(units))
+	for _, u := range units {
+		pb = append(pb, &perilpb.Unit{
+			Id:       int64(u.ID),
+			Rank:     string(u.Rank),
+			Location: string(u.Location),
+		})
+	}
+	return pb
+}
+
+func fromPBPlayer(p *perilpb.Player) gamelogic.Player {
+	units := map[int]gamelogic.Unit{}
+	for _, u := range fromPBUnits(p.GetUnits()) {
+		units[u.ID] = u
+	}
+	return gamelogic.Player{Username: p.GetUsername(), Units: units}
+}
+
+func fromPBUnits(pb []*perilpb.Unit) []gamelogic.Unit {
+	units := make([]gamelogic.Unit, 0, len(pb))
+	for _, u := range pb {
+		units = append(units, gamelogic.Unit{
+			ID:       int(u.GetId()),
+			Rank:     gamelogic.UnitRank(u.GetRank()),
+			Location: gamelogic.Location(u.GetLocation()),
+		})
+	}
+	return units
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/albsko/learn-pub-sub/internal/perilpb"
+	"github.com/albsko/learn-pub-sub/internal/pubsub"
+	"github.com/albsko/learn-pub-sub/internal/routing"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func newTestService(t *testing.T) (*service, *pubsub.MemoryBroker) {
+	t.Helper()
+	b := pubsub.NewMemoryBroker()
+	broker, err := pubsub.NewConnectionManager(b.Dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { broker.Close() })
+	if err := pubsub.DeclareTopology(broker, routing.PerilTopology()); err != nil {
+		t.Fatal(err)
+	}
+	ch, err := broker.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher, err := pubsub.NewConfirmingPublisher(ch, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &service{
+		broker:    broker,
+		publisher: publisher,
+		logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}, b
+}
+
+func dialService(t *testing.T, s *service) perilpb.PerilClient {
+	t.Helper()
+	ln := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	perilpb.RegisterPerilServer(srv, s)
+	go srv.Serve(ln)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return ln.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return perilpb.NewPerilClient(conn)
+}
+
+func TestPublishValidation(t *testing.T) {
+	s, _ := newTestService(t)
+	client := dialService(t, s)
+	ctx := context.Background()
+
+	for name, call := range map[string]func() error{
+		"move without player": func() error {
+			_, err := client.PublishMove(ctx, &perilpb.ArmyMove{ToLocation: "europe"})
+			return err
+		},
+		"move with a wildcard username": func() error {
+			_, err := client.PublishMove(ctx, &perilpb.ArmyMove{Player: &perilpb.Player{Username: "*"}})
+			return err
+		},
+		"war without defender": func() error {
+			_, err := client.DeclareWar(ctx, &perilpb.RecognitionOfWar{Attacker: &perilpb.Player{Username: "alice"}})
+			return err
+		},
+		"war with a dotted attacker": func() error {
+			_, err := client.DeclareWar(ctx, &perilpb.RecognitionOfWar{
+				Attacker: &perilpb.Player{Username: "alice.bob"},
+				Defender: &perilpb.Player{Username: "carol"},
+			})
+			return err
+		},
+		"game log without time": func() error {
+			_, err := client.PublishGameLog(ctx, &perilpb.GameLog{Username: "alice", Message: "hi"})
+			return err
+		},
+		"watch with a spaced username": func() error {
+			stream, err := client.WatchArmyMoves(ctx, &perilpb.WatchArmyMovesRequest{Username: "a b"})
+			if err != nil {
+				return err
+			}
+			_, err = stream.Recv()
+			return err
+		},
+	} {
+		if code := status.Code(call()); code != codes.InvalidArgument {
+			t.Errorf("%s: got %v, want InvalidArgument", name, code)
+		}
+	}
+
+	// nobody watches army moves yet
+	_, err := client.PublishMove(ctx, &perilpb.ArmyMove{Player: &perilpb.Player{Username: "alice"}})
+	if code := status.Code(err); code != codes.FailedPrecondition {
+		t.Errorf("unroutable move: got %v, want FailedPrecondition", err)
+	}
+}
+
+func TestWatchArmyMoves(t *testing.T) {
+	s, _ := newTestService(t)
+	client := dialService(t, s)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := client.WatchArmyMoves(ctx, &perilpb.WatchArmyMovesRequest{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// moves are unroutable until the watcher's queue is bound
+	move := &perilpb.ArmyMove{Player: &perilpb.Player{Username: "alice"}, ToLocation: "europe"}
+	for {
+		resp, err := client.PublishMove(ctx, move)
+		if err == nil {
+			if resp.GetRoutingKey() != "army_moves.alice" {
+				t.Errorf("published with key %s", resp.GetRoutingKey())
+			}
+			break
+		}
+		if status.Code(err) != codes.FailedPrecondition {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	got, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.GetPlayer().GetUsername() != "alice" || got.GetToLocation() != "europe" {
+		t.Errorf("watched %v", got)
+	}
+
+	// the watcher only asked for alice's moves
+	_, err = client.PublishMove(ctx, &perilpb.ArmyMove{Player: &perilpb.Player{Username: "bob"}})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("bob's move reached a queue: %v", err)
+	}
+}
+
+func TestWatchAcksWhenSendFails(t *testing.T) {
+	s, b := newTestService(t)
+	ch, err := b.Connect().Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sent := make(chan struct{}, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- watch(ctx, s, routing.ExchangePerilTopic, "army_moves.grpc-test", routing.ArmyMovesPrefix+".*", pubsub.TransientSimpleQueue,
+			func(string) error {
+				sent <- struct{}{}
+				cancel()
+				return errors.New("stream closed")
+			},
+			pubsub.WithDefaultCodec(pubsub.JSONCodec),
+		)
+	}()
+
+	for published := false; !published; {
+		select {
+		case <-sent:
+			published = true
+		case <-time.After(10 * time.Millisecond):
+			if err := pubsub.PublishJSON(ch, routing.ExchangePerilTopic, "army_moves.alice", "move"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	select {
+	case err := <-done:
+		if status.Code(err) != codes.Canceled {
+			t.Errorf("watch returned %v, want Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("watch did not return after its stream went away")
+	}
+
+	// a move the watcher could not send is not a dead letter
+	msg, ok, err := ch.Get(routing.DeadLetterQueue(routing.ArmyMovesPrefix), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Errorf("dead-letter queue got %q", msg.Body)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/albsko/learn-pub-sub/internal/pubsub"
+	"github.com/albsko/learn-pub-sub/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const maxBodyPreview = 200
+
+func runDLQ(dial pubsub.DialFunc, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: perilctl dlq <list|inspect|replay|purge> ...")
+	}
+
+	conn, err := dial()
+	if err != nil {
+		return fmt.Errorf("failed connecting to broker: %v", err)
+	}
+	defer conn.Close()
+
+	err = pubsub.DeclareDeadLetterTopology(conn)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "list":
+		return dlqList(conn)
+	case "inspect", "replay":
+		flags := flag.NewFlagSet("dlq "+args[0], flag.ContinueOnError)
+		count := flags.Int("n", 0, "number of messages (default: all)")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		source, err := dlqSource(flags.Args())
+		if err != nil {
+			return err
+		}
+		if args[0] == "inspect" {
+			return dlqInspect(conn, source, *count)
+		}
+		return dlqReplay(conn, source, *count)
+	case "purge":
+		source, err := dlqSource(args[1:])
+		if err != nil {
+			return err
+		}
+		return dlqPurge(conn, source)
+	}
+	return fmt.Errorf("unknown dlq command: %s", args[0])
+}
+
+func dlqSource(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("expected one source, one of: %s", strings.Join(routing.DeadLetterSources, ", "))
+	}
+	if !slices.Contains(routing.DeadLetterSources, args[0]) {
+		return "", fmt.Errorf("unknown source %q, expected one of: %s", args[0], strings.Join(routing.DeadLetterSources, ", "))
+	}
+	return args[0], nil
+}
+
+func dlqList(broker pubsub.Broker) error {
+	ch, err := broker.Channel()
+	if err != nil {
+		return fmt.Errorf("could not create channel: %v", err)
+	}
+	defer ch.Close()
+
+	for _, source := range routing.DeadLetterSources {
+		queue, err := ch.QueueDeclarePassive(routing.DeadLetterQueue(source), true, false, false, false, nil)
+		if err != nil {
+			return fmt.Errorf("could not inspect queue: %v", err)
+		}
+		fmt.Printf("%-24s %d message(s)\n", queue.Name, queue.Messages)
+	}
+	return nil
+}
+
+func dlqInspect(broker pubsub.Broker, source string, count int) error {
+	ch, err := broker.Channel()
+	if err != nil {
+		return fmt.Errorf("could not create channel: %v", err)
+	}
+	// closing the channel returns every fetched message to the queue
+	defer ch.Close()
+
+	queueName := routing.DeadLetterQueue(source)
+	for i := 1; count <= 0 || i <= count; i++ {
+		msg, ok, err := ch.Get(queueName, false)
+		if err != nil {
+			return fmt.Errorf("could not get message: %v", err)
+		}
+		if !ok {
+			if i == 1 {
+				fmt.Printf("%s is empty\n", queueName)
+			}
+			return nil
+		}
+		printDeadLetter(i, msg)
+	}
+	return nil
+}
+
+func printDeadLetter(n int, msg amqp.Delivery) {
+	fmt.Printf("#%d routing-key=%s content-type=%s message-id=%s\n", n, msg.RoutingKey, msg.ContentType, msg.MessageId)
+	for _, death := range pubsub.Deaths(msg.Headers) {
+		fmt.Printf("   died: reason=%s queue=%s exchange=%s keys=%s count=%d at=%s\n",
+			death.Reason,
+			death.Queue,
+			death.Exchange,
+			strings.Join(death.RoutingKeys, ","),
+			death.Count,
+			death.Time.Format(time.RFC3339),
+		)
+	}
+	fmt.Printf("   body: %s\n", previewBody(msg.Body))
+}
+
+func previewBody(body []byte) string {
+	truncated := ""
+	if len(body) > maxBodyPreview {
+		body = body[:maxBodyPreview]
+		truncated = "..."
+	}
+	if utf8.Valid(body) {
+		return string(body) + truncated
+	}
+	return fmt.Sprintf("%q%s", body, truncated)
+}
+
+func dlqReplay(broker pubsub.Broker, source string, count int) error {
+	ch, err := broker.Channel()
+	if err != nil {
+		return fmt.Errorf("could not create channel: %v", err)
+	}
+	defer ch.Close()
+
+	publishCh, err := broker.Channel()
+	if err != nil {
+		return fmt.Errorf("could not create channel: %v", err)
+	}
+	publisher, err := pubsub.NewConfirmingPublisher(publishCh, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer publisher.Close()
+
+	queueName := routing.DeadLetterQueue(source)
+	queue, err := ch.QueueDeclarePassive(queueName, true, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("could not inspect queue: %v", err)
+	}
+	// messages that die again while replaying must not be picked up twice
+	if count <= 0 || count > queue.Messages {
+		count = queue.Messages
+	}
+
+	replayed, skipped := 0, 0
+	for i := 0; i < count; i++ {
+		msg, ok, err := ch.Get(queueName, false)
+		if err != nil {
+			return fmt.Errorf("could not get message: %v", err)
+		}
+		if !ok {
+			break
+		}
+
+		exchange, key, ok := pubsub.Origin(msg)
+		if !ok {
+			fmt.Printf("skipping message without x-death origin: %s\n", previewBody(msg.Body))
+			skipped++
+			continue
+		}
+
+		err = publisher.PublishWithContext(
+			context.Background(),
+			exchange,
+			key,
+			true,
+			false,
+			pubsub.Replaying(msg),
+		)
+		if err != nil {
+			msg.Nack(false, true)
+			return fmt.Errorf("could not replay message to %s/%s: %v", exchange, key, err)
+		}
+		err = msg.Ack(false)
+		if err != nil {
+			return fmt.Errorf("could not ack replayed message: %v", err)
+		}
+		replayed++
+	}
+
+	fmt.Printf("Replayed %d message(s) from %s, skipped %d\n", replayed, queueName, skipped)
+	return nil
+}
+
+func dlqPurge(broker pubsub.Broker, source string) error {
+	ch, err := broker.Channel()
+	if err != nil {
+		return fmt.Errorf("could not create channel: %v", err)
+	}
+	defer ch.Close()
+
+	queueName := routing.DeadLetterQueue(source)
+	n, err := ch.QueuePurge(queueName, false)
+	if err != nil {
+		return fmt.Errorf("could not purge queue: %v", err)
+	}
+	fmt.Printf("Purged %d message(s) from %s\n", n, queueName)
+	return nil
+}
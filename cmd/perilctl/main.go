@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/albsko/learn-pub-sub/internal/config"
+)
+
+func main() {
+	cfg, args, err := config.LoadArgs("perilctl", os.Args[1:])
+	if errors.Is(err, config.ErrPrintConfig) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(args) < 1 {
+		printUsage()
+		os.Exit(2)
+	}
+
+	dial, err := cfg.Broker.Dial()
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+
+	switch args[0] {
+	case "dlq":
+		err = runDLQ(dial, args[1:])
+	case "topology":
+		err = runTopology(dial, args[1:])
+	case "help", "-h", "--help":
+		printUsage()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n", args[0])
+		printUsage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: perilctl [config flags] <command> [arguments]")
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintln(os.Stderr, "* dlq list")
+	fmt.Fprintln(os.Stderr, "* dlq inspect [-n count] <source>")
+	fmt.Fprintln(os.Stderr, "* dlq replay [-n count] <source>")
+	fmt.Fprintln(os.Stderr, "* dlq purge <source>")
+	fmt.Fprintln(os.Stderr, "* topology declare")
+	fmt.Fprintln(os.Stderr, "* topology verify")
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/albsko/learn-pub-sub/internal/pubsub"
+	"github.com/albsko/learn-pub-sub/internal/routing"
+)
+
+func runTopology(dial pubsub.DialFunc, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: perilctl topology <declare|verify>")
+	}
+
+	conn, err := dial()
+	if err != nil {
+		return fmt.Errorf("failed connecting to broker: %v", err)
+	}
+	defer conn.Close()
+
+	switch args[0] {
+	case "declare":
+		err = pubsub.DeclareTopology(conn, routing.PerilTopology())
+		if err != nil {
+			return err
+		}
+		fmt.Println("Topology declared")
+		return nil
+	case "verify":
+		return topologyVerify(conn)
+	}
+	return fmt.Errorf("unknown topology command: %s", args[0])
+}
+
+func topologyVerify(conn pubsub.Broker) error {
+	topology := routing.PerilTopology()
+	drift, err := pubsub.VerifyTopology(conn, topology)
+	if err != nil {
+		return err
+	}
+	if len(drift) == 0 {
+		fmt.Printf("OK: %d exchanges and %d queues match\n", len(topology.Exchanges), len(topology.Queues))
+		return nil
+	}
+	for _, d := range drift {
+		fmt.Printf("DRIFT %s\n", d)
+	}
+	return fmt.Errorf("%d of %d entities differ from the expected topology",
+		len(drift), len(topology.Exchanges)+len(topology.Queues))
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/albsko/learn-pub-sub/internal/pubsub"
+	"github.com/albsko/learn-pub-sub/internal/routing"
+)
+
+// recentLogsKept is how many game logs the admin API can show.
+const recentLogsKept = 100
+
+// recentLogs keeps the last game logs the server wrote, newest last.
+type recentLogs struct {
+	mu   sync.Mutex
+	max  int
+	logs []routing.GameLog
+}
+
+func newRecentLogs(max int) *recentLogs {
+	return &recentLogs{max: max}
+}
+
+func (r *recentLogs) add(gl routing.GameLog) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.logs = append(r.logs, gl)
+	if len(r.logs) > r.max {
+		r.logs = append(r.logs[:0], r.logs[len(r.logs)-r.max:]...)
+	}
+}
+
+// last returns up to n of the newest logs.
+func (r *recentLogs) last(n int) []routing.GameLog {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if n > len(r.logs) {
+		n = len(r.logs)
+	}
+	return append([]routing.GameLog{}, r.logs[len(r.logs)-n:]...)
+}
+
+// admin is the HTTP API ops scripts drive the server with instead of the
+// REPL:
+//
+//	GET  /healthz              the process is up
+//	GET  /readyz               the broker is connected and the game logs are consumed
+//	GET  /api/state            the PlayingState clients get
+//	POST /api/pause            pause the game, like the pause command
+//	POST /api/resume           resume the game
+//	GET  /api/players          the players in the lobby
+//	GET  /api/logs?limit=n     the last game logs written, newest last
+//	GET  /api/subscriptions    acked, nacked and undecodable counts per consumer
+//	GET  /api/rate_limit       game logs refused by the rate limit, in total and per player
+//
+// Everything under /api needs the bearer token.
+type admin struct {
+	token   string
+	broker  *pubsub.ConnectionManager
+	game    *lobby
+	publish pubsub.Publisher
+	logs    *recentLogs
+	subs    map[string]*pubsub.Subscription
+	// limiter is nil if game logs are not rate limited
+	limiter *pubsub.RateLimiter
+}
+
+type subscriptionStats struct {
+	Acked          int64  `json:"acked"`
+	Nacked         int64  `json:"nacked"`
+	DecodeFailures int64  `json:"decode_failures"`
+	Running        bool   `json:"running"`
+	Error          string `json:"error,omitempty"`
+}
+
+// listen starts serving on addr and returns once the address is bound, so
+// a port already in use fails the server's startup.
+func (a *admin) listen(addr string) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on %s: %v", addr, err)
+	}
+	srv := &http.Server{
+		Handler:           a.handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("admin API stopped: %v", err)
+		}
+	}()
+	return srv, nil
+}
+
+func (a *admin) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("GET /readyz", a.ready)
+	mux.Handle("GET /api/state", a.auth(a.state))
+	mux.Handle("POST /api/pause", a.auth(a.setPaused(true)))
+	mux.Handle("POST /api/resume", a.auth(a.setPaused(false)))
+	mux.Handle("GET /api/players", a.auth(a.players))
+	mux.Handle("GET /api/logs", a.auth(a.recentLogs))
+	mux.Handle("GET /api/subscriptions", a.auth(a.subscriptions))
+	mux.Handle("GET /api/rate_limit", a.auth(a.rateLimit))
+	return mux
+}
+
+func (a *admin) auth(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "missing or wrong bearer token")
+			return
+		}
+		next(w, r)
+	})
+}
+
+func (a *admin) ready(w http.ResponseWriter, r *http.Request) {
+	var problems []string
+	if state := a.broker.State(); state != pubsub.StateConnected {
+		problems = append(problems, "broker is "+state.String())
+	}
+	select {
+	case <-a.subs[routing.GameLogSlug].Done():
+		problems = append(problems, "game log consumer has stopped")
+	default:
+	}
+	if len(problems) > 0 {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"status": "unavailable", "problems": problems})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+func (a *admin) state(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, routing.PlayingState{IsPaused: a.game.isPaused()})
+}
+
+func (a *admin) setPaused(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if paused {
+			log.Println("Admin API is sending pause message")
+		} else {
+			log.Println("Admin API is sending resume message")
+		}
+		if err := a.game.broadcastPaused(a.publish, paused); err != nil {
+			writeError(w, http.StatusBadGateway, fmt.Sprintf("could not publish: %v", err))
+			return
+		}
+		writeJSON(w, http.StatusOK, routing.PlayingState{IsPaused: paused})
+	}
+}
+
+func (a *admin) players(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, routing.PlayersResponse{Players: a.game.playerList()})
+}
+
+func (a *admin) recentLogs(w http.ResponseWriter, r *http.Request) {
+	limit := recentLogsKept
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "limit must be a non-negative number")
+			return
+		}
+		limit = n
+	}
+	writeJSON(w, http.StatusOK, a.logs.last(limit))
+}
+
+func (a *admin) subscriptions(w http.ResponseWriter, r *http.Request) {
+	stats := map[string]subscriptionStats{}
+	for name, sub := range a.subs {
+		s := sub.Stats()
+		st := subscriptionStats{
+			Acked:          s.Acked,
+			Nacked:         s.Nacked,
+			DecodeFailures: s.DecodeFailures,
+			Running:        true,
+		}
+		select {
+		case <-sub.Done():
+			st.Running = false
+		default:
+		}
+		if err := sub.Err(); err != nil {
+			st.Error = err.Error()
+		}
+		stats[name] = st
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func (a *admin) rateLimit(w http.ResponseWriter, r *http.Request) {
+	resp := struct {
+		Enabled  bool             `json:"enabled"`
+		Dropped  int64            `json:"dropped"`
+		ByPlayer map[string]int64 `json:"by_player"`
+	}{ByPlayer: map[string]int64{}}
+	if a.limiter != nil {
+		resp.Enabled = true
+		resp.Dropped = a.limiter.Dropped()
+		resp.ByPlayer = a.limiter.DroppedByKey()
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("could not write admin API response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/albsko/learn-pub-sub/internal/pubsub"
+	"github.com/albsko/learn-pub-sub/internal/routing"
+)
+
+const adminToken = "secret"
+
+func newTestAdmin(t *testing.T) (*admin, *pubsub.MemoryBroker, *httptest.Server) {
+	t.Helper()
+	b := pubsub.NewMemoryBroker()
+	broker, err := pubsub.NewConnectionManager(b.Dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { broker.Close() })
+	if err := pubsub.DeclareTopology(broker, routing.PerilTopology()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	logsSub, err := pubsub.Subscribe(ctx, broker, routing.ExchangePerilTopic, routing.GameLogSlug, routing.GameLogSlug+".*",
+		pubsub.DurableSimpleQueue,
+		func(pubsub.Delivery[routing.GameLog]) pubsub.AckType { return pubsub.Ack },
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	game := newLobby(false, broker)
+	subs, err := serveLobby(ctx, broker, game)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subs[routing.GameLogSlug] = logsSub
+	ch, err := broker.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &admin{
+		token:   adminToken,
+		broker:  broker,
+		game:    game,
+		publish: ch,
+		logs:    newRecentLogs(recentLogsKept),
+		subs:    subs,
+	}
+	srv := httptest.NewServer(a.handler())
+	t.Cleanup(srv.Close)
+	return a, b, srv
+}
+
+// adminRequest sends a request with authorization as its Authorization
+// header and decodes the response into out, if it is not nil.
+func adminRequest(t *testing.T, srv *httptest.Server, method, path, authorization string, out interface{}) int {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAdminAuth(t *testing.T) {
+	_, _, srv := newTestAdmin(t)
+
+	for _, route := range []struct{ method, path string }{
+		{"GET", "/api/state"},
+		{"POST", "/api/pause"},
+		{"POST", "/api/resume"},
+		{"GET", "/api/players"},
+		{"GET", "/api/logs"},
+		{"GET", "/api/subscriptions"},
+		{"GET", "/api/rate_limit"},
+	} {
+		for _, authorization := range []string{"", "Bearer wrong", "Bearer " + adminToken + "x", adminToken, "Basic " + adminToken} {
+			if code := adminRequest(t, srv, route.method, route.path, authorization, nil); code != http.StatusUnauthorized {
+				t.Errorf("%s %s with %q: got %d, want 401", route.method, route.path, authorization, code)
+			}
+		}
+		if code := adminRequest(t, srv, route.method, route.path, "Bearer "+adminToken, nil); code != http.StatusOK {
+			t.Errorf("%s %s with the token: got %d", route.method, route.path, code)
+		}
+	}
+
+	for _, path := range []string{"/healthz", "/readyz"} {
+		if code := adminRequest(t, srv, "GET", path, "", nil); code != http.StatusOK {
+			t.Errorf("%s without a token: got %d", path, code)
+		}
+	}
+}
+
+func TestAdminPause(t *testing.T) {
+	_, b, srv := newTestAdmin(t)
+	ch, err := b.Connect().Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := ch.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind(q.Name, routing.PauseKey, routing.ExchangePerilDirect, false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, paused := range []bool{true, false} {
+		path := "/api/resume"
+		if paused {
+			path = "/api/pause"
+		}
+		var state routing.PlayingState
+		if code := adminRequest(t, srv, "POST", path, "Bearer "+adminToken, &state); code != http.StatusOK || state.IsPaused != paused {
+			t.Errorf("POST %s: got %d and %+v", path, code, state)
+		}
+		state = routing.PlayingState{}
+		adminRequest(t, srv, "GET", "/api/state", "Bearer "+adminToken, &state)
+		if state.IsPaused != paused {
+			t.Errorf("after POST %s the state is %+v", path, state)
+		}
+
+		msg, ok, err := ch.Get(q.Name, true)
+		if err != nil || !ok {
+			t.Fatalf("POST %s did not tell the clients: %v", path, err)
+		}
+		var told routing.PlayingState
+		if err := json.Unmarshal(msg.Body, &told); err != nil || told.IsPaused != paused {
+			t.Errorf("POST %s told the clients %s", path, msg.Body)
+		}
+	}
+}
+
+func TestAdminEndpoints(t *testing.T) {
+	a, b, srv := newTestAdmin(t)
+	auth := "Bearer " + adminToken
+
+	if _, err := callLobby(t, lobbyClient(t, b.Connect()), routing.RPCJoinKey, routing.JoinRequest{Username: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	var players routing.PlayersResponse
+	adminRequest(t, srv, "GET", "/api/players", auth, &players)
+	if !reflect.DeepEqual(players.Players, []string{"alice"}) {
+		t.Errorf("players are %q", players.Players)
+	}
+
+	for _, msg := range []string{"one", "two", "three"} {
+		a.logs.add(routing.GameLog{Username: "alice", Message: msg, CurrentTime: time.Now()})
+	}
+	var logs []routing.GameLog
+	adminRequest(t, srv, "GET", "/api/logs?limit=2", auth, &logs)
+	if len(logs) != 2 || logs[0].Message != "two" || logs[1].Message != "three" {
+		t.Errorf("the last two logs are %+v", logs)
+	}
+	if code := adminRequest(t, srv, "GET", "/api/logs?limit=-1", auth, nil); code != http.StatusBadRequest {
+		t.Errorf("negative limit: got %d, want 400", code)
+	}
+
+	var limit struct {
+		Enabled bool `json:"enabled"`
+	}
+	adminRequest(t, srv, "GET", "/api/rate_limit", auth, &limit)
+	if limit.Enabled {
+		t.Error("rate limit is enabled without a limiter")
+	}
+	a.limiter = pubsub.NewRateLimiter(1, 1)
+	a.limiter.Allow("alice")
+	a.limiter.Allow("alice")
+	var limited struct {
+		Enabled  bool             `json:"enabled"`
+		Dropped  int64            `json:"dropped"`
+		ByPlayer map[string]int64 `json:"by_player"`
+	}
+	adminRequest(t, srv, "GET", "/api/rate_limit", auth, &limited)
+	if !limited.Enabled || limited.Dropped != 1 || limited.ByPlayer["alice"] != 1 {
+		t.Errorf("rate limit is %+v, want one of alice's logs dropped", limited)
+	}
+
+	var stats map[string]subscriptionStats
+	adminRequest(t, srv, "GET", "/api/subscriptions", auth, &stats)
+	if st, ok := stats[routing.GameLogSlug]; !ok || !st.Running {
+		t.Errorf("game log subscription is %+v", st)
+	}
+	if st := stats[routing.RPCJoinKey]; st.Acked != 1 {
+		t.Errorf("join subscription is %+v, want one request acked", st)
+	}
+
+	// the game log consumer stopping makes the server unready
+	a.subs[routing.GameLogSlug].Close()
+	if code := adminRequest(t, srv, "GET", "/readyz", "", nil); code != http.StatusServiceUnavailable {
+		t.Errorf("readyz without a game log consumer: got %d, want 503", code)
+	}
+	adminRequest(t, srv, "GET", "/api/subscriptions", auth, &stats)
+	if stats[routing.GameLogSlug].Running {
+		t.Error("the closed game log subscription is reported running")
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/albsko/learn-pub-sub/internal/config"
+	"github.com/albsko/learn-pub-sub/internal/gamelogic"
+	"github.com/albsko/learn-pub-sub/internal/pubsub"
+	"github.com/albsko/learn-pub-sub/internal/routing"
+)
+
+// gameLogMiddleware returns the middleware around the game log handler and
+// the per-player rate limiter in it, nil if logs are not limited.
+func gameLogMiddleware(cfg config.Config, logger *slog.Logger, dedup pubsub.DedupStore) ([]pubsub.Middleware[routing.GameLog], *pubsub.RateLimiter) {
+	// no Timeout middleware: a log it gave up on while the writer had it
+	// queued would be redelivered and written twice, see writeGameLog
+	middleware := []pubsub.Middleware[routing.GameLog]{
+		pubsub.Recover[routing.GameLog](logger, pubsub.NackDiscard),
+		pubsub.Logging[routing.GameLog](logger),
+		pubsub.Idempotent[routing.GameLog](logger, dedup),
+	}
+
+	// the logs of all players share the writer's batches, one player must not
+	// crowd out the others. Limited inside Idempotent, so a redelivered log
+	// that was already written does not use up a token.
+	limit := cfg.Logs.RateLimit
+	if limit.Rate <= 0 {
+		return middleware, nil
+	}
+	limiter := pubsub.NewRateLimiter(limit.Rate, limit.Burst)
+	limited := pubsub.Ack
+	if cfg.Logs.DeadLetterLimited {
+		limited = pubsub.NackDiscard
+	}
+	middleware = append(middleware, pubsub.RateLimit(
+		limiter,
+		// the routing key names the publisher, the body can say anything
+		func(d pubsub.Delivery[routing.GameLog]) string {
+			return strings.TrimPrefix(d.RoutingKey, routing.GameLogSlug+".")
+		},
+		limited,
+	))
+	return middleware, limiter
+}
+
+// writeGameLog writes each log through w and acks it only once the batch it
+// was written in is on disk. timeout bounds the wait for a place in a batch;
+// after that the log is written however long the batch takes, so it must
+// not be nacked any more.
+func writeGameLog(w *gamelogic.LogWriter, recent *recentLogs, timeout time.Duration) pubsub.Handler[routing.GameLog] {
+	return func(d pubsub.Delivery[routing.GameLog]) pubsub.AckType {
+		defer gamelogic.PrintServerHelp()
+		ctx := d.Context()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		err := w.Write(ctx, d.Body)
+		if err != nil {
+			fmt.Printf("error writing log %s (correlation %s, attempt %d): %v\n",
+				d.MessageID, d.CorrelationID, d.Attempt, err)
+			return pubsub.NackRequeue
+		}
+		recent.add(d.Body)
+		return pubsub.Ack
+	}
+}
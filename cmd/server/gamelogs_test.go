@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/albsko/learn-pub-sub/internal/config"
+	"github.com/albsko/learn-pub-sub/internal/gamelogic"
+	"github.com/albsko/learn-pub-sub/internal/pubsub"
+	"github.com/albsko/learn-pub-sub/internal/routing"
+)
+
+func gameLog(id, username string) pubsub.Delivery[routing.GameLog] {
+	return pubsub.Delivery[routing.GameLog]{
+		Envelope: pubsub.Envelope{MessageID: id, RoutingKey: routing.GameLogSlug + "." + username},
+		Body:     routing.GameLog{Username: username, Message: id},
+	}
+}
+
+func TestGameLogsRateLimitedAfterDedup(t *testing.T) {
+	cfg := config.Default()
+	cfg.Logs.RateLimit = config.RateLimit{Rate: 0.001, Burst: 1}
+	cfg.Logs.DeadLetterLimited = true
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	middleware, limiter := gameLogMiddleware(cfg, logger, pubsub.NewMemoryDedupStore(100, time.Hour))
+
+	var written []string
+	handler := pubsub.Chain(func(d pubsub.Delivery[routing.GameLog]) pubsub.AckType {
+		written = append(written, d.Body.Message)
+		return pubsub.Ack
+	}, middleware...)
+
+	if ack := handler(gameLog("log-1", "alice")); ack != pubsub.Ack {
+		t.Fatalf("first log: got %v, want Ack", ack)
+	}
+	// redeliveries of a written log are acked without a token
+	for i := 0; i < 3; i++ {
+		if ack := handler(gameLog("log-1", "alice")); ack != pubsub.Ack {
+			t.Fatalf("redelivery: got %v, want Ack", ack)
+		}
+	}
+	if n := limiter.Dropped(); n != 0 {
+		t.Errorf("%d redeliveries were rate limited", n)
+	}
+	if ack := handler(gameLog("log-2", "alice")); ack != pubsub.NackDiscard {
+		t.Errorf("new log over the limit: got %v, want NackDiscard", ack)
+	}
+	// alice cannot dodge the limit by naming someone else in the body
+	spoofed := gameLog("log-3", "alice")
+	spoofed.Body.Username = "mallory"
+	if ack := handler(spoofed); ack != pubsub.NackDiscard {
+		t.Errorf("log over the limit under another name: got %v, want NackDiscard", ack)
+	}
+	if ack := handler(gameLog("log-4", "bob")); ack != pubsub.Ack {
+		t.Errorf("another player's log: got %v, want Ack", ack)
+	}
+	if len(written) != 2 || written[0] != "log-1" || written[1] != "log-4" {
+		t.Errorf("wrote %q, want log-1 and log-4", written)
+	}
+	if dropped := limiter.DroppedByKey(); dropped["alice"] != 2 || len(dropped) != 1 {
+		t.Errorf("dropped %v, want 2 of alice's logs", dropped)
+	}
+}
+
+func TestGameLogTimeoutOnlyBoundsQueueing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "game.log")
+	// a batch waits far longer than the timeout to fill up
+	w, err := gamelogic.NewLogWriter(path, 10, 300*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	cfg := config.Default()
+	cfg.Logs.RateLimit = config.RateLimit{}
+	middleware, _ := gameLogMiddleware(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)), pubsub.NewMemoryDedupStore(100, time.Hour))
+	handler := pubsub.Chain(writeGameLog(w, newRecentLogs(10), 50*time.Millisecond), middleware...)
+
+	written := func(id string) int {
+		t.Helper()
+		data, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		return strings.Count(string(data), id)
+	}
+
+	// log-1 has its place in the batch before the timeout, so it is acked
+	// once the batch is on disk and not before
+	start := time.Now()
+	if ack := handler(gameLog("log-1", "alice")); ack != pubsub.Ack {
+		t.Fatalf("queued log: got %v, want Ack", ack)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("acked after %v, before the batch was written", elapsed)
+	}
+	if n := written("log-1"); n != 1 {
+		t.Errorf("log-1 acked with %d copies on disk", n)
+	}
+
+	// a redelivery of a written log is acked without writing it again
+	if ack := handler(gameLog("log-1", "carol")); ack != pubsub.Ack {
+		t.Fatalf("redelivered log-1: got %v, want Ack", ack)
+	}
+	if n := written("log-1"); n != 1 {
+		t.Errorf("log-1 written %d times", n)
+	}
+
+	// a log that cannot be queued is requeued rather than lost
+	w.Close()
+	if ack := handler(gameLog("log-2", "bob")); ack != pubsub.NackRequeue {
+		t.Errorf("log that was never queued: got %v, want NackRequeue", ack)
+	}
+	if n := written("log-2"); n != 0 {
+		t.Errorf("log-2 written %d times after the writer closed", n)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/albsko/learn-pub-sub/internal/gamelogic"
+	"github.com/albsko/learn-pub-sub/internal/pubsub"
+	"github.com/albsko/learn-pub-sub/internal/routing"
+)
+
+// replayIdle is how long the game log stream has to stay quiet before a
+// replay assumes it has read everything.
+const replayIdle = 2 * time.Second
+
+// parseReplaySince accepts "all", a duration back from now such as 30m, or
+// an RFC 3339 time.
+func parseReplaySince(s string) (pubsub.StreamOffset, error) {
+	if s == "all" {
+		return pubsub.StreamFirst, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return pubsub.StreamAt(time.Now().Add(-d)), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return pubsub.StreamOffset{}, fmt.Errorf("%s is neither all, a duration nor an RFC 3339 time", s)
+	}
+	return pubsub.StreamAt(t), nil
+}
+
+// replayGameLogs reads the game log stream from since and writes every log
+// to w. It stops at the first log published after the replay started, or
+// once the stream has nothing more to give.
+func replayGameLogs(broker pubsub.Broker, since pubsub.StreamOffset, w io.Writer) (int64, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	started := time.Now()
+	var count atomic.Int64
+	seen := make(chan struct{}, 1)
+
+	sub, err := pubsub.Subscribe(
+		ctx,
+		broker,
+		routing.ExchangePerilTopic,
+		routing.GameLogStream,
+		routing.GameLogSlug+".*",
+		pubsub.StreamQueue,
+		func(d pubsub.Delivery[routing.GameLog]) pubsub.AckType {
+			select {
+			case seen <- struct{}{}:
+			default:
+			}
+			if d.Timestamp.After(started) {
+				cancel()
+				return pubsub.Ack
+			}
+			_, err := io.WriteString(w, gamelogic.FormatLog(d.Body))
+			if err != nil {
+				fmt.Printf("error writing replayed log: %v\n", err)
+				cancel()
+				return pubsub.Ack
+			}
+			count.Add(1)
+			return pubsub.Ack
+		},
+		pubsub.WithDefaultCodec(pubsub.GobCodec),
+		pubsub.WithPrefetch(100, 0),
+		pubsub.WithStreamOffset(since),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	idle := time.NewTimer(replayIdle)
+	defer idle.Stop()
+WAIT:
+	for {
+		select {
+		case <-seen:
+			idle.Reset(replayIdle)
+		case <-idle.C:
+			cancel()
+			break WAIT
+		case <-sub.Done():
+			break WAIT
+		}
+	}
+	<-sub.Done()
+	return count.Load(), sub.Err()
+}
+
+// replayCommand runs "replay <since> [file]".
+func replayCommand(broker pubsub.Broker, words []string) error {
+	if len(words) < 2 {
+		return fmt.Errorf("usage: replay <all|duration|time> [file]")
+	}
+	since, err := parseReplaySince(words[1])
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if len(words) > 2 {
+		f, err := os.OpenFile(words[2], os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("could not open %s: %v", words[2], err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	n, err := replayGameLogs(broker, since, w)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Replayed %d game logs\n", n)
+	return nil
+}
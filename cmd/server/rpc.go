@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/albsko/learn-pub-sub/internal/pubsub"
+	"github.com/albsko/learn-pub-sub/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// lobby is the server's view of the game that clients can query.
+type lobby struct {
+	mu     sync.Mutex
+	paused bool
+	// players maps each username to the reply queue of the client that
+	// joined with it
+	players map[string]string
+	// connected reports whether the client owning a reply queue is still
+	// around
+	connected func(replyQueue string) bool
+
+	// pauseMu keeps a pause and a resume from overtaking each other between
+	// the broadcast and the lobby
+	pauseMu sync.Mutex
+}
+
+func newLobby(paused bool, broker pubsub.Broker) *lobby {
+	return &lobby{
+		paused:    paused,
+		players:   map[string]string{},
+		connected: replyQueueExists(broker),
+	}
+}
+
+// replyQueueExists checks for a client's reply queue. The queue is exclusive
+// to the client's connection, so the broker deletes it when the client
+// crashes or is killed without leaving the lobby.
+func replyQueueExists(broker pubsub.Broker) func(string) bool {
+	return func(queue string) bool {
+		ch, err := broker.Channel()
+		if err != nil {
+			// when in doubt the name stays taken
+			return true
+		}
+		defer ch.Close()
+		_, err = ch.QueueDeclarePassive(queue, false, true, true, false, nil)
+		var amqpErr *amqp.Error
+		return !errors.As(err, &amqpErr) || amqpErr.Code != amqp.NotFound
+	}
+}
+
+func (l *lobby) setPaused(paused bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.paused = paused
+}
+
+func (l *lobby) isPaused() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.paused
+}
+
+// broadcastPaused tells every client to pause or resume the game and
+// remembers the new state for clients that join later.
+func (l *lobby) broadcastPaused(ch pubsub.Publisher, paused bool) error {
+	l.pauseMu.Lock()
+	defer l.pauseMu.Unlock()
+	err := pubsub.PublishJSON(
+		ch,
+		routing.ExchangePerilDirect,
+		routing.PauseKey,
+		routing.PlayingState{
+			IsPaused: paused,
+		},
+	)
+	if err != nil {
+		return err
+	}
+	l.setPaused(paused)
+	return nil
+}
+
+func (l *lobby) playerList() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	players := make([]string, 0, len(l.players))
+	for p := range l.players {
+		players = append(players, p)
+	}
+	sort.Strings(players)
+	return players
+}
+
+// join lets a player in under a free username. A username stays taken while
+// the client that joined with it is connected, but that client may join
+// again, e.g. after the server restarted.
+func (l *lobby) join(d pubsub.Delivery[routing.JoinRequest]) (routing.PlayersResponse, error) {
+	if d.Body.Username == "" {
+		return routing.PlayersResponse{}, fmt.Errorf("username is required")
+	}
+	l.mu.Lock()
+	owner, taken := l.players[d.Body.Username]
+	l.mu.Unlock()
+	if taken && owner != d.ReplyTo && l.connected(owner) {
+		return routing.PlayersResponse{}, fmt.Errorf("username %s is already playing", d.Body.Username)
+	}
+	l.mu.Lock()
+	l.players[d.Body.Username] = d.ReplyTo
+	l.mu.Unlock()
+	return routing.PlayersResponse{Players: l.playerList()}, nil
+}
+
+// leave only takes a player out of the lobby on behalf of the client that
+// joined with the username.
+func (l *lobby) leave(d pubsub.Delivery[routing.LeaveRequest]) (routing.PlayersResponse, error) {
+	l.mu.Lock()
+	if l.players[d.Body.Username] == d.ReplyTo {
+		delete(l.players, d.Body.Username)
+	}
+	l.mu.Unlock()
+	return routing.PlayersResponse{Players: l.playerList()}, nil
+}
+
+func (l *lobby) listPlayers(pubsub.Delivery[routing.PlayersRequest]) (routing.PlayersResponse, error) {
+	return routing.PlayersResponse{Players: l.playerList()}, nil
+}
+
+func (l *lobby) pauseState(pubsub.Delivery[routing.PauseStateRequest]) (routing.PlayingState, error) {
+	return routing.PlayingState{IsPaused: l.isPaused()}, nil
+}
+
+// serveLobby answers the lobby's RPCs. The subscriptions are keyed by the
+// routing key they serve.
+func serveLobby(ctx context.Context, broker pubsub.Broker, l *lobby) (map[string]*pubsub.Subscription, error) {
+	subs := map[string]*pubsub.Subscription{}
+
+	sub, err := pubsub.Serve(ctx, broker, routing.ExchangePerilDirect, routing.RPCJoinKey, routing.RPCJoinKey, l.join)
+	if err != nil {
+		return subs, fmt.Errorf("could not serve %s: %v", routing.RPCJoinKey, err)
+	}
+	subs[routing.RPCJoinKey] = sub
+
+	sub, err = pubsub.Serve(ctx, broker, routing.ExchangePerilDirect, routing.RPCLeaveKey, routing.RPCLeaveKey, l.leave)
+	if err != nil {
+		return subs, fmt.Errorf("could not serve %s: %v", routing.RPCLeaveKey, err)
+	}
+	subs[routing.RPCLeaveKey] = sub
+
+	sub, err = pubsub.Serve(ctx, broker, routing.ExchangePerilDirect, routing.RPCPlayersKey, routing.RPCPlayersKey, l.listPlayers)
+	if err != nil {
+		return subs, fmt.Errorf("could not serve %s: %v", routing.RPCPlayersKey, err)
+	}
+	subs[routing.RPCPlayersKey] = sub
+
+	sub, err = pubsub.Serve(ctx, broker, routing.ExchangePerilDirect, routing.RPCPauseStateKey, routing.RPCPauseStateKey, l.pauseState)
+	if err != nil {
+		return subs, fmt.Errorf("could not serve %s: %v", routing.RPCPauseStateKey, err)
+	}
+	subs[routing.RPCPauseStateKey] = sub
+
+	return subs, nil
+}
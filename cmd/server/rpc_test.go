@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/albsko/learn-pub-sub/internal/pubsub"
+	"github.com/albsko/learn-pub-sub/internal/routing"
+)
+
+func lobbyClient(t *testing.T, conn pubsub.Broker) *pubsub.RPCClient {
+	t.Helper()
+	c, err := pubsub.NewRPCClient(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func callLobby[Req any](t *testing.T, c *pubsub.RPCClient, key string, req Req) ([]string, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	resp, err := pubsub.Call[Req, routing.PlayersResponse](ctx, c, routing.ExchangePerilDirect, key, req)
+	return resp.Players, err
+}
+
+func TestLobbyUsernames(t *testing.T) {
+	b := pubsub.NewMemoryBroker()
+	if err := pubsub.DeclareTopology(b.Connect(), routing.PerilTopology()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := serveLobby(ctx, b.Connect(), newLobby(false, b.Connect())); err != nil {
+		t.Fatal(err)
+	}
+
+	aliceConn := b.Connect()
+	alice := lobbyClient(t, aliceConn)
+	bob := lobbyClient(t, b.Connect())
+
+	if _, err := callLobby(t, alice, routing.RPCJoinKey, routing.JoinRequest{Username: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	var remote *pubsub.RemoteError
+	if _, err := callLobby(t, bob, routing.RPCJoinKey, routing.JoinRequest{Username: "alice"}); !errors.As(err, &remote) {
+		t.Fatalf("joining under a connected player's name: got %v, want a RemoteError", err)
+	}
+	if _, err := callLobby(t, alice, routing.RPCJoinKey, routing.JoinRequest{Username: "alice"}); err != nil {
+		t.Errorf("the same client could not join again: %v", err)
+	}
+	players, err := callLobby(t, bob, routing.RPCLeaveKey, routing.LeaveRequest{Username: "alice"})
+	if err != nil || len(players) != 1 {
+		t.Errorf("another client took alice out of the lobby: %q, %v", players, err)
+	}
+
+	// alice's client goes away without leaving, which takes its reply queue
+	// with it
+	aliceConn.Close()
+	players, err = callLobby(t, bob, routing.RPCJoinKey, routing.JoinRequest{Username: "alice"})
+	if err != nil || len(players) != 1 || players[0] != "alice" {
+		t.Fatalf("could not take over a disconnected player's name: %q, %v", players, err)
+	}
+	players, err = callLobby(t, bob, routing.RPCLeaveKey, routing.LeaveRequest{Username: "alice"})
+	if err != nil || len(players) != 0 {
+		t.Errorf("after leaving the lobby holds %q, %v", players, err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+)
+
+// tlsproxy terminates TLS in front of a plain AMQP broker, so the TLS and
+// mutual-TLS settings can be tried without reconfiguring RabbitMQ. Generate
+// certificates with ./gencerts.sh.
+func main() {
+	listen := flag.String("listen", ":5671", "address to accept TLS connections on")
+	upstream := flag.String("upstream", "localhost:5672", "plain AMQP broker to forward to")
+	certFile := flag.String("cert", "certs/server.pem", "server certificate")
+	keyFile := flag.String("key", "certs/server.key", "server certificate key")
+	clientCA := flag.String("client-ca", "", "require client certificates signed by this CA")
+	flag.Parse()
+
+	cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+	if err != nil {
+		log.Fatalf("could not load server certificate: %v", err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if *clientCA != "" {
+		pem, err := os.ReadFile(*clientCA)
+		if err != nil {
+			log.Fatalf("could not read client CA: %v", err)
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			log.Fatalf("no certificates found in %s", *clientCA)
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	ln, err := tls.Listen("tcp", *listen, cfg)
+	if err != nil {
+		log.Fatalf("could not listen: %v", err)
+	}
+	fmt.Printf("Forwarding TLS on %s to %s\n", *listen, *upstream)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Fatalf("could not accept: %v", err)
+		}
+		go forward(conn.(*tls.Conn), *upstream)
+	}
+}
+
+func forward(conn *tls.Conn, upstream string) {
+	defer conn.Close()
+
+	if err := conn.Handshake(); err != nil {
+		log.Printf("handshake with %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	peer := "anonymous"
+	if certs := conn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		peer = certs[0].Subject.CommonName
+	}
+
+	up, err := net.Dial("tcp", upstream)
+	if err != nil {
+		log.Printf("could not reach %s: %v", upstream, err)
+		return
+	}
+	defer up.Close()
+	fmt.Printf("%s connected as %s\n", conn.RemoteAddr(), peer)
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(up, conn)
+		up.(*net.TCPConn).CloseWrite()
+		close(done)
+	}()
+	io.Copy(conn, up)
+	conn.CloseWrite()
+	<-done
+	fmt.Printf("%s disconnected\n", conn.RemoteAddr())
+}
@@ -0,0 +1,35 @@
+#!/bin/bash
+
+# Generates a throwaway CA plus a server and a client certificate signed by
+# it, for trying TLS locally with ./cmd/tlsproxy or a RabbitMQ TLS listener.
+
+set -e
+
+dir=${1:-certs}
+days=365
+
+mkdir -p "$dir"
+cd "$dir"
+
+echo "Generating CA..."
+openssl req -x509 -newkey rsa:2048 -nodes -days "$days" \
+  -keyout ca.key -out ca.pem -subj "/CN=peril-test-ca" 2>/dev/null
+
+# sign <name> <subject> <extensions>
+sign() {
+  openssl req -newkey rsa:2048 -nodes \
+    -keyout "$1.key" -out "$1.csr" -subj "$2" 2>/dev/null
+  openssl x509 -req -in "$1.csr" -CA ca.pem -CAkey ca.key -CAcreateserial \
+    -days "$days" -out "$1.pem" -extfile <(printf "%s" "$3") 2>/dev/null
+  rm "$1.csr"
+}
+
+echo "Generating server certificate..."
+sign server "/CN=localhost" "subjectAltName=DNS:localhost,IP:127.0.0.1
+extendedKeyUsage=serverAuth"
+
+echo "Generating client certificate..."
+sign client "/CN=guest" "extendedKeyUsage=clientAuth"
+
+rm -f ca.srl
+echo "Certificates written to $dir/"
@@ -0,0 +1,507 @@
+package config
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/albsko/learn-pub-sub/internal/gamelogic"
+	"github.com/albsko/learn-pub-sub/internal/pubsub"
+	"github.com/albsko/learn-pub-sub/internal/routing"
+)
+
+// Config is shared by the server and the client. Each binary reads the
+// parts it needs.
+type Config struct {
+	Broker        Broker        `yaml:"broker"`
+	NATS          NATS          `yaml:"nats"`
+	Gateway       Gateway       `yaml:"gateway"`
+	Admin         Admin         `yaml:"admin"`
+	GRPC          GRPC          `yaml:"grpc"`
+	Client        Client        `yaml:"client"`
+	Logs          Logs          `yaml:"logs"`
+	Subscriptions Subscriptions `yaml:"subscriptions"`
+	Game          Game          `yaml:"game"`
+}
+
+type Broker struct {
+	// URLs are tried in order until one accepts the connection. Their
+	// scheme picks the transport: amqp and amqps, stomp and stomps for the
+	// broker's STOMP plugin, mqtt and mqtts for its MQTT plugin, or nats
+	// for NATS with JetStream. All URLs must use the same transport.
+	URLs             []string      `yaml:"urls"`
+	VHost            string        `yaml:"vhost"`
+	Username         string        `yaml:"username"`
+	Password         string        `yaml:"password"`
+	TLS              TLS           `yaml:"tls"`
+	ReconnectInitial time.Duration `yaml:"reconnect_initial"`
+	ReconnectMax     time.Duration `yaml:"reconnect_max"`
+}
+
+type TLS struct {
+	CAFile     string `yaml:"ca_file"`
+	CertFile   string `yaml:"cert_file"`
+	KeyFile    string `yaml:"key_file"`
+	ServerName string `yaml:"server_name"`
+	// ExternalAuth logs in as the client certificate's subject instead of
+	// with username and password. Requires the rabbitmq_auth_mechanism_ssl
+	// plugin on the broker.
+	ExternalAuth bool `yaml:"external_auth"`
+}
+
+// NATS runs a NATS server inside the Peril server, so that a game needs no
+// broker of its own. Unless broker.urls is set, the server connects to it at
+// nats://<listen>; clients are pointed at it with broker.urls.
+type NATS struct {
+	Embedded bool   `yaml:"embedded"`
+	Listen   string `yaml:"listen"`
+	StoreDir string `yaml:"store_dir"`
+}
+
+// Gateway is the WebSocket gateway that lets browsers play. Players log in
+// with a username and, if set, the shared password.
+type Gateway struct {
+	Listen   string `yaml:"listen"`
+	Password string `yaml:"password"`
+}
+
+// Admin is the server's HTTP admin API, off unless Listen is set. Requests
+// other than health checks need "Authorization: Bearer <Token>".
+type Admin struct {
+	Listen string `yaml:"listen"`
+	Token  string `yaml:"token"`
+}
+
+// GRPC is cmd/grpcgateway's gRPC service. If Token is set, calls need
+// "authorization: Bearer <Token>" metadata.
+type GRPC struct {
+	Listen string `yaml:"listen"`
+	Token  string `yaml:"token"`
+}
+
+type Logs struct {
+	GameLog string `yaml:"game_log"`
+	DedupDB string `yaml:"dedup_db"`
+	// BatchSize is the most game logs written and synced to disk at once.
+	// A smaller batch is written FlushInterval after its first log.
+	BatchSize     int           `yaml:"batch_size"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	// RateLimit applies to each player's logs. Logs over it are
+	// dead-lettered if DeadLetterLimited is set, dropped otherwise.
+	RateLimit         RateLimit `yaml:"rate_limit"`
+	DeadLetterLimited bool      `yaml:"dead_letter_limited"`
+}
+
+type Client struct {
+	// PublishLimit keeps a client from flooding the broker with moves and
+	// logs. Publishes over it fail.
+	PublishLimit RateLimit `yaml:"publish_limit"`
+}
+
+// RateLimit is a token bucket: Burst messages at once, Rate per second on
+// average. A zero Rate turns it off.
+type RateLimit struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+type Subscriptions struct {
+	GameLogs Subscription `yaml:"game_logs"`
+	Moves    Subscription `yaml:"moves"`
+	War      Subscription `yaml:"war"`
+}
+
+type Subscription struct {
+	Prefetch    int           `yaml:"prefetch"`
+	Concurrency int           `yaml:"concurrency"`
+	Timeout     time.Duration `yaml:"timeout"`
+	Retry       Retry         `yaml:"retry"`
+}
+
+// Retry is disabled when MaxAttempts is zero.
+type Retry struct {
+	MaxAttempts  int           `yaml:"max_attempts"`
+	InitialDelay time.Duration `yaml:"initial_delay"`
+	MaxDelay     time.Duration `yaml:"max_delay"`
+}
+
+// Game rules have to match between clients, otherwise two clients can
+// disagree about who won a war.
+type Game struct {
+	StartPaused    bool `yaml:"start_paused"`
+	MaxUnits       int  `yaml:"max_units"`
+	InfantryPower  int  `yaml:"infantry_power"`
+	CavalryPower   int  `yaml:"cavalry_power"`
+	ArtilleryPower int  `yaml:"artillery_power"`
+}
+
+func Default() Config {
+	return Config{
+		Broker: Broker{
+			URLs:             []string{"amqp://localhost:5672/"},
+			Username:         "guest",
+			Password:         "guest",
+			ReconnectInitial: 500 * time.Millisecond,
+			ReconnectMax:     30 * time.Second,
+		},
+		NATS: NATS{
+			Listen:   "localhost:4222",
+			StoreDir: "peril-nats",
+		},
+		Gateway: Gateway{
+			Listen: "localhost:8080",
+		},
+		GRPC: GRPC{
+			Listen: "localhost:9090",
+		},
+		Logs: Logs{
+			GameLog:       "game.log",
+			DedupDB:       "game_logs.dedup.db",
+			BatchSize:     100,
+			FlushInterval: 200 * time.Millisecond,
+			// one player must not fill the writer's batches
+			RateLimit: RateLimit{
+				Rate:  0.5,
+				Burst: 10,
+			},
+			DeadLetterLimited: true,
+		},
+		Client: Client{
+			PublishLimit: RateLimit{
+				Rate:  10,
+				Burst: 20,
+			},
+		},
+		Subscriptions: Subscriptions{
+			GameLogs: Subscription{
+				Prefetch:    200,
+				Concurrency: 100,
+				Timeout:     5 * time.Second,
+				Retry: Retry{
+					MaxAttempts:  5,
+					InitialDelay: time.Second,
+					MaxDelay:     30 * time.Second,
+				},
+			},
+			Moves: Subscription{
+				Prefetch:    10,
+				Concurrency: 1,
+				Timeout:     10 * time.Second,
+			},
+			// a war is shared by every client, so wars for other players are
+			// passed on after a short delay instead of bouncing between clients
+			War: Subscription{
+				Prefetch:    10,
+				Concurrency: 1,
+				Timeout:     10 * time.Second,
+				Retry: Retry{
+					MaxAttempts:  20,
+					InitialDelay: 100 * time.Millisecond,
+					MaxDelay:     5 * time.Second,
+				},
+			},
+		},
+		Game: Game{
+			StartPaused:    true,
+			InfantryPower:  1,
+			CavalryPower:   5,
+			ArtilleryPower: 10,
+		},
+	}
+}
+
+func (c Config) Validate() error {
+	var errs []error
+	if len(c.Broker.URLs) == 0 {
+		errs = append(errs, errors.New("broker.urls: at least one URL is required"))
+	}
+	for _, raw := range c.Broker.URLs {
+		u, err := url.Parse(raw)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("broker.urls: %v", err))
+			continue
+		}
+		switch u.Scheme {
+		case "amqp", "amqps", "stomp", "stomps", "mqtt", "mqtts", "nats":
+		default:
+			errs = append(errs, fmt.Errorf("broker.urls: %s: scheme must be amqp, amqps, stomp, stomps, mqtt, mqtts or nats", raw))
+		}
+	}
+	stomp, mqtt, nats := c.Broker.STOMP(), c.Broker.MQTT(), c.Broker.NATS()
+	if len(c.Broker.URLs) > 0 {
+		first := c.Broker.transport()
+		for _, raw := range c.Broker.URLs {
+			if u, err := url.Parse(raw); err == nil && transport(u.Scheme) != first {
+				errs = append(errs, errors.New("broker.urls: cannot mix AMQP, STOMP, MQTT and NATS URLs"))
+				break
+			}
+		}
+	}
+	if nats && c.Broker.VHost != "" {
+		errs = append(errs, errors.New("broker.vhost is not supported over NATS"))
+	}
+	if c.Broker.ReconnectInitial <= 0 || c.Broker.ReconnectMax < c.Broker.ReconnectInitial {
+		errs = append(errs, errors.New("broker.reconnect_initial must be positive and no larger than broker.reconnect_max"))
+	}
+
+	t := c.Broker.TLS
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		errs = append(errs, errors.New("broker.tls: cert_file and key_file must be set together"))
+	}
+	if t.ExternalAuth && t.CertFile == "" {
+		errs = append(errs, errors.New("broker.tls.external_auth needs a client certificate"))
+	}
+	if t.ExternalAuth && stomp {
+		errs = append(errs, errors.New("broker.tls.external_auth is not supported over STOMP"))
+	}
+	if t.ExternalAuth && mqtt {
+		errs = append(errs, errors.New("broker.tls.external_auth is not supported over MQTT"))
+	}
+	if t.ExternalAuth && nats {
+		errs = append(errs, errors.New("broker.tls.external_auth is not supported over NATS"))
+	}
+	if t.enabled() || t.ExternalAuth {
+		// NATS negotiates TLS on the same port and scheme
+		for _, raw := range c.Broker.URLs {
+			if u, err := url.Parse(raw); err == nil && u.Scheme != "amqps" && u.Scheme != "stomps" && u.Scheme != "mqtts" && u.Scheme != "nats" {
+				errs = append(errs, fmt.Errorf("broker.urls: %s: TLS is configured, use amqps://, stomps://, mqtts:// or nats://", raw))
+			}
+		}
+	}
+	for _, f := range []struct{ key, path string }{
+		{"broker.tls.ca_file", t.CAFile},
+		{"broker.tls.cert_file", t.CertFile},
+		{"broker.tls.key_file", t.KeyFile},
+	} {
+		if f.path == "" {
+			continue
+		}
+		if _, err := os.Stat(f.path); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", f.key, err))
+		}
+	}
+
+	if c.NATS.Embedded {
+		if !nats {
+			errs = append(errs, errors.New("nats.embedded needs nats:// broker URLs"))
+		}
+		if _, _, err := net.SplitHostPort(c.NATS.Listen); err != nil {
+			errs = append(errs, fmt.Errorf("nats.listen: %v", err))
+		}
+		if c.NATS.StoreDir == "" {
+			errs = append(errs, errors.New("nats.store_dir is required"))
+		}
+	}
+
+	if _, _, err := net.SplitHostPort(c.Gateway.Listen); err != nil {
+		errs = append(errs, fmt.Errorf("gateway.listen: %v", err))
+	}
+
+	if _, _, err := net.SplitHostPort(c.GRPC.Listen); err != nil {
+		errs = append(errs, fmt.Errorf("grpc.listen: %v", err))
+	}
+	if c.Admin.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Admin.Listen); err != nil {
+			errs = append(errs, fmt.Errorf("admin.listen: %v", err))
+		}
+		if c.Admin.Token == "" {
+			errs = append(errs, errors.New("admin.token is required when admin.listen is set"))
+		}
+	}
+
+	if c.Logs.GameLog == "" {
+		errs = append(errs, errors.New("logs.game_log is required"))
+	}
+	if c.Logs.DedupDB == "" {
+		errs = append(errs, errors.New("logs.dedup_db is required"))
+	}
+	if c.Logs.BatchSize < 1 {
+		errs = append(errs, errors.New("logs.batch_size must be at least 1"))
+	}
+	if c.Logs.FlushInterval <= 0 {
+		errs = append(errs, errors.New("logs.flush_interval must be positive"))
+	}
+	for key, l := range map[string]RateLimit{
+		"logs.rate_limit":      c.Logs.RateLimit,
+		"client.publish_limit": c.Client.PublishLimit,
+	} {
+		if l.Rate < 0 {
+			errs = append(errs, fmt.Errorf("%s.rate must not be negative", key))
+		}
+		if l.Rate > 0 && l.Burst < 1 {
+			errs = append(errs, fmt.Errorf("%s.burst must be at least 1", key))
+		}
+	}
+
+	for name, s := range map[string]Subscription{
+		"game_logs": c.Subscriptions.GameLogs,
+		"moves":     c.Subscriptions.Moves,
+		"war":       c.Subscriptions.War,
+	} {
+		prefix := "subscriptions." + name
+		if s.Prefetch < 0 {
+			errs = append(errs, fmt.Errorf("%s.prefetch must not be negative", prefix))
+		}
+		if s.Concurrency < 1 {
+			errs = append(errs, fmt.Errorf("%s.concurrency must be at least 1", prefix))
+		}
+		if s.Timeout < 0 {
+			errs = append(errs, fmt.Errorf("%s.timeout must not be negative", prefix))
+		}
+		if s.Retry.MaxAttempts < 0 {
+			errs = append(errs, fmt.Errorf("%s.retry.max_attempts must not be negative", prefix))
+		}
+		if s.Retry.MaxAttempts > 0 && s.Retry.InitialDelay <= 0 {
+			errs = append(errs, fmt.Errorf("%s.retry.initial_delay must be positive", prefix))
+		}
+	}
+
+	g := c.Game
+	if g.MaxUnits < 0 {
+		errs = append(errs, errors.New("game.max_units must not be negative"))
+	}
+	if g.InfantryPower < 0 || g.CavalryPower < 0 || g.ArtilleryPower < 0 {
+		errs = append(errs, errors.New("game: unit powers must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// DialURLs returns the broker URLs with the configured vhost filled in, and
+// the configured credentials in those that do not carry their own.
+func (b Broker) DialURLs() []string {
+	urls := make([]string, 0, len(b.URLs))
+	for _, raw := range b.URLs {
+		u, err := url.Parse(raw)
+		if err != nil {
+			// rejected by Validate
+			continue
+		}
+		if u.User == nil && b.Username != "" {
+			u.User = url.UserPassword(b.Username, b.Password)
+		}
+		if b.VHost != "" {
+			u.Path = "/" + b.VHost
+			u.RawPath = "/" + url.PathEscape(b.VHost)
+		}
+		urls = append(urls, u.String())
+	}
+	return urls
+}
+
+// STOMP reports whether the broker is reached through its STOMP plugin.
+// STOMP cannot declare exchanges, so the topology has to be declared over
+// AMQP beforehand.
+func (b Broker) STOMP() bool {
+	if len(b.URLs) == 0 {
+		return false
+	}
+	u, err := url.Parse(b.URLs[0])
+	return err == nil && isSTOMP(u.Scheme)
+}
+
+// MQTT reports whether the broker is reached through its MQTT plugin. The
+// plugin only publishes to and binds on the exchange set as mqtt.exchange in
+// the broker's configuration, which the Dockerfile sets to peril_topic.
+func (b Broker) MQTT() bool {
+	return b.transport() == "mqtt"
+}
+
+// NATS reports whether the broker is a NATS server with JetStream.
+func (b Broker) NATS() bool {
+	return b.transport() == "nats"
+}
+
+func (b Broker) transport() string {
+	if len(b.URLs) == 0 {
+		return ""
+	}
+	u, err := url.Parse(b.URLs[0])
+	if err != nil {
+		return ""
+	}
+	return transport(u.Scheme)
+}
+
+func isSTOMP(scheme string) bool {
+	return scheme == "stomp" || scheme == "stomps"
+}
+
+func transport(scheme string) string {
+	switch {
+	case isSTOMP(scheme):
+		return "stomp"
+	case scheme == "mqtt" || scheme == "mqtts":
+		return "mqtt"
+	case scheme == "nats":
+		return "nats"
+	}
+	return "amqp"
+}
+
+// Dial returns the DialFunc for the configured brokers, over TLS if any TLS
+// file is configured.
+func (b Broker) Dial() (pubsub.DialFunc, error) {
+	tlsConfig, err := b.TLS.Config()
+	if err != nil {
+		return nil, err
+	}
+	if b.STOMP() {
+		return pubsub.DialStomp(tlsConfig, b.DialURLs()...), nil
+	}
+	if b.MQTT() {
+		return pubsub.DialMQTT(tlsConfig, routing.ExchangePerilTopic, b.DialURLs()...), nil
+	}
+	if b.NATS() {
+		return pubsub.DialNATS(tlsConfig, b.DialURLs()...), nil
+	}
+	if b.TLS.ExternalAuth {
+		return pubsub.DialTLSExternalAuth(tlsConfig, b.DialURLs()...), nil
+	}
+	return pubsub.DialURLs(tlsConfig, b.DialURLs()...), nil
+}
+
+func (t TLS) enabled() bool {
+	return t.CAFile != "" || t.CertFile != "" || t.KeyFile != "" || t.ServerName != ""
+}
+
+// Config builds the client TLS settings, or returns nil if none are set.
+func (t TLS) Config() (*tls.Config, error) {
+	if !t.enabled() {
+		return nil, nil
+	}
+	return pubsub.NewTLSConfig(pubsub.TLSFiles{
+		CAFile:     t.CAFile,
+		CertFile:   t.CertFile,
+		KeyFile:    t.KeyFile,
+		ServerName: t.ServerName,
+	})
+}
+
+// Options turns the subscription tuning into subscribe options.
+func (s Subscription) Options() []pubsub.SubscribeOption {
+	opts := []pubsub.SubscribeOption{
+		pubsub.WithPrefetch(s.Prefetch, 0),
+		pubsub.WithConcurrency(s.Concurrency),
+	}
+	if s.Retry.MaxAttempts > 0 {
+		opts = append(opts, pubsub.WithRetry(pubsub.RetryPolicy{
+			MaxAttempts:  s.Retry.MaxAttempts,
+			InitialDelay: s.Retry.InitialDelay,
+			MaxDelay:     s.Retry.MaxDelay,
+		}))
+	}
+	return opts
+}
+
+func (g Game) Rules() gamelogic.Rules {
+	return gamelogic.Rules{
+		MaxUnits:       g.MaxUnits,
+		InfantryPower:  g.InfantryPower,
+		CavalryPower:   g.CavalryPower,
+		ArtilleryPower: g.ArtilleryPower,
+	}
+}
@@ -0,0 +1,250 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrPrintConfig is returned by Load after it has printed the configuration
+// because of --print-config. The program should exit successfully.
+var ErrPrintConfig = errors.New("config: printed configuration")
+
+const configEnv = "PERIL_CONFIG"
+
+// setting is one configuration value that can be overridden by an
+// environment variable and a flag, both derived from key.
+type setting struct {
+	key   string
+	usage string
+	field func(*Config) interface{}
+}
+
+// env returns the environment variable for the setting, e.g.
+// PERIL_BROKER_VHOST for broker.vhost.
+func (s setting) env() string {
+	return "PERIL_" + strings.ToUpper(strings.ReplaceAll(s.key, ".", "_"))
+}
+
+func settings() []setting {
+	list := []setting{
+		{"broker.urls", "comma-separated broker URLs, tried in order", func(c *Config) interface{} { return &c.Broker.URLs }},
+		{"broker.vhost", "virtual host", func(c *Config) interface{} { return &c.Broker.VHost }},
+		{"broker.username", "broker user", func(c *Config) interface{} { return &c.Broker.Username }},
+		{"broker.password", "broker password", func(c *Config) interface{} { return &c.Broker.Password }},
+		{"broker.tls.ca_file", "CA certificate to verify the broker with", func(c *Config) interface{} { return &c.Broker.TLS.CAFile }},
+		{"broker.tls.cert_file", "client certificate", func(c *Config) interface{} { return &c.Broker.TLS.CertFile }},
+		{"broker.tls.key_file", "client certificate key", func(c *Config) interface{} { return &c.Broker.TLS.KeyFile }},
+		{"broker.tls.server_name", "server name to verify the broker certificate against", func(c *Config) interface{} { return &c.Broker.TLS.ServerName }},
+		{"broker.tls.external_auth", "authenticate with the client certificate", func(c *Config) interface{} { return &c.Broker.TLS.ExternalAuth }},
+		{"broker.reconnect_initial", "first reconnect delay", func(c *Config) interface{} { return &c.Broker.ReconnectInitial }},
+		{"broker.reconnect_max", "longest reconnect delay", func(c *Config) interface{} { return &c.Broker.ReconnectMax }},
+		{"nats.embedded", "run a NATS server in the Peril server and connect to it unless broker.urls is set", func(c *Config) interface{} { return &c.NATS.Embedded }},
+		{"nats.listen", "host:port the embedded NATS server listens on", func(c *Config) interface{} { return &c.NATS.Listen }},
+		{"nats.store_dir", "directory the embedded NATS server keeps messages in", func(c *Config) interface{} { return &c.NATS.StoreDir }},
+		{"gateway.listen", "host:port the WebSocket gateway serves on", func(c *Config) interface{} { return &c.Gateway.Listen }},
+		{"gateway.password", "password players log in to the gateway with, empty for none", func(c *Config) interface{} { return &c.Gateway.Password }},
+		{"admin.listen", "host:port the server's admin API serves on, empty for none", func(c *Config) interface{} { return &c.Admin.Listen }},
+		{"admin.token", "bearer token admin API requests must carry", func(c *Config) interface{} { return &c.Admin.Token }},
+		{"grpc.listen", "host:port the gRPC gateway serves on", func(c *Config) interface{} { return &c.GRPC.Listen }},
+		{"grpc.token", "bearer token gRPC calls must carry, empty for none", func(c *Config) interface{} { return &c.GRPC.Token }},
+		{"logs.game_log", "file game logs are written to", func(c *Config) interface{} { return &c.Logs.GameLog }},
+		{"logs.dedup_db", "file remembering written game logs", func(c *Config) interface{} { return &c.Logs.DedupDB }},
+		{"logs.batch_size", "most game logs written to disk at once", func(c *Config) interface{} { return &c.Logs.BatchSize }},
+		{"logs.flush_interval", "how long a batch of game logs waits to fill up", func(c *Config) interface{} { return &c.Logs.FlushInterval }},
+		{"logs.rate_limit.rate", "game logs per second a player may average, 0 for no limit", func(c *Config) interface{} { return &c.Logs.RateLimit.Rate }},
+		{"logs.rate_limit.burst", "game logs a player may send at once", func(c *Config) interface{} { return &c.Logs.RateLimit.Burst }},
+		{"logs.dead_letter_limited", "dead-letter game logs over the rate limit instead of dropping them", func(c *Config) interface{} { return &c.Logs.DeadLetterLimited }},
+		{"client.publish_limit.rate", "messages per second a client may average, 0 for no limit", func(c *Config) interface{} { return &c.Client.PublishLimit.Rate }},
+		{"client.publish_limit.burst", "messages a client may publish at once", func(c *Config) interface{} { return &c.Client.PublishLimit.Burst }},
+		{"game.start_paused", "start the game paused", func(c *Config) interface{} { return &c.Game.StartPaused }},
+		{"game.max_units", "units a player may have, 0 for no limit", func(c *Config) interface{} { return &c.Game.MaxUnits }},
+		{"game.infantry_power", "power of an infantry unit", func(c *Config) interface{} { return &c.Game.InfantryPower }},
+		{"game.cavalry_power", "power of a cavalry unit", func(c *Config) interface{} { return &c.Game.CavalryPower }},
+		{"game.artillery_power", "power of an artillery unit", func(c *Config) interface{} { return &c.Game.ArtilleryPower }},
+	}
+
+	subs := []struct {
+		name string
+		sub  func(*Config) *Subscription
+	}{
+		{"game_logs", func(c *Config) *Subscription { return &c.Subscriptions.GameLogs }},
+		{"moves", func(c *Config) *Subscription { return &c.Subscriptions.Moves }},
+		{"war", func(c *Config) *Subscription { return &c.Subscriptions.War }},
+	}
+	for _, s := range subs {
+		prefix := "subscriptions." + s.name + "."
+		sub := s.sub
+		list = append(list,
+			setting{prefix + "prefetch", "unacked messages per consumer", func(c *Config) interface{} { return &sub(c).Prefetch }},
+			setting{prefix + "concurrency", "messages handled in parallel", func(c *Config) interface{} { return &sub(c).Concurrency }},
+			setting{prefix + "timeout", "time a handler gets per message, 0 for no limit", func(c *Config) interface{} { return &sub(c).Timeout }},
+			setting{prefix + "retry.max_attempts", "deliveries before a message is dead-lettered, 0 to requeue forever", func(c *Config) interface{} { return &sub(c).Retry.MaxAttempts }},
+			setting{prefix + "retry.initial_delay", "delay before the first retry", func(c *Config) interface{} { return &sub(c).Retry.InitialDelay }},
+			setting{prefix + "retry.max_delay", "longest delay between retries", func(c *Config) interface{} { return &sub(c).Retry.MaxDelay }},
+		)
+	}
+	return list
+}
+
+func set(field interface{}, value string) error {
+	switch f := field.(type) {
+	case *string:
+		*f = value
+	case *[]string:
+		*f = nil
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				*f = append(*f, v)
+			}
+		}
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*f = n
+	case *float64:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		*f = n
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		*f = b
+	case *time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*f = d
+	default:
+		return fmt.Errorf("unsupported setting type %T", field)
+	}
+	return nil
+}
+
+// Load builds the configuration from the defaults, a YAML file, PERIL_*
+// environment variables and finally the command-line flags in args, each
+// overriding the one before. The file is given by -config or PERIL_CONFIG.
+func Load(name string, args []string) (Config, error) {
+	cfg, rest, err := LoadArgs(name, args)
+	if err == nil && len(rest) > 0 {
+		return Config{}, fmt.Errorf("unexpected arguments: %s", strings.Join(rest, " "))
+	}
+	return cfg, err
+}
+
+// LoadArgs is Load for programs that take arguments after the flags. It
+// returns those arguments.
+func LoadArgs(name string, args []string) (Config, []string, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv(configEnv), "YAML config file (env "+configEnv+")")
+	printConfig := fs.Bool("print-config", false, "print the resulting configuration and exit")
+
+	type override struct {
+		setting setting
+		value   string
+	}
+	var flagValues []override
+	all := settings()
+	defaults := Default()
+	for _, s := range all {
+		s := s
+		usage := s.usage + " (env " + s.env() + ")"
+		record := func(v string) error {
+			flagValues = append(flagValues, override{s, v})
+			return nil
+		}
+		if _, ok := s.field(&defaults).(*bool); ok {
+			fs.BoolFunc(s.key, usage, record)
+			continue
+		}
+		fs.Func(s.key, usage, record)
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, nil, err
+	}
+
+	cfg := defaults
+	if *configPath != "" {
+		data, err := os.ReadFile(*configPath)
+		if err != nil {
+			return Config{}, nil, fmt.Errorf("could not read config file: %v", err)
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+			return Config{}, nil, fmt.Errorf("could not parse config file %s: %v", *configPath, err)
+		}
+	}
+
+	for _, s := range all {
+		v, ok := os.LookupEnv(s.env())
+		if !ok {
+			continue
+		}
+		if err := set(s.field(&cfg), v); err != nil {
+			return Config{}, nil, fmt.Errorf("invalid %s: %v", s.env(), err)
+		}
+	}
+
+	for _, o := range flagValues {
+		if err := set(o.setting.field(&cfg), o.value); err != nil {
+			return Config{}, nil, fmt.Errorf("invalid -%s: %v", o.setting.key, err)
+		}
+	}
+
+	// -nats.embedded alone runs a game without any broker of its own
+	if cfg.NATS.Embedded && slices.Equal(cfg.Broker.URLs, defaults.Broker.URLs) {
+		cfg.Broker.URLs = []string{"nats://" + cfg.NATS.Listen}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return Config{}, nil, fmt.Errorf("invalid configuration:\n%v", err)
+	}
+
+	if *printConfig {
+		if err := cfg.Write(os.Stdout); err != nil {
+			return Config{}, nil, err
+		}
+		return cfg, fs.Args(), ErrPrintConfig
+	}
+	return cfg, fs.Args(), nil
+}
+
+// Write encodes the configuration as YAML with the passwords masked, in a
+// form Load accepts as a config file.
+func (c Config) Write(w io.Writer) error {
+	if c.Broker.Password != "" {
+		c.Broker.Password = "********"
+	}
+	if c.Gateway.Password != "" {
+		c.Gateway.Password = "********"
+	}
+	if c.Admin.Token != "" {
+		c.Admin.Token = "********"
+	}
+	if c.GRPC.Token != "" {
+		c.GRPC.Token = "********"
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(c); err != nil {
+		return fmt.Errorf("could not encode config: %v", err)
+	}
+	return enc.Close()
+}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "peril.yaml")
+	data := "broker:\n  vhost: file\nsubscriptions:\n  moves:\n    prefetch: 5\n"
+	if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// registers the variables to be restored after the test
+	t.Setenv(configEnv, "")
+	t.Setenv("PERIL_BROKER_VHOST", "")
+
+	for _, tc := range []struct {
+		configEnv string
+		vhostEnv  string
+		args      []string
+		vhost     string
+		prefetch  int
+	}{
+		{vhost: "", prefetch: 10},
+		{args: []string{"-config", file}, vhost: "file", prefetch: 5},
+		{configEnv: file, vhost: "file", prefetch: 5},
+		{configEnv: file, vhostEnv: "env", vhost: "env", prefetch: 5},
+		{vhostEnv: "env", vhost: "env", prefetch: 10},
+		{configEnv: file, vhostEnv: "env", args: []string{"-broker.vhost", "flag"}, vhost: "flag", prefetch: 5},
+		{args: []string{"-config", file, "-subscriptions.moves.prefetch", "7"}, vhost: "file", prefetch: 7},
+	} {
+		for name, value := range map[string]string{configEnv: tc.configEnv, "PERIL_BROKER_VHOST": tc.vhostEnv} {
+			if value == "" {
+				os.Unsetenv(name)
+			} else {
+				os.Setenv(name, value)
+			}
+		}
+		cfg, err := Load("peril", tc.args)
+		if err != nil {
+			t.Errorf("%+v: %v", tc, err)
+			continue
+		}
+		if cfg.Broker.VHost != tc.vhost || cfg.Subscriptions.Moves.Prefetch != tc.prefetch {
+			t.Errorf("%+v: got vhost %q and prefetch %d", tc, cfg.Broker.VHost, cfg.Subscriptions.Moves.Prefetch)
+		}
+	}
+
+	t.Setenv("PERIL_SUBSCRIPTIONS_MOVES_PREFETCH", "many")
+	if _, err := Load("peril", nil); err == nil {
+		t.Error("an invalid environment variable was accepted")
+	}
+}
+
+func TestLoadEmbeddedNATS(t *testing.T) {
+	t.Setenv(configEnv, "")
+	for _, tc := range []struct {
+		args []string
+		want []string
+	}{
+		{args: nil, want: []string{"amqp://localhost:5672/"}},
+		{args: []string{"-nats.embedded"}, want: []string{"nats://localhost:4222"}},
+		{args: []string{"-nats.embedded", "-nats.listen", "0.0.0.0:4333"}, want: []string{"nats://0.0.0.0:4333"}},
+		{args: []string{"-nats.embedded", "-broker.urls", "nats://node2:4222"}, want: []string{"nats://node2:4222"}},
+	} {
+		cfg, err := Load("peril", tc.args)
+		if err != nil {
+			t.Errorf("%q: %v", tc.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(cfg.Broker.URLs, tc.want) {
+			t.Errorf("%q: broker URLs are %q, want %q", tc.args, cfg.Broker.URLs, tc.want)
+		}
+	}
+
+	if _, err := Load("peril", []string{"-nats.embedded", "-broker.urls", "amqp://node2:5672/"}); err == nil {
+		t.Error("an embedded NATS server with AMQP broker URLs passed validation")
+	}
+}
@@ -7,9 +7,28 @@ import (
 type GameState struct {
 	Player Player
 	Paused bool
+	Rules  Rules
 	mu     *sync.RWMutex
 }
 
+// Rules are the tunable parts of the game. Every client in a game has to use
+// the same rules.
+type Rules struct {
+	// MaxUnits limits how many units a player can have, 0 means no limit.
+	MaxUnits       int
+	InfantryPower  int
+	CavalryPower   int
+	ArtilleryPower int
+}
+
+func DefaultRules() Rules {
+	return Rules{
+		InfantryPower:  1,
+		CavalryPower:   5,
+		ArtilleryPower: 10,
+	}
+}
+
 func NewGameState(username string) *GameState {
 	return &GameState{
 		Player: Player{
@@ -17,6 +36,7 @@ func NewGameState(username string) *GameState {
 			Units:    map[int]Unit{},
 		},
 		Paused: false,
+		Rules:  DefaultRules(),
 		mu:     &sync.RWMutex{},
 	}
 }
@@ -33,7 +53,7 @@ func (gs *GameState) pauseGame() {
 	gs.Paused = true
 }
 
-func (gs *GameState) isPaused() bool {
+func (gs *GameState) IsPaused() bool {
 	gs.mu.RLock()
 	defer gs.mu.RUnlock()
 	return gs.Paused
@@ -0,0 +1,146 @@
+package gamelogic
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/albsko/learn-pub-sub/internal/routing"
+)
+
+// ErrLogWriterClosed is returned by Write once the LogWriter is closed.
+var ErrLogWriterClosed = errors.New("gamelogic: log writer is closed")
+
+// LogWriter appends game logs to a file that stays open. Logs written
+// concurrently are gathered into batches of up to maxBatch, or whatever
+// arrived within flushEvery of the first one, and each batch is flushed and
+// fsynced at once, so writing many logs costs about as much as writing one.
+// A batch is written in the order the logs were made, so logs that raced
+// each other to the writer still end up in order.
+type LogWriter struct {
+	f          *os.File
+	buf        *bufio.Writer
+	maxBatch   int
+	flushEvery time.Duration
+
+	requests  chan logRequest
+	closing   chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+type logRequest struct {
+	at      time.Time
+	line    string
+	flushed chan error
+}
+
+func NewLogWriter(path string, maxBatch int, flushEvery time.Duration) (*LogWriter, error) {
+	if maxBatch < 1 {
+		return nil, fmt.Errorf("batch size must be at least 1, got %d", maxBatch)
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open logs file: %v", err)
+	}
+	w := &LogWriter{
+		f:          f,
+		buf:        bufio.NewWriter(f),
+		maxBatch:   maxBatch,
+		flushEvery: flushEvery,
+		requests:   make(chan logRequest),
+		closing:    make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go w.run()
+	return w, nil
+}
+
+// Write queues gamelog and returns once the batch it ended up in is on
+// disk, with the error of writing that batch. ctx only bounds the wait for
+// a place in a batch: a queued log is written whatever happens to ctx, so
+// a nil error is the only sign it may be acknowledged.
+func (w *LogWriter) Write(ctx context.Context, gamelog routing.GameLog) error {
+	r := logRequest{
+		at:      gamelog.CurrentTime,
+		line:    FormatLog(gamelog),
+		flushed: make(chan error, 1),
+	}
+	select {
+	case w.requests <- r:
+	case <-w.closing:
+		return ErrLogWriterClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return <-r.flushed
+}
+
+// Close writes the logs already queued and closes the file.
+func (w *LogWriter) Close() error {
+	w.closeOnce.Do(func() {
+		close(w.closing)
+		<-w.done
+		w.closeErr = w.f.Close()
+	})
+	return w.closeErr
+}
+
+func (w *LogWriter) run() {
+	defer close(w.done)
+	for {
+		var first logRequest
+		select {
+		case first = <-w.requests:
+		case <-w.closing:
+			return
+		}
+
+		batch := []logRequest{first}
+		timer := time.NewTimer(w.flushEvery)
+	GATHER:
+		for len(batch) < w.maxBatch {
+			select {
+			case r := <-w.requests:
+				batch = append(batch, r)
+			case <-timer.C:
+				break GATHER
+			case <-w.closing:
+				break GATHER
+			}
+		}
+		timer.Stop()
+
+		err := w.flush(batch)
+		for _, r := range batch {
+			r.flushed <- err
+		}
+	}
+}
+
+func (w *LogWriter) flush(batch []logRequest) error {
+	log.Printf("writing %d game logs...", len(batch))
+
+	sort.SliceStable(batch, func(i, j int) bool { return batch[i].at.Before(batch[j].at) })
+	for _, r := range batch {
+		w.buf.WriteString(r.line)
+	}
+	err := w.buf.Flush()
+	if err != nil {
+		// a failed bufio.Writer keeps failing, the next batch starts over
+		w.buf.Reset(w.f)
+		return fmt.Errorf("could not write to logs file: %v", err)
+	}
+	err = w.f.Sync()
+	if err != nil {
+		return fmt.Errorf("could not sync logs file: %v", err)
+	}
+	return nil
+}
@@ -22,6 +22,10 @@ func (gs *GameState) CommandSpawn(words []string) error {
 		return fmt.Errorf("error: %s is not a valid unit", rank)
 	}
 
+	if gs.Rules.MaxUnits > 0 && len(gs.getUnitsSnap()) >= gs.Rules.MaxUnits {
+		return fmt.Errorf("error: you already have the maximum of %d units", gs.Rules.MaxUnits)
+	}
+
 	id := len(gs.getUnitsSnap()) + 1
 	gs.addUnit(Unit{
 		ID:       id,
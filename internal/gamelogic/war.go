@@ -59,8 +59,8 @@ func (gs *GameState) HandleWar(rw RecognitionOfWar) (outcome WarOutcome, winner
 	for _, unit := range defenderUnits {
 		fmt.Printf("  * %v\n", unit.Rank)
 	}
-	attackerPower := unitsToPowerLevel(attackerUnits)
-	defenderPower := unitsToPowerLevel(defenderUnits)
+	attackerPower := gs.Rules.powerLevel(attackerUnits)
+	defenderPower := gs.Rules.powerLevel(defenderUnits)
 	fmt.Printf("Attacker has a power level of %v\n", attackerPower)
 	fmt.Printf("Defender has a power level of %v\n", defenderPower)
 	if attackerPower > defenderPower {
@@ -88,17 +88,17 @@ func (gs *GameState) HandleWar(rw RecognitionOfWar) (outcome WarOutcome, winner
 	return WarOutcomeDraw, rw.Attacker.Username, rw.Defender.Username
 }
 
-func unitsToPowerLevel(units []Unit) int {
+func (r Rules) powerLevel(units []Unit) int {
 	power := 0
 	for _, unit := range units {
 		if unit.Rank == RankArtillery {
-			power += 10
+			power += r.ArtilleryPower
 		}
 		if unit.Rank == RankCavalry {
-			power += 5
+			power += r.CavalryPower
 		}
 		if unit.Rank == RankInfantry {
-			power += 1
+			power += r.InfantryPower
 		}
 	}
 	return power
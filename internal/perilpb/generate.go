@@ -0,0 +1,5 @@
+// Package perilpb holds the gRPC API of cmd/grpcgateway, generated from
+// peril.proto.
+package perilpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative peril.proto
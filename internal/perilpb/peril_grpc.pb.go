@@ -0,0 +1,378 @@
+// The Peril game over gRPC, for tools that would rather not speak AMQP.
+// cmd/grpcgateway serves it on top of the broker: the unary calls publish
+// what the Go client would publish, and the Watch calls stream what its
+// subscriptions receive.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: peril.proto
+
+package perilpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Peril_PublishMove_FullMethodName     = "/peril.v1.Peril/PublishMove"
+	Peril_DeclareWar_FullMethodName      = "/peril.v1.Peril/DeclareWar"
+	Peril_PublishGameLog_FullMethodName  = "/peril.v1.Peril/PublishGameLog"
+	Peril_SetPlayingState_FullMethodName = "/peril.v1.Peril/SetPlayingState"
+	Peril_WatchArmyMoves_FullMethodName  = "/peril.v1.Peril/WatchArmyMoves"
+	Peril_WatchWars_FullMethodName       = "/peril.v1.Peril/WatchWars"
+	Peril_WatchGameLogs_FullMethodName   = "/peril.v1.Peril/WatchGameLogs"
+)
+
+// PerilClient is the client API for Peril service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type PerilClient interface {
+	// PublishMove publishes to peril_topic with army_moves.<player>.
+	PublishMove(ctx context.Context, in *ArmyMove, opts ...grpc.CallOption) (*PublishResponse, error)
+	// DeclareWar publishes to peril_topic with war.<defender>, as the player
+	// who noticed the war does.
+	DeclareWar(ctx context.Context, in *RecognitionOfWar, opts ...grpc.CallOption) (*PublishResponse, error)
+	// PublishGameLog publishes to peril_topic with game_logs.<username>.
+	PublishGameLog(ctx context.Context, in *GameLog, opts ...grpc.CallOption) (*PublishResponse, error)
+	// SetPlayingState pauses or resumes every client through peril_direct.
+	SetPlayingState(ctx context.Context, in *PlayingState, opts ...grpc.CallOption) (*PublishResponse, error)
+	// The Watch calls stream copies of the messages; they do not take them
+	// from the players' queues.
+	WatchArmyMoves(ctx context.Context, in *WatchArmyMovesRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ArmyMove], error)
+	WatchWars(ctx context.Context, in *WatchWarsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[RecognitionOfWar], error)
+	WatchGameLogs(ctx context.Context, in *WatchGameLogsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[GameLog], error)
+}
+
+type perilClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewPerilClient(cc grpc.ClientConnInterface) PerilClient {
+	return &perilClient{cc}
+}
+
+func (c *perilClient) PublishMove(ctx context.Context, in *ArmyMove, opts ...grpc.CallOption) (*PublishResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(PublishResponse)
+	err := c.cc.Invoke(ctx, Peril_PublishMove_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *perilClient) DeclareWar(ctx context.Context, in *RecognitionOfWar, opts ...grpc.CallOption) (*PublishResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(PublishResponse)
+	err := c.cc.Invoke(ctx, Peril_DeclareWar_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *perilClient) PublishGameLog(ctx context.Context, in *GameLog, opts ...grpc.CallOption) (*PublishResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(PublishResponse)
+	err := c.cc.Invoke(ctx, Peril_PublishGameLog_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *perilClient) SetPlayingState(ctx context.Context, in *PlayingState, opts ...grpc.CallOption) (*PublishResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(PublishResponse)
+	err := c.cc.Invoke(ctx, Peril_SetPlayingState_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *perilClient) WatchArmyMoves(ctx context.Context, in *WatchArmyMovesRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ArmyMove], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Peril_ServiceDesc.Streams[0], Peril_WatchArmyMoves_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchArmyMovesRequest, ArmyMove]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Peril_WatchArmyMovesClient = grpc.ServerStreamingClient[ArmyMove]
+
+func (c *perilClient) WatchWars(ctx context.Context, in *WatchWarsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[RecognitionOfWar], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Peril_ServiceDesc.Streams[1], Peril_WatchWars_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchWarsRequest, RecognitionOfWar]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Peril_WatchWarsClient = grpc.ServerStreamingClient[RecognitionOfWar]
+
+func (c *perilClient) WatchGameLogs(ctx context.Context, in *WatchGameLogsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[GameLog], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Peril_ServiceDesc.Streams[2], Peril_WatchGameLogs_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchGameLogsRequest, GameLog]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Peril_WatchGameLogsClient = grpc.ServerStreamingClient[GameLog]
+
+// PerilServer is the server API for Peril service.
+// All implementations must embed UnimplementedPerilServer
+// for forward compatibility.
+type PerilServer interface {
+	// PublishMove publishes to peril_topic with army_moves.<player>.
+	PublishMove(context.Context, *ArmyMove) (*PublishResponse, error)
+	// DeclareWar publishes to peril_topic with war.<defender>, as the player
+	// who noticed the war does.
+	DeclareWar(context.Context, *RecognitionOfWar) (*PublishResponse, error)
+	// PublishGameLog publishes to peril_topic with game_logs.<username>.
+	PublishGameLog(context.Context, *GameLog) (*PublishResponse, error)
+	// SetPlayingState pauses or resumes every client through peril_direct.
+	SetPlayingState(context.Context, *PlayingState) (*PublishResponse, error)
+	// The Watch calls stream copies of the messages; they do not take them
+	// from the players' queues.
+	WatchArmyMoves(*WatchArmyMovesRequest, grpc.ServerStreamingServer[ArmyMove]) error
+	WatchWars(*WatchWarsRequest, grpc.ServerStreamingServer[RecognitionOfWar]) error
+	WatchGameLogs(*WatchGameLogsRequest, grpc.ServerStreamingServer[GameLog]) error
+	mustEmbedUnimplementedPerilServer()
+}
+
+// UnimplementedPerilServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedPerilServer struct{}
+
+func (UnimplementedPerilServer) PublishMove(context.Context, *ArmyMove) (*PublishResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PublishMove not implemented")
+}
+func (UnimplementedPerilServer) DeclareWar(context.Context, *RecognitionOfWar) (*PublishResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeclareWar not implemented")
+}
+func (UnimplementedPerilServer) PublishGameLog(context.Context, *GameLog) (*PublishResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PublishGameLog not implemented")
+}
+func (UnimplementedPerilServer) SetPlayingState(context.Context, *PlayingState) (*PublishResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetPlayingState not implemented")
+}
+func (UnimplementedPerilServer) WatchArmyMoves(*WatchArmyMovesRequest, grpc.ServerStreamingServer[ArmyMove]) error {
+	return status.Errorf(codes.Unimplemented, "method WatchArmyMoves not implemented")
+}
+func (UnimplementedPerilServer) WatchWars(*WatchWarsRequest, grpc.ServerStreamingServer[RecognitionOfWar]) error {
+	return status.Errorf(codes.Unimplemented, "method WatchWars not implemented")
+}
+func (UnimplementedPerilServer) WatchGameLogs(*WatchGameLogsRequest, grpc.ServerStreamingServer[GameLog]) error {
+	return status.Errorf(codes.Unimplemented, "method WatchGameLogs not implemented")
+}
+func (UnimplementedPerilServer) mustEmbedUnimplementedPerilServer() {}
+func (UnimplementedPerilServer) testEmbeddedByValue()               {}
+
+// UnsafePerilServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to PerilServer will
+// result in compilation errors.
+type UnsafePerilServer interface {
+	mustEmbedUnimplementedPerilServer()
+}
+
+func RegisterPerilServer(s grpc.ServiceRegistrar, srv PerilServer) {
+	// If the following call pancis, it indicates UnimplementedPerilServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Peril_ServiceDesc, srv)
+}
+
+func _Peril_PublishMove_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ArmyMove)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PerilServer).PublishMove(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Peril_PublishMove_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PerilServer).PublishMove(ctx, req.(*ArmyMove))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Peril_DeclareWar_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RecognitionOfWar)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PerilServer).DeclareWar(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Peril_DeclareWar_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PerilServer).DeclareWar(ctx, req.(*RecognitionOfWar))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Peril_PublishGameLog_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GameLog)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PerilServer).PublishGameLog(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Peril_PublishGameLog_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PerilServer).PublishGameLog(ctx, req.(*GameLog))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Peril_SetPlayingState_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PlayingState)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PerilServer).SetPlayingState(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Peril_SetPlayingState_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PerilServer).SetPlayingState(ctx, req.(*PlayingState))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Peril_WatchArmyMoves_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchArmyMovesRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PerilServer).WatchArmyMoves(m, &grpc.GenericServerStream[WatchArmyMovesRequest, ArmyMove]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Peril_WatchArmyMovesServer = grpc.ServerStreamingServer[ArmyMove]
+
+func _Peril_WatchWars_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchWarsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PerilServer).WatchWars(m, &grpc.GenericServerStream[WatchWarsRequest, RecognitionOfWar]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Peril_WatchWarsServer = grpc.ServerStreamingServer[RecognitionOfWar]
+
+func _Peril_WatchGameLogs_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchGameLogsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PerilServer).WatchGameLogs(m, &grpc.GenericServerStream[WatchGameLogsRequest, GameLog]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Peril_WatchGameLogsServer = grpc.ServerStreamingServer[GameLog]
+
+// Peril_ServiceDesc is the grpc.ServiceDesc for Peril service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Peril_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "peril.v1.Peril",
+	HandlerType: (*PerilServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "PublishMove",
+			Handler:    _Peril_PublishMove_Handler,
+		},
+		{
+			MethodName: "DeclareWar",
+			Handler:    _Peril_DeclareWar_Handler,
+		},
+		{
+			MethodName: "PublishGameLog",
+			Handler:    _Peril_PublishGameLog_Handler,
+		},
+		{
+			MethodName: "SetPlayingState",
+			Handler:    _Peril_SetPlayingState_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchArmyMoves",
+			Handler:       _Peril_WatchArmyMoves_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "WatchWars",
+			Handler:       _Peril_WatchWars_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "WatchGameLogs",
+			Handler:       _Peril_WatchGameLogs_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "peril.proto",
+}
@@ -0,0 +1,139 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type Publisher interface {
+	PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+}
+
+type Subscriber interface {
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Cancel(consumer string, noWait bool) error
+}
+
+// Channel is the subset of *amqp.Channel used by this package. Every
+// Broker implementation hands these out in place of a real AMQP channel.
+type Channel interface {
+	Publisher
+	Subscriber
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueuePurge(name string, noWait bool) (int, error)
+	Get(queue string, autoAck bool) (msg amqp.Delivery, ok bool, err error)
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(c chan amqp.Return) chan amqp.Return
+	NotifyClose(c chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+type Broker interface {
+	Channel() (Channel, error)
+	Close() error
+}
+
+// Connection is a single broker connection that reports when it goes away.
+type Connection interface {
+	Broker
+	NotifyClose(c chan *amqp.Error) chan *amqp.Error
+}
+
+type DialFunc func() (Connection, error)
+
+// ErrNotSupported is returned by STOMP and MQTT channels for AMQP operations
+// their protocol has no equivalent for, such as declaring exchanges. Declare
+// the topology over AMQP, e.g. with perilctl topology declare.
+var ErrNotSupported = errors.New("pubsub: not supported by this transport")
+
+func DialURL(url string) DialFunc {
+	return func() (Connection, error) {
+		conn, err := amqp.Dial(url)
+		if err != nil {
+			return nil, err
+		}
+		return &amqpBroker{conn: conn}, nil
+	}
+}
+
+// DialURLs tries each URL in order and returns the first connection that
+// succeeds, so the connection manager fails over between cluster nodes. A
+// non-nil tlsConfig is used for amqps URLs.
+func DialURLs(tlsConfig *tls.Config, urls ...string) DialFunc {
+	return dialURLs(urls, tlsConfig, nil)
+}
+
+// DialTLSExternalAuth is DialURLs for brokers that authenticate clients by
+// their TLS certificate (SASL EXTERNAL) instead of the URL's credentials.
+func DialTLSExternalAuth(tlsConfig *tls.Config, urls ...string) DialFunc {
+	return dialURLs(urls, tlsConfig, []amqp.Authentication{&amqp.ExternalAuth{}})
+}
+
+func dialURLs(urls []string, tlsConfig *tls.Config, sasl []amqp.Authentication) DialFunc {
+	return func() (Connection, error) {
+		var errs []error
+		for _, url := range urls {
+			config := amqp.Config{
+				SASL:      sasl,
+				Heartbeat: 10 * time.Second,
+				Locale:    "en_US",
+			}
+			if tlsConfig != nil {
+				// amqp fills in ServerName from the URL, which must not
+				// leak into the dial of the next URL
+				config.TLSClientConfig = tlsConfig.Clone()
+			}
+			conn, err := amqp.DialConfig(url, config)
+			if err == nil {
+				return &amqpBroker{conn: conn}, nil
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", redactURL(url), err))
+		}
+		return nil, errors.Join(errs...)
+	}
+}
+
+// redactURL hides the password so dial errors can be printed.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "<invalid url>"
+	}
+	return u.Redacted()
+}
+
+type amqpBroker struct {
+	conn *amqp.Connection
+}
+
+func NewAMQPBroker(conn *amqp.Connection) Broker {
+	return &amqpBroker{conn: conn}
+}
+
+func (b *amqpBroker) Channel() (Channel, error) {
+	ch, err := b.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+func (b *amqpBroker) NotifyClose(c chan *amqp.Error) chan *amqp.Error {
+	return b.conn.NotifyClose(c)
+}
+
+func (b *amqpBroker) Close() error {
+	return b.conn.Close()
+}
@@ -0,0 +1,218 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var ErrNacked = errors.New("pubsub: publishing was nacked by the broker")
+
+// UnroutableError is returned when a mandatory publishing matched no queue
+// and the broker sent it back.
+type UnroutableError struct {
+	Exchange   string
+	RoutingKey string
+	ReplyCode  uint16
+	ReplyText  string
+}
+
+func (e *UnroutableError) Error() string {
+	return fmt.Sprintf("pubsub: message to exchange %q with key %q was returned: %d %s",
+		e.Exchange, e.RoutingKey, e.ReplyCode, e.ReplyText)
+}
+
+// SettleFollowUp settles a message after publishing the follow-up it caused,
+// which failed with err if err is not nil. Redelivering the message cannot
+// help when nothing is bound for the follow-up.
+func SettleFollowUp(err error) AckType {
+	if err == nil {
+		return Ack
+	}
+	var unroutable *UnroutableError
+	if errors.As(err, &unroutable) {
+		return NackDiscard
+	}
+	return NackRequeue
+}
+
+// ConfirmingPublisher puts a channel in confirm mode and makes every publish
+// wait until the broker has taken responsibility for the message. Publishings
+// are always mandatory, so a message no queue is bound for fails with an
+// *UnroutableError instead of being dropped silently.
+type ConfirmingPublisher struct {
+	ch      Channel
+	timeout time.Duration
+
+	// publishMu keeps delivery tags in step with seq
+	publishMu sync.Mutex
+	seq       uint64
+
+	mu      sync.Mutex
+	waiting map[uint64]*confirmWaiter
+	closed  bool
+}
+
+// confirmWaiter is a publish waiting for its confirm. A return carries no
+// delivery tag, so it is matched to its publish by the message instead.
+type confirmWaiter struct {
+	result     chan error
+	exchange   string
+	key        string
+	messageID  string
+	unroutable *UnroutableError
+}
+
+// NewConfirmingPublisher takes over ch; it should not be used to publish
+// directly afterwards. timeout bounds each publish whose context has no
+// deadline of its own, zero means wait as long as the context allows.
+func NewConfirmingPublisher(ch Channel, timeout time.Duration) (*ConfirmingPublisher, error) {
+	if err := ch.Confirm(false); err != nil {
+		return nil, fmt.Errorf("could not put channel in confirm mode: %v", err)
+	}
+	p := &ConfirmingPublisher{
+		ch:      ch,
+		timeout: timeout,
+		waiting: map[uint64]*confirmWaiter{},
+	}
+	go p.settle(
+		ch.NotifyPublish(make(chan amqp.Confirmation, 1)),
+		ch.NotifyReturn(make(chan amqp.Return, 1)),
+	)
+	return p, nil
+}
+
+func (p *ConfirmingPublisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if _, ok := ctx.Deadline(); !ok && p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	p.publishMu.Lock()
+	tag := p.seq + 1
+	w := &confirmWaiter{
+		result:    make(chan error, 1),
+		exchange:  exchange,
+		key:       key,
+		messageID: msg.MessageId,
+	}
+	// the waiter is registered first, the confirm may beat the publish call
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		p.publishMu.Unlock()
+		return amqp.ErrClosed
+	}
+	p.waiting[tag] = w
+	p.mu.Unlock()
+	err := p.ch.PublishWithContext(ctx, exchange, key, true, immediate, msg)
+	if err != nil {
+		p.mu.Lock()
+		delete(p.waiting, tag)
+		p.mu.Unlock()
+		p.publishMu.Unlock()
+		return err
+	}
+	p.seq = tag
+	p.publishMu.Unlock()
+
+	select {
+	case err := <-w.result:
+		return err
+	case <-ctx.Done():
+		p.mu.Lock()
+		delete(p.waiting, tag)
+		p.mu.Unlock()
+		return fmt.Errorf("pubsub: waiting for publisher confirm: %w", ctx.Err())
+	}
+}
+
+// settle drains confirms and returns for as long as the channel lives, so
+// a confirm nobody waits for any more never blocks the connection, and
+// hands each one to the publish waiting for its delivery tag.
+func (p *ConfirmingPublisher) settle(confirms chan amqp.Confirmation, returns chan amqp.Return) {
+	for confirms != nil {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			p.returned(r)
+		case c, ok := <-confirms:
+			if !ok {
+				confirms = nil
+				continue
+			}
+			// a basic.return always precedes the confirm of the same message
+			for drained := false; !drained && returns != nil; {
+				select {
+				case r, ok := <-returns:
+					if !ok {
+						returns = nil
+						continue
+					}
+					p.returned(r)
+				default:
+					drained = true
+				}
+			}
+
+			p.mu.Lock()
+			if w, ok := p.waiting[c.DeliveryTag]; ok {
+				delete(p.waiting, c.DeliveryTag)
+				switch {
+				case !c.Ack:
+					w.result <- ErrNacked
+				case w.unroutable != nil:
+					w.result <- w.unroutable
+				default:
+					w.result <- nil
+				}
+			}
+			p.mu.Unlock()
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for tag, w := range p.waiting {
+		delete(p.waiting, tag)
+		w.result <- amqp.ErrClosed
+	}
+}
+
+// returned marks the oldest unconfirmed publish of r's message as
+// unroutable.
+func (p *ConfirmingPublisher) returned(r amqp.Return) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var oldest uint64
+	for tag, w := range p.waiting {
+		if w.unroutable != nil || w.exchange != r.Exchange || w.key != r.RoutingKey || w.messageID != r.MessageId {
+			continue
+		}
+		if oldest == 0 || tag < oldest {
+			oldest = tag
+		}
+	}
+	if oldest == 0 {
+		return
+	}
+	p.waiting[oldest].unroutable = &UnroutableError{
+		Exchange:   r.Exchange,
+		RoutingKey: r.RoutingKey,
+		ReplyCode:  r.ReplyCode,
+		ReplyText:  r.ReplyText,
+	}
+}
+
+func (p *ConfirmingPublisher) Close() error {
+	return p.ch.Close()
+}
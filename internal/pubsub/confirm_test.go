@@ -0,0 +1,107 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// confirmChannel confirms publishes only when the test says so, like a
+// broker that is slow to answer.
+type confirmChannel struct {
+	Channel
+	published chan amqp.Publishing
+	confirms  chan amqp.Confirmation
+	returns   chan amqp.Return
+}
+
+func newConfirmChannel() *confirmChannel {
+	return &confirmChannel{published: make(chan amqp.Publishing, 100)}
+}
+
+func (ch *confirmChannel) Confirm(noWait bool) error { return nil }
+
+func (ch *confirmChannel) NotifyPublish(c chan amqp.Confirmation) chan amqp.Confirmation {
+	ch.confirms = c
+	return c
+}
+
+func (ch *confirmChannel) NotifyReturn(c chan amqp.Return) chan amqp.Return {
+	ch.returns = c
+	return c
+}
+
+func (ch *confirmChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	ch.published <- msg
+	return nil
+}
+
+func (ch *confirmChannel) Close() error {
+	close(ch.confirms)
+	close(ch.returns)
+	return nil
+}
+
+func TestConfirmingPublisherLateConfirms(t *testing.T) {
+	ch := newConfirmChannel()
+	p, err := NewConfirmingPublisher(ch, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := p.PublishWithContext(ctx, "ex", "key", true, false, amqp.Publishing{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+
+	// the confirms nobody waits for any more must not block the next ones;
+	// the channel buffers one, so a couple would stall a reader that only
+	// drains while publishing
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			ch.confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("late confirms were not drained")
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- p.PublishWithContext(context.Background(), "ex", "key", true, false, amqp.Publishing{})
+	}()
+	<-ch.published
+	<-ch.published
+	ch.returns <- amqp.Return{Exchange: "ex", RoutingKey: "key", ReplyCode: amqp.NoRoute, ReplyText: "NO_ROUTE"}
+	ch.confirms <- amqp.Confirmation{DeliveryTag: 2, Ack: true}
+	var unroutable *UnroutableError
+	if err := <-result; !errors.As(err, &unroutable) || unroutable.RoutingKey != "key" {
+		t.Fatalf("got %v, want an UnroutableError", err)
+	}
+
+	go func() {
+		result <- p.PublishWithContext(context.Background(), "ex", "key", true, false, amqp.Publishing{})
+	}()
+	<-ch.published
+	ch.confirms <- amqp.Confirmation{DeliveryTag: 3, Ack: false}
+	if err := <-result; !errors.Is(err, ErrNacked) {
+		t.Fatalf("got %v, want ErrNacked", err)
+	}
+
+	go func() {
+		result <- p.PublishWithContext(context.Background(), "ex", "key", true, false, amqp.Publishing{})
+	}()
+	<-ch.published
+	p.Close()
+	if err := <-result; !errors.Is(err, amqp.ErrClosed) {
+		t.Fatalf("got %v after close, want amqp.ErrClosed", err)
+	}
+}
@@ -0,0 +1,844 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var ErrNotConnected = errors.New("pubsub: not connected to broker")
+
+type ConnectionState int
+
+const (
+	StateConnecting ConnectionState = iota
+	StateConnected
+	StateReconnecting
+	StateClosed
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("ConnectionState(%d)", int(s))
+}
+
+type StateEvent struct {
+	State   ConnectionState
+	Attempt int
+	Err     error
+}
+
+type ManagerOption func(*ConnectionManager)
+
+func WithBackoff(initial, max time.Duration) ManagerOption {
+	return func(m *ConnectionManager) {
+		m.initialBackoff = initial
+		m.maxBackoff = max
+	}
+}
+
+// WithConnectionLogger sets where the manager reports channels it could not
+// restore after a reconnect. It defaults to slog.Default().
+func WithConnectionLogger(logger *slog.Logger) ManagerOption {
+	return func(m *ConnectionManager) {
+		if logger != nil {
+			m.logger = logger
+		}
+	}
+}
+
+// ConnectionManager keeps a broker connection alive. Channels handed out by
+// it record their declarations and consumers and replay them whenever the
+// connection or the channel itself has to be re-established, so callers keep
+// using the same Channel and delivery chan across broker restarts.
+type ConnectionManager struct {
+	dial           DialFunc
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	logger         *slog.Logger
+
+	mu        sync.Mutex
+	conn      Connection
+	state     ConnectionState
+	channels  map[*managedChannel]struct{}
+	listeners []chan StateEvent
+	nextTag   int
+	done      chan struct{}
+}
+
+func NewConnectionManager(dial DialFunc, opts ...ManagerOption) (*ConnectionManager, error) {
+	m := &ConnectionManager{
+		dial:           dial,
+		initialBackoff: 500 * time.Millisecond,
+		maxBackoff:     30 * time.Second,
+		logger:         slog.Default(),
+		state:          StateConnecting,
+		channels:       map[*managedChannel]struct{}{},
+		done:           make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	conn, err := dial()
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to broker: %v", err)
+	}
+	m.connected(conn)
+	return m, nil
+}
+
+func (m *ConnectionManager) NotifyState(c chan StateEvent) chan StateEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.state == StateClosed {
+		close(c)
+		return c
+	}
+	m.listeners = append(m.listeners, c)
+	return c
+}
+
+func (m *ConnectionManager) State() ConnectionState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+func (m *ConnectionManager) setStateLocked(ev StateEvent) {
+	m.state = ev.State
+	for _, c := range m.listeners {
+		select {
+		case c <- ev:
+		default:
+		}
+	}
+}
+
+func (m *ConnectionManager) connected(conn Connection) {
+	m.mu.Lock()
+	m.conn = conn
+	m.setStateLocked(StateEvent{State: StateConnected})
+	channels := make([]*managedChannel, 0, len(m.channels))
+	for mc := range m.channels {
+		channels = append(channels, mc)
+	}
+	m.mu.Unlock()
+
+	for _, mc := range channels {
+		if err := mc.restore(conn); err != nil {
+			m.logger.Warn("could not restore channel, retrying", "error", err)
+			go mc.reopen()
+		}
+	}
+
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	go m.watch(closed)
+}
+
+func (m *ConnectionManager) watch(closed chan *amqp.Error) {
+	reason, ok := <-closed
+	if !ok || reason == nil {
+		return
+	}
+
+	m.mu.Lock()
+	if m.state == StateClosed {
+		m.mu.Unlock()
+		return
+	}
+	m.conn = nil
+	m.setStateLocked(StateEvent{State: StateReconnecting, Err: reason})
+	for mc := range m.channels {
+		mc.detach()
+	}
+	m.mu.Unlock()
+
+	delay := m.initialBackoff
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-m.done:
+			return
+		case <-time.After(jitter(delay)):
+		}
+
+		conn, err := m.dial()
+		if err == nil {
+			m.mu.Lock()
+			closing := m.state == StateClosed
+			m.mu.Unlock()
+			if closing {
+				conn.Close()
+				return
+			}
+			m.connected(conn)
+			return
+		}
+
+		m.mu.Lock()
+		m.setStateLocked(StateEvent{State: StateReconnecting, Attempt: attempt, Err: err})
+		m.mu.Unlock()
+
+		delay *= 2
+		if delay > m.maxBackoff {
+			delay = m.maxBackoff
+		}
+	}
+}
+
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+func (m *ConnectionManager) Channel() (Channel, error) {
+	m.mu.Lock()
+	if m.state == StateClosed {
+		m.mu.Unlock()
+		return nil, amqp.ErrClosed
+	}
+	conn := m.conn
+	mc := &managedChannel{
+		m:          m,
+		consumers:  map[string]*managedConsumer{},
+		pending:    map[uint64]struct{}{},
+		notifyDone: make(chan struct{}),
+	}
+	m.channels[mc] = struct{}{}
+	m.mu.Unlock()
+
+	if conn == nil {
+		return mc, nil
+	}
+	if err := mc.restore(conn); err != nil {
+		m.mu.Lock()
+		delete(m.channels, mc)
+		m.mu.Unlock()
+		return nil, err
+	}
+	return mc, nil
+}
+
+func (m *ConnectionManager) Close() error {
+	m.mu.Lock()
+	if m.state == StateClosed {
+		m.mu.Unlock()
+		return amqp.ErrClosed
+	}
+	conn := m.conn
+	m.conn = nil
+	channels := m.channels
+	m.channels = map[*managedChannel]struct{}{}
+	m.setStateLocked(StateEvent{State: StateClosed})
+	for _, c := range m.listeners {
+		close(c)
+	}
+	m.listeners = nil
+	close(m.done)
+	m.mu.Unlock()
+
+	for mc := range channels {
+		mc.shutdown()
+	}
+	if conn != nil {
+		return conn.Close()
+	}
+	return nil
+}
+
+func (m *ConnectionManager) genTag() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextTag++
+	return fmt.Sprintf("ctag-managed-%d", m.nextTag)
+}
+
+func (m *ConnectionManager) currentConn() Connection {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.conn
+}
+
+type managedChannel struct {
+	m *ConnectionManager
+
+	mu        sync.Mutex
+	ch        Channel
+	gen       int
+	qos       func(Channel) error
+	ops       []func(Channel) error
+	consumers map[string]*managedConsumer
+	confirm   bool
+	seq       uint64
+	pending   map[uint64]struct{}
+	notify    []chan *amqp.Error
+	closed    bool
+
+	// notifyMu guards the listeners, which are sent to without it so that a
+	// slow listener cannot hold up Close. Closing notifyDone stops those
+	// sends; emitting counts them so the listeners are closed after them.
+	notifyMu     sync.Mutex
+	notifyClosed bool
+	notifyDone   chan struct{}
+	emitting     sync.WaitGroup
+	confirms     []chan amqp.Confirmation
+	returns      []chan amqp.Return
+}
+
+type managedConsumer struct {
+	queue     string
+	tag       string
+	autoAck   bool
+	exclusive bool
+	noLocal   bool
+	args      amqp.Table
+	out       chan amqp.Delivery
+	sources   chan (<-chan amqp.Delivery)
+	stop      chan struct{}
+
+	// streamOffset is one past the last delivery from a stream, or -1
+	streamOffset atomic.Int64
+}
+
+func (mc *managedChannel) restore(conn Connection) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if mc.closed || mc.ch != nil {
+		return nil
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	if mc.qos != nil {
+		if err := mc.qos(ch); err != nil {
+			ch.Close()
+			return err
+		}
+	}
+	for _, op := range mc.ops {
+		if err := op(ch); err != nil {
+			ch.Close()
+			return err
+		}
+	}
+	if mc.confirm {
+		if err := ch.Confirm(false); err != nil {
+			ch.Close()
+			return err
+		}
+	}
+	go mc.forward(
+		ch.NotifyPublish(make(chan amqp.Confirmation, 16)),
+		ch.NotifyReturn(make(chan amqp.Return, 16)),
+		mc.seq,
+	)
+	for _, c := range mc.consumers {
+		src, err := ch.Consume(c.queue, c.tag, c.autoAck, c.exclusive, c.noLocal, false, c.consumeArgs())
+		if err != nil {
+			ch.Close()
+			return err
+		}
+		c.setSource(src)
+	}
+
+	mc.ch = ch
+	mc.gen++
+	go mc.watch(ch.NotifyClose(make(chan *amqp.Error, 1)), mc.gen)
+	return nil
+}
+
+func (mc *managedChannel) watch(closed chan *amqp.Error, gen int) {
+	reason, ok := <-closed
+	if !ok || reason == nil {
+		return
+	}
+
+	mc.mu.Lock()
+	if mc.gen != gen || mc.closed {
+		mc.mu.Unlock()
+		return
+	}
+	mc.dropLocked()
+	mc.mu.Unlock()
+
+	conn := mc.m.currentConn()
+	if conn == nil {
+		return
+	}
+	if err := mc.restore(conn); err != nil {
+		mc.m.logger.Warn("could not reopen channel, retrying", "error", err)
+		mc.reopen()
+	}
+}
+
+// reopen keeps restoring the channel on the current connection, backing off
+// between attempts. It gives up when the connection goes away, as the
+// manager restores every channel once it has reconnected.
+func (mc *managedChannel) reopen() {
+	delay := mc.m.initialBackoff
+	for {
+		select {
+		case <-mc.m.done:
+			return
+		case <-time.After(jitter(delay)):
+		}
+		delay *= 2
+		if delay > mc.m.maxBackoff {
+			delay = mc.m.maxBackoff
+		}
+
+		conn := mc.m.currentConn()
+		if conn == nil {
+			return
+		}
+		err := mc.restore(conn)
+		if err == nil {
+			return
+		}
+		mc.m.logger.Warn("could not restore channel, retrying", "error", err, "delay", delay)
+	}
+}
+
+func (mc *managedChannel) detach() {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.dropLocked()
+}
+
+// dropLocked forgets the underlying channel. Publishings it never confirmed
+// are reported as nacked, since their confirms can no longer arrive.
+func (mc *managedChannel) dropLocked() {
+	mc.ch = nil
+	if len(mc.pending) == 0 {
+		return
+	}
+	nacks := make([]amqp.Confirmation, 0, len(mc.pending))
+	for tag := range mc.pending {
+		nacks = append(nacks, amqp.Confirmation{DeliveryTag: tag, Ack: false})
+	}
+	mc.pending = map[uint64]struct{}{}
+	go func() {
+		for _, c := range nacks {
+			mc.emitConfirm(c)
+		}
+	}()
+}
+
+// forward relays confirms and returns from one underlying channel, shifting
+// delivery tags by offset so they keep counting up across reconnects.
+func (mc *managedChannel) forward(confirms chan amqp.Confirmation, returns chan amqp.Return, offset uint64) {
+	for confirms != nil || returns != nil {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			mc.emitReturn(r)
+		case c, ok := <-confirms:
+			if !ok {
+				confirms = nil
+				continue
+			}
+			// a basic.return always precedes the confirm of the same message
+			for drained := false; !drained && returns != nil; {
+				select {
+				case r, ok := <-returns:
+					if !ok {
+						returns = nil
+						continue
+					}
+					mc.emitReturn(r)
+				default:
+					drained = true
+				}
+			}
+
+			c.DeliveryTag += offset
+			mc.mu.Lock()
+			_, pending := mc.pending[c.DeliveryTag]
+			delete(mc.pending, c.DeliveryTag)
+			mc.mu.Unlock()
+			if pending {
+				mc.emitConfirm(c)
+			}
+		}
+	}
+}
+
+func (mc *managedChannel) emitConfirm(c amqp.Confirmation) {
+	mc.notifyMu.Lock()
+	if mc.notifyClosed {
+		mc.notifyMu.Unlock()
+		return
+	}
+	listeners := append([]chan amqp.Confirmation(nil), mc.confirms...)
+	mc.emitting.Add(1)
+	mc.notifyMu.Unlock()
+	defer mc.emitting.Done()
+
+	for _, l := range listeners {
+		select {
+		case l <- c:
+		case <-mc.notifyDone:
+			return
+		}
+	}
+}
+
+func (mc *managedChannel) emitReturn(r amqp.Return) {
+	mc.notifyMu.Lock()
+	if mc.notifyClosed {
+		mc.notifyMu.Unlock()
+		return
+	}
+	listeners := append([]chan amqp.Return(nil), mc.returns...)
+	mc.emitting.Add(1)
+	mc.notifyMu.Unlock()
+	defer mc.emitting.Done()
+
+	for _, l := range listeners {
+		select {
+		case l <- r:
+		case <-mc.notifyDone:
+			return
+		}
+	}
+}
+
+func (mc *managedChannel) current() (Channel, error) {
+	if mc.closed {
+		return nil, amqp.ErrClosed
+	}
+	if mc.ch == nil {
+		return nil, ErrNotConnected
+	}
+	return mc.ch, nil
+}
+
+func (mc *managedChannel) live() (Channel, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.current()
+}
+
+func (mc *managedChannel) record(op func(Channel) error) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	ch, err := mc.current()
+	if err != nil {
+		return err
+	}
+	if err := op(ch); err != nil {
+		return err
+	}
+	mc.ops = append(mc.ops, op)
+	return nil
+}
+
+func (mc *managedChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	mc.mu.Lock()
+	ch, err := mc.current()
+	if err != nil {
+		mc.mu.Unlock()
+		return err
+	}
+	if !mc.confirm {
+		mc.mu.Unlock()
+		return ch.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+	}
+
+	defer mc.mu.Unlock()
+	if err := ch.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg); err != nil {
+		return err
+	}
+	mc.seq++
+	mc.pending[mc.seq] = struct{}{}
+	return nil
+}
+
+func (mc *managedChannel) Confirm(noWait bool) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	ch, err := mc.current()
+	if err != nil {
+		return err
+	}
+	if mc.confirm {
+		return nil
+	}
+	if err := ch.Confirm(noWait); err != nil {
+		return err
+	}
+	mc.confirm = true
+	return nil
+}
+
+func (mc *managedChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	mc.notifyMu.Lock()
+	defer mc.notifyMu.Unlock()
+	if mc.notifyClosed {
+		close(confirm)
+		return confirm
+	}
+	mc.confirms = append(mc.confirms, confirm)
+	return confirm
+}
+
+func (mc *managedChannel) NotifyReturn(c chan amqp.Return) chan amqp.Return {
+	mc.notifyMu.Lock()
+	defer mc.notifyMu.Unlock()
+	if mc.notifyClosed {
+		close(c)
+		return c
+	}
+	mc.returns = append(mc.returns, c)
+	return c
+}
+
+func (mc *managedChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	ch, err := mc.current()
+	if err != nil {
+		return err
+	}
+	qos := func(ch Channel) error {
+		return ch.Qos(prefetchCount, prefetchSize, global)
+	}
+	if err := qos(ch); err != nil {
+		return err
+	}
+	mc.qos = qos
+	return nil
+}
+
+func (mc *managedChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	return mc.record(func(ch Channel) error {
+		return ch.ExchangeDeclare(name, kind, durable, autoDelete, internal, noWait, args)
+	})
+}
+
+func (mc *managedChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	var queue amqp.Queue
+	err := mc.record(func(ch Channel) error {
+		q, err := ch.QueueDeclare(name, durable, autoDelete, exclusive, noWait, args)
+		queue = q
+		return err
+	})
+	return queue, err
+}
+
+func (mc *managedChannel) ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	ch, err := mc.live()
+	if err != nil {
+		return err
+	}
+	return ch.ExchangeDeclarePassive(name, kind, durable, autoDelete, internal, noWait, args)
+}
+
+func (mc *managedChannel) QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	ch, err := mc.live()
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+	return ch.QueueDeclarePassive(name, durable, autoDelete, exclusive, noWait, args)
+}
+
+func (mc *managedChannel) QueuePurge(name string, noWait bool) (int, error) {
+	ch, err := mc.live()
+	if err != nil {
+		return 0, err
+	}
+	return ch.QueuePurge(name, noWait)
+}
+
+func (mc *managedChannel) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	ch, err := mc.live()
+	if err != nil {
+		return amqp.Delivery{}, false, err
+	}
+	return ch.Get(queue, autoAck)
+}
+
+func (mc *managedChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	return mc.record(func(ch Channel) error {
+		return ch.QueueBind(name, key, exchange, noWait, args)
+	})
+}
+
+func (mc *managedChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	if consumer == "" {
+		consumer = mc.m.genTag()
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	ch, err := mc.current()
+	if err != nil {
+		return nil, err
+	}
+	src, err := ch.Consume(queue, consumer, autoAck, exclusive, noLocal, noWait, args)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &managedConsumer{
+		queue:     queue,
+		tag:       consumer,
+		autoAck:   autoAck,
+		exclusive: exclusive,
+		noLocal:   noLocal,
+		args:      args,
+		out:       make(chan amqp.Delivery),
+		sources:   make(chan (<-chan amqp.Delivery), 1),
+		stop:      make(chan struct{}),
+	}
+	c.streamOffset.Store(-1)
+	c.setSource(src)
+	mc.consumers[consumer] = c
+	go c.run()
+	return c.out, nil
+}
+
+func (mc *managedChannel) Cancel(consumer string, noWait bool) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	c, ok := mc.consumers[consumer]
+	if !ok {
+		return nil
+	}
+	delete(mc.consumers, consumer)
+	close(c.stop)
+	if mc.ch == nil {
+		return nil
+	}
+	return mc.ch.Cancel(consumer, noWait)
+}
+
+func (mc *managedChannel) NotifyClose(c chan *amqp.Error) chan *amqp.Error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if mc.closed {
+		close(c)
+		return c
+	}
+	mc.notify = append(mc.notify, c)
+	return c
+}
+
+func (mc *managedChannel) Close() error {
+	mc.m.mu.Lock()
+	delete(mc.m.channels, mc)
+	mc.m.mu.Unlock()
+	return mc.shutdown()
+}
+
+func (mc *managedChannel) shutdown() error {
+	mc.mu.Lock()
+	if mc.closed {
+		mc.mu.Unlock()
+		return amqp.ErrClosed
+	}
+	mc.closed = true
+	for tag, c := range mc.consumers {
+		delete(mc.consumers, tag)
+		close(c.stop)
+	}
+	for _, c := range mc.notify {
+		close(c)
+	}
+	mc.notify = nil
+	ch := mc.ch
+	mc.ch = nil
+	mc.mu.Unlock()
+
+	mc.notifyMu.Lock()
+	mc.notifyClosed = true
+	confirms, returns := mc.confirms, mc.returns
+	mc.confirms, mc.returns = nil, nil
+	mc.notifyMu.Unlock()
+
+	close(mc.notifyDone)
+	mc.emitting.Wait()
+	for _, c := range confirms {
+		close(c)
+	}
+	for _, c := range returns {
+		close(c)
+	}
+
+	if ch == nil {
+		return nil
+	}
+	return ch.Close()
+}
+
+// consumeArgs resumes a stream consumer after the last message it received
+// rather than at the offset it was started with.
+func (c *managedConsumer) consumeArgs() amqp.Table {
+	next := c.streamOffset.Load()
+	if next < 0 {
+		return c.args
+	}
+	args := amqp.Table{}
+	for k, v := range c.args {
+		args[k] = v
+	}
+	args[streamOffsetArg] = next
+	return args
+}
+
+func (c *managedConsumer) setSource(src <-chan amqp.Delivery) {
+	select {
+	case <-c.sources:
+	default:
+	}
+	c.sources <- src
+}
+
+func (c *managedConsumer) run() {
+	defer close(c.out)
+	var src <-chan amqp.Delivery
+	for {
+		select {
+		case <-c.stop:
+			return
+		case s := <-c.sources:
+			src = s
+		case d, ok := <-src:
+			if !ok {
+				src = nil
+				continue
+			}
+			if offset, ok := tableInt(d.Headers[streamOffsetArg]); ok {
+				c.streamOffset.Store(offset + 1)
+			}
+			select {
+			case c.out <- d:
+			case <-c.stop:
+				return
+			}
+		}
+	}
+}
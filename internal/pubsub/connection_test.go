@@ -0,0 +1,186 @@
+package pubsub
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func expectState(t *testing.T, states chan StateEvent, want ConnectionState) StateEvent {
+	t.Helper()
+	for {
+		select {
+		case ev := <-states:
+			if ev.State == want {
+				return ev
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("manager never got %v", want)
+		}
+	}
+}
+
+func TestConnectionManagerReplaysAfterReconnect(t *testing.T) {
+	b := NewMemoryBroker()
+	m, err := NewConnectionManager(b.Dial, WithBackoff(time.Millisecond, 10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	states := m.NotifyState(make(chan StateEvent, 10))
+
+	ch, err := m.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	declareExchange(t, ch, "peril_topic", amqp.ExchangeTopic)
+	// a transient queue is gone after the restart and has to be declared
+	// and bound again
+	if _, err := ch.QueueDeclare("moves", false, true, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	bindQueue(t, ch, "moves", "army_moves.*", "peril_topic")
+	if err := ch.Qos(1, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := ch.Consume("moves", "", false, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.Confirm(false); err != nil {
+		t.Fatal(err)
+	}
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 10))
+
+	publish(t, ch, "peril_topic", "army_moves.alice", amqp.Publishing{Body: []byte("before")})
+	receive(t, msgs).Ack(false)
+	if c := <-confirms; c.DeliveryTag != 1 || !c.Ack {
+		t.Errorf("got confirmation %+v before the restart", c)
+	}
+
+	b.Restart()
+	if ev := expectState(t, states, StateReconnecting); ev.Err == nil {
+		t.Error("reconnecting without the reason the connection was lost")
+	}
+	expectState(t, states, StateConnected)
+
+	publish(t, ch, "peril_topic", "army_moves.alice", amqp.Publishing{Body: []byte("after")})
+	d := receive(t, msgs)
+	if string(d.Body) != "after" {
+		t.Errorf("got %q after the restart", d.Body)
+	}
+	d.Ack(false)
+	if c := <-confirms; c.DeliveryTag != 2 || !c.Ack {
+		t.Errorf("got confirmation %+v after the restart, want tag 2 acked", c)
+	}
+}
+
+func TestConnectionManagerRetriesRestore(t *testing.T) {
+	b := NewMemoryBroker()
+	var logs syncBuffer
+	m, err := NewConnectionManager(b.Dial,
+		WithBackoff(50*time.Millisecond, 50*time.Millisecond),
+		WithConnectionLogger(slog.New(slog.NewTextHandler(&logs, nil))),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	states := m.NotifyState(make(chan StateEvent, 10))
+
+	ch, err := m.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ch.QueueDeclare("moves", false, true, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := ch.Consume("moves", "", true, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.Restart()
+	// another connection takes the queue name before the manager is back,
+	// so replaying the declaration fails
+	other := b.Connect()
+	otherCh, err := other.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := otherCh.QueueDeclare("moves", false, false, true, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	expectState(t, states, StateConnected)
+
+	deadline := time.Now().Add(time.Second)
+	for !strings.Contains(logs.String(), "could not restore channel") {
+		if time.Now().After(deadline) {
+			t.Fatal("the failed restore was not logged")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	other.Close()
+	deadline = time.Now().Add(time.Second)
+	for {
+		// the channel is only back once the manager has retried
+		if _, err := ch.QueueDeclarePassive("moves", false, true, false, false, nil); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the channel was not restored")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := PublishJSON(memChannelFor(t, b), "", "moves", "after"); err != nil {
+		t.Fatal(err)
+	}
+	if d := receive(t, msgs); !strings.Contains(string(d.Body), "after") {
+		t.Errorf("got %q after the restore", d.Body)
+	}
+}
+
+func TestManagedChannelCloseWithUnreadListeners(t *testing.T) {
+	b := NewMemoryBroker()
+	m, err := NewConnectionManager(b.Dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	ch, err := m.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.Confirm(false); err != nil {
+		t.Fatal(err)
+	}
+	// nobody reads these
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation))
+	returns := ch.NotifyReturn(make(chan amqp.Return))
+
+	err = ch.PublishWithContext(context.Background(), "", "nobody", true, false, amqp.Publishing{Body: []byte("x")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	closed := make(chan error, 1)
+	go func() { closed <- ch.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked on a listener nobody reads")
+	}
+	for range confirms {
+	}
+	for range returns {
+	}
+}
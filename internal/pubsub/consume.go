@@ -1,10 +1,10 @@
 package pubsub
 
 import (
-	"bytes"
-	"encoding/gob"
-	"encoding/json"
+	"context"
 	"fmt"
+	"log/slog"
+	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
@@ -15,6 +15,13 @@ type AckType int
 const (
 	DurableSimpleQueue SimpleQueueType = iota
 	TransientSimpleQueue
+	// QuorumQueue is a durable queue replicated across the cluster nodes.
+	// It counts redeliveries, which WithDeliveryLimit can bound.
+	QuorumQueue
+	// StreamQueue is a durable append-only log. Consumers read it from an
+	// offset chosen with WithStreamOffset and remove nothing; acks and nacks
+	// only return prefetch credit, so nothing is ever redelivered.
+	StreamQueue
 )
 
 const (
@@ -23,126 +30,391 @@ const (
 	NackDiscard
 )
 
+func (a AckType) String() string {
+	switch a {
+	case Ack:
+		return "ack"
+	case NackRequeue:
+		return "nack_requeue"
+	case NackDiscard:
+		return "nack_discard"
+	default:
+		return fmt.Sprintf("AckType(%d)", int(a))
+	}
+}
+
+// Envelope carries the message properties that travel alongside a body.
+// Exchange and RoutingKey are the ones the message was first published with,
+// even when it reaches the handler again through a retry queue.
+type Envelope struct {
+	MessageID     string
+	CorrelationID string
+	Timestamp     time.Time
+	AppID         string
+	UserID        string
+	ContentType   string
+	Exchange      string
+	RoutingKey    string
+	ReplyTo       string
+	Redelivered   bool
+	Headers       amqp.Table
+}
+
+// Cause returns the ID follow-up messages should be correlated with: the
+// correlation ID the message already carries, or its own ID if it started
+// the chain.
+func (e Envelope) Cause() string {
+	if e.CorrelationID != "" {
+		return e.CorrelationID
+	}
+	return e.MessageID
+}
+
+type Delivery[T any] struct {
+	Envelope
+	Body T
+	// Attempt counts deliveries of this message through a retry policy or
+	// by a quorum queue, starting at 1.
+	Attempt int
+
+	ctx context.Context
+}
+
+// Context is done when the subscription is shutting down or, under the
+// Timeout middleware, when the handler has run out of time. Handlers that
+// block, e.g. to publish, should give up once it is done.
+func (d Delivery[T]) Context() context.Context {
+	if d.ctx == nil {
+		return context.Background()
+	}
+	return d.ctx
+}
+
+// WithContext returns a copy of d whose Context is ctx.
+func (d Delivery[T]) WithContext(ctx context.Context) Delivery[T] {
+	d.ctx = ctx
+	return d
+}
+
+func envelopeOf(msg amqp.Delivery) Envelope {
+	env := Envelope{
+		MessageID:     msg.MessageId,
+		CorrelationID: msg.CorrelationId,
+		Timestamp:     msg.Timestamp,
+		AppID:         msg.AppId,
+		UserID:        msg.UserId,
+		ContentType:   msg.ContentType,
+		Exchange:      msg.Exchange,
+		RoutingKey:    msg.RoutingKey,
+		ReplyTo:       msg.ReplyTo,
+		Redelivered:   msg.Redelivered,
+		Headers:       msg.Headers,
+	}
+	if exchange, ok := msg.Headers[originalExchangeHeader].(string); ok {
+		env.Exchange = exchange
+	}
+	if key, ok := msg.Headers[originalRoutingKeyHeader].(string); ok {
+		env.RoutingKey = key
+	}
+	return env
+}
+
+type Handler[T any] func(Delivery[T]) AckType
+
 func subscribe[T any](
-	conn *amqp.Connection,
+	ctx context.Context,
+	broker Broker,
 	exchange,
 	queueName,
 	key string,
 	simpleQueueType SimpleQueueType,
-	handler func(T) AckType,
-	unmarshaller func([]byte) (T, error),
-) error {
-	rabbitCh, queue, err := DeclareAndBind(conn, exchange, queueName, key, simpleQueueType)
+	handler Handler[T],
+	opts subscribeOptions,
+) (*Subscription, error) {
+	err := opts.checkQueueType(simpleQueueType)
+	if err != nil {
+		return nil, err
+	}
+
+	args := simpleQueueType.args()
+	if opts.deliveryLimit > 0 {
+		args["x-delivery-limit"] = int64(opts.deliveryLimit)
+	}
+	rabbitCh, queue, err := declareAndBind(broker, exchange, queueName, key, simpleQueueType, args)
 	if err != nil {
-		return fmt.Errorf("could not declare and bind queue: %v", err)
+		return nil, fmt.Errorf("could not declare and bind queue: %v", err)
+	}
+
+	if opts.decodeFailure == DecodeQuarantine {
+		err = declareQuarantineQueue(rabbitCh)
+		if err != nil {
+			rabbitCh.Close()
+			return nil, err
+		}
+	}
+
+	if opts.retry != nil {
+		err = declareRetryQueues(rabbitCh, queue.Name, simpleQueueType, *opts.retry)
+		if err != nil {
+			rabbitCh.Close()
+			return nil, err
+		}
 	}
 
 	err = rabbitCh.Qos(
-		10,    // prefetch count
-		0,     // prefetch size
-		false, // global
+		opts.prefetchCount, // prefetch count
+		opts.prefetchSize,  // prefetch size
+		false,              // global
 	)
 	if err != nil {
-		return fmt.Errorf("could not set QoS: %v", err)
+		rabbitCh.Close()
+		return nil, fmt.Errorf("could not set QoS: %v", err)
 	}
 
+	var consumeArgs amqp.Table
+	if opts.streamOffset != nil {
+		consumeArgs = amqp.Table{streamOffsetArg: opts.streamOffset.value}
+	}
+
+	consumerTag := newConsumerTag()
 	msgs, err := rabbitCh.Consume(
-		queue.Name, // queue
-		"",         // consumer
-		false,      // auto-ack
-		false,      // exclusive
-		false,      // no-local
-		false,      // no-wait
-		nil,        // args
+		queue.Name,   // queue
+		consumerTag,  // consumer
+		opts.autoAck, // auto-ack
+		false,        // exclusive
+		false,        // no-local
+		false,        // no-wait
+		consumeArgs,  // args
 	)
 	if err != nil {
-		return fmt.Errorf("could not consume messages: %v", err)
-	}
-
-	go func() {
-		defer rabbitCh.Close()
-		for msg := range msgs {
-			target, err := unmarshaller(msg.Body)
-			if err != nil {
-				fmt.Printf("could not unmarshal message: %v\n", err)
-				continue
-			}
-			switch handler(target) {
-			case Ack:
-				msg.Ack(false)
-				fmt.Println("Ack")
-			case NackDiscard:
-				msg.Nack(false, false)
-				fmt.Println("NackDiscard")
-			case NackRequeue:
-				msg.Nack(false, true)
-				fmt.Println("NackRequeue")
-			}
+		rabbitCh.Close()
+		return nil, fmt.Errorf("could not consume messages: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	sub := &Subscription{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	c := &consumer[T]{
+		ch:          rabbitCh,
+		queueName:   queue.Name,
+		consumerTag: consumerTag,
+		handler:     handler,
+		opts:        opts,
+		sub:         sub,
+	}
+	go c.run(ctx, msgs)
+	return sub, nil
+}
+
+type SubscribeOption func(*subscribeOptions)
+
+type subscribeOptions struct {
+	defaultCodec  Codec
+	retry         *RetryPolicy
+	concurrency   int
+	prefetchCount int
+	prefetchSize  int
+	orderingKey   func(amqp.Delivery) string
+	deliveryLimit int
+	streamOffset  *StreamOffset
+	autoAck       bool
+	logger        *slog.Logger
+
+	decodeFailure   DecodeFailurePolicy
+	onDecodeFailure func(amqp.Delivery, error)
+}
+
+func defaultSubscribeOptions() subscribeOptions {
+	return subscribeOptions{
+		concurrency:   1,
+		prefetchCount: 10,
+		logger:        slog.Default(),
+	}
+}
+
+// WithDefaultCodec sets the codec used for messages that carry no content
+// type, or one no codec is registered for.
+func WithDefaultCodec(c Codec) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.defaultCodec = c
+	}
+}
+
+// WithConcurrency runs the handler on up to workers deliveries at once.
+func WithConcurrency(workers int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		if workers > 0 {
+			o.concurrency = workers
+		}
+	}
+}
+
+// WithPrefetch sets how many unacknowledged messages, and how many bytes of
+// them, the broker hands the consumer ahead of time. RabbitMQ only
+// implements a size of 0.
+func WithPrefetch(count, size int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.prefetchCount = count
+		o.prefetchSize = size
+	}
+}
+
+// WithOrderingKey keeps deliveries that share a key in order by always
+// handing them to the same worker. Deliveries with different keys are still
+// handled in parallel.
+func WithOrderingKey(key func(amqp.Delivery) string) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.orderingKey = key
+	}
+}
+
+// WithAutoAck has the broker forget each message as soon as it is sent,
+// which is faster but loses the messages in flight when the subscriber goes
+// away: AMQP auto-ack, or QoS 0 over MQTT. The handler's AckType is only
+// counted, though NackRequeue still schedules a retry.
+func WithAutoAck() SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.autoAck = true
+	}
+}
+
+// WithLogger sets where the subscription reports how it settled each
+// delivery, at debug level, and the failures to settle one. It defaults to
+// slog.Default().
+func WithLogger(logger *slog.Logger) SubscribeOption {
+	return func(o *subscribeOptions) {
+		if logger != nil {
+			o.logger = logger
 		}
-	}()
-	return nil
+	}
+}
+
+func OrderByRoutingKey(msg amqp.Delivery) string {
+	return msg.RoutingKey
+}
+
+// Subscribe consumes messages of type T, decoding each one with the codec
+// registered for its content type.
+func Subscribe[T any](
+	ctx context.Context,
+	broker Broker,
+	exchange,
+	queueName,
+	key string,
+	simpleQueueType SimpleQueueType,
+	handler Handler[T],
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	options := defaultSubscribeOptions()
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return subscribe(ctx, broker, exchange, queueName, key, simpleQueueType, handler, options)
+}
+
+func bodyHandler[T any](handler func(T) AckType) Handler[T] {
+	return func(d Delivery[T]) AckType {
+		return handler(d.Body)
+	}
+}
+
+func decode[T any](msg amqp.Delivery, defaultCodec Codec) (T, error) {
+	var target T
+	codec, ok := CodecFor(msg.ContentType)
+	if !ok {
+		codec = defaultCodec
+	}
+	if codec == nil {
+		return target, &UnsupportedContentTypeError{ContentType: msg.ContentType}
+	}
+	err := codec.Unmarshal(msg.Body, &target)
+	return target, err
 }
 
 func SubscribeJSON[T any](
-	conn *amqp.Connection,
+	broker Broker,
 	exchange,
 	queueName,
 	key string,
 	simpleQueueType SimpleQueueType,
 	handler func(T) AckType,
 ) error {
-	unmarshaller := func(data []byte) (T, error) {
-		var target T
-		err := json.Unmarshal(data, &target)
-		return target, err
-	}
+	_, err := SubscribeJSONWithContext(context.Background(), broker, exchange, queueName, key, simpleQueueType, handler)
+	return err
+}
 
-	return subscribe(conn, exchange, queueName, key, simpleQueueType, handler, unmarshaller)
+func SubscribeJSONWithContext[T any](
+	ctx context.Context,
+	broker Broker,
+	exchange,
+	queueName,
+	key string,
+	simpleQueueType SimpleQueueType,
+	handler func(T) AckType,
+) (*Subscription, error) {
+	return Subscribe(ctx, broker, exchange, queueName, key, simpleQueueType, bodyHandler(handler), WithDefaultCodec(JSONCodec))
 }
 
 func SubscribeGob[T any](
-	conn *amqp.Connection,
+	broker Broker,
 	exchange,
 	queueName,
 	key string,
 	simpleQueueType SimpleQueueType,
 	handler func(T) AckType,
 ) error {
-	unmarshaller := func(data []byte) (T, error) {
-		var target T
-		decoder := gob.NewDecoder(bytes.NewReader(data))
-		err := decoder.Decode(&target)
-		return target, err
-	}
+	_, err := SubscribeGobWithContext(context.Background(), broker, exchange, queueName, key, simpleQueueType, handler)
+	return err
+}
 
-	return subscribe(conn, exchange, queueName, key, simpleQueueType, handler, unmarshaller)
+func SubscribeGobWithContext[T any](
+	ctx context.Context,
+	broker Broker,
+	exchange,
+	queueName,
+	key string,
+	simpleQueueType SimpleQueueType,
+	handler func(T) AckType,
+) (*Subscription, error) {
+	return Subscribe(ctx, broker, exchange, queueName, key, simpleQueueType, bodyHandler(handler), WithDefaultCodec(GobCodec))
 }
 
 func DeclareAndBind(
-	conn *amqp.Connection,
+	broker Broker,
 	exchange,
 	queueName,
 	key string,
 	simpleQueueType SimpleQueueType,
-) (*amqp.Channel, amqp.Queue, error) {
-	rabbitCh, err := conn.Channel()
+) (Channel, amqp.Queue, error) {
+	return declareAndBind(broker, exchange, queueName, key, simpleQueueType, simpleQueueType.args())
+}
+
+func declareAndBind(
+	broker Broker,
+	exchange,
+	queueName,
+	key string,
+	simpleQueueType SimpleQueueType,
+	args amqp.Table,
+) (Channel, amqp.Queue, error) {
+	rabbitCh, err := broker.Channel()
 	if err != nil {
 		return nil, amqp.Queue{}, fmt.Errorf("could not create channel: %v", err)
 	}
 
-	args := amqp.Table{
-		"x-dead-letter-exchange": "peril_dlx",
-	}
-
 	queue, err := rabbitCh.QueueDeclare(
-		queueName,                             // name
-		simpleQueueType == DurableSimpleQueue, // durable
-		simpleQueueType != DurableSimpleQueue, // delete when unused
-		simpleQueueType != DurableSimpleQueue, // exclusive
-		false,                                 // no-wait
-		args,                                  // args
+		queueName,                               // name
+		simpleQueueType.durable(),               // durable
+		simpleQueueType == TransientSimpleQueue, // delete when unused
+		simpleQueueType == TransientSimpleQueue, // exclusive
+		false,                                   // no-wait
+		args,                                    // args
 	)
 	if err != nil {
+		rabbitCh.Close()
 		return nil, amqp.Queue{}, fmt.Errorf("could not declare queue: %v", err)
 	}
 
@@ -154,6 +426,7 @@ func DeclareAndBind(
 		nil,        // args
 	)
 	if err != nil {
+		rabbitCh.Close()
 		return nil, amqp.Queue{}, fmt.Errorf("could not bind queue: %v", err)
 	}
 	return rabbitCh, queue, nil
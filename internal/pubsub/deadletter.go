@@ -0,0 +1,100 @@
+package pubsub
+
+import (
+	"time"
+
+	"github.com/albsko/learn-pub-sub/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// DeclareDeadLetterTopology declares the dead-letter exchange every queue
+// from DeclareAndBind points at, plus one durable dead-letter queue per
+// routing.DeadLetterSources entry.
+func DeclareDeadLetterTopology(broker Broker) error {
+	return DeclareTopology(broker, routing.DeadLetterTopology())
+}
+
+// Death is one entry of the x-death header RabbitMQ adds when it
+// dead-letters a message.
+type Death struct {
+	Queue       string
+	Reason      string
+	Exchange    string
+	RoutingKeys []string
+	Count       int64
+	Time        time.Time
+}
+
+// Deaths decodes the x-death header, most recent death first.
+func Deaths(headers amqp.Table) []Death {
+	raw, _ := headers["x-death"].([]interface{})
+	deaths := make([]Death, 0, len(raw))
+	for _, entry := range raw {
+		table, ok := entry.(amqp.Table)
+		if !ok {
+			continue
+		}
+		death := Death{}
+		death.Queue, _ = table["queue"].(string)
+		death.Reason, _ = table["reason"].(string)
+		death.Exchange, _ = table["exchange"].(string)
+		death.Count, _ = table["count"].(int64)
+		death.Time, _ = table["time"].(time.Time)
+		keys, _ := table["routing-keys"].([]interface{})
+		for _, key := range keys {
+			if s, ok := key.(string); ok {
+				death.RoutingKeys = append(death.RoutingKeys, s)
+			}
+		}
+		deaths = append(deaths, death)
+	}
+	return deaths
+}
+
+// Origin returns where a dead-lettered message was first published. A
+// message that went through retry queues died on its way back from one, so
+// its x-death names the default exchange and the source queue; the
+// x-original-* headers the retry added say where it really came from.
+func Origin(msg amqp.Delivery) (exchange, key string, ok bool) {
+	exchange, hasExchange := msg.Headers[originalExchangeHeader].(string)
+	key, hasKey := msg.Headers[originalRoutingKeyHeader].(string)
+	if hasExchange && hasKey {
+		return exchange, key, true
+	}
+	deaths := Deaths(msg.Headers)
+	if len(deaths) == 0 || len(deaths[0].RoutingKeys) == 0 {
+		return "", "", false
+	}
+	return deaths[0].Exchange, deaths[0].RoutingKeys[0], true
+}
+
+// replayDroppedHeaders are the broker's and the retry policy's bookkeeping
+// of a message's earlier life. A replayed message starts over without them,
+// otherwise it would count as already out of attempts.
+var replayDroppedHeaders = []string{
+	"x-death",
+	"x-first-death-queue",
+	"x-first-death-reason",
+	"x-first-death-exchange",
+	"x-last-death-queue",
+	"x-last-death-reason",
+	"x-last-death-exchange",
+	retryCountHeader,
+	deliveryCountHeader,
+	originalExchangeHeader,
+	originalRoutingKeyHeader,
+}
+
+// Replaying is Republishing for a dead-lettered message that is sent back
+// to its Origin.
+func Replaying(msg amqp.Delivery) amqp.Publishing {
+	replay := Republishing(msg)
+	replay.Headers = amqp.Table{}
+	for k, v := range msg.Headers {
+		replay.Headers[k] = v
+	}
+	for _, k := range replayDroppedHeaders {
+		delete(replay.Headers, k)
+	}
+	return replay
+}
@@ -0,0 +1,82 @@
+package pubsub
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/albsko/learn-pub-sub/internal/routing"
+)
+
+func TestReplayAfterRetries(t *testing.T) {
+	b := NewMemoryBroker()
+	if err := DeclareTopology(b.Connect(), routing.PerilTopology()); err != nil {
+		t.Fatal(err)
+	}
+
+	attempts := make(chan int, 10)
+	var succeed atomic.Bool
+	sub, err := Subscribe(context.Background(), b.Connect(), routing.ExchangePerilTopic, routing.WarRecognitionsPrefix,
+		routing.WarRecognitionsPrefix+".*", DurableSimpleQueue,
+		func(d Delivery[string]) AckType {
+			attempts <- d.Attempt
+			if succeed.Load() {
+				return Ack
+			}
+			return NackRequeue
+		},
+		WithDefaultCodec(JSONCodec),
+		WithConcurrency(1),
+		WithRetry(RetryPolicy{MaxAttempts: 2, InitialDelay: 10 * time.Millisecond}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	ch := memChannelFor(t, b)
+	if err := PublishJSON(ch, routing.ExchangePerilTopic, "war.alice", "war"); err != nil {
+		t.Fatal(err)
+	}
+	for want := 1; want <= 2; want++ {
+		select {
+		case got := <-attempts:
+			if got != want {
+				t.Fatalf("got attempt %d, want %d", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("attempt %d never came", want)
+		}
+	}
+
+	dlq := routing.DeadLetterQueue(routing.WarRecognitionsPrefix)
+	dead := getEventually(t, ch, dlq)
+	if deaths := Deaths(dead.Headers); len(deaths) == 0 || deaths[0].Exchange != "" {
+		t.Fatalf("expected the last death to be on the way back from a retry queue, got %+v", deaths)
+	}
+
+	exchange, key, ok := Origin(dead)
+	if !ok || exchange != routing.ExchangePerilTopic || key != "war.alice" {
+		t.Errorf("origin is %q/%q, want %s/war.alice", exchange, key, routing.ExchangePerilTopic)
+	}
+	replay := Replaying(dead)
+	for _, h := range []string{"x-death", retryCountHeader, originalExchangeHeader, originalRoutingKeyHeader} {
+		if _, ok := replay.Headers[h]; ok {
+			t.Errorf("replay still carries %s", h)
+		}
+	}
+
+	succeed.Store(true)
+	if err := ch.PublishWithContext(context.Background(), exchange, key, false, false, replay); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-attempts:
+		if got != 1 {
+			t.Errorf("replayed message arrived as attempt %d, want a fresh start", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("replayed message never reached the subscriber")
+	}
+}
@@ -0,0 +1,218 @@
+package pubsub
+
+import (
+	"container/list"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// DedupStore remembers the IDs of messages that have been handled.
+type DedupStore interface {
+	Seen(ctx context.Context, id string) (bool, error)
+	Mark(ctx context.Context, id string) error
+}
+
+// Idempotent skips deliveries whose message ID the store has already seen
+// and marks a message once the handler acks it. Messages that were nacked
+// stay unmarked, so a retry still reaches the handler. Messages without an
+// ID cannot be recognised and are always handled.
+//
+// A duplicate that arrives while the first copy is still being handled is
+// requeued rather than handled in parallel. Store failures are logged to
+// logger.
+func Idempotent[T any](logger *slog.Logger, store DedupStore) Middleware[T] {
+	var mu sync.Mutex
+	inFlight := map[string]struct{}{}
+
+	return func(next Handler[T]) Handler[T] {
+		return func(d Delivery[T]) AckType {
+			id := d.MessageID
+			if id == "" {
+				return next(d)
+			}
+
+			mu.Lock()
+			if _, ok := inFlight[id]; ok {
+				mu.Unlock()
+				return NackRequeue
+			}
+			inFlight[id] = struct{}{}
+			mu.Unlock()
+			defer func() {
+				mu.Lock()
+				delete(inFlight, id)
+				mu.Unlock()
+			}()
+
+			seen, err := store.Seen(d.Context(), id)
+			if err != nil {
+				logger.Error("could not look up message", "message_id", id, "error", err)
+				return NackRequeue
+			}
+			if seen {
+				return Ack
+			}
+
+			ack := next(d)
+			if ack == Ack {
+				err = store.Mark(d.Context(), id)
+				if err != nil {
+					// the effect has happened, the worst case is doing it again
+					logger.Warn("could not mark message as handled", "message_id", id, "error", err)
+				}
+			}
+			return ack
+		}
+	}
+}
+
+// MemoryDedupStore keeps the most recently marked IDs in memory. IDs are
+// forgotten after ttl or once capacity newer IDs have been marked.
+type MemoryDedupStore struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+type dedupEntry struct {
+	id      string
+	expires time.Time
+}
+
+func NewMemoryDedupStore(capacity int, ttl time.Duration) *MemoryDedupStore {
+	return &MemoryDedupStore{
+		capacity: capacity,
+		ttl:      ttl,
+		order:    list.New(),
+		entries:  map[string]*list.Element{},
+	}
+}
+
+func (s *MemoryDedupStore) Seen(ctx context.Context, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.entries[id]
+	if !ok {
+		return false, nil
+	}
+	if time.Now().After(el.Value.(dedupEntry).expires) {
+		s.order.Remove(el)
+		delete(s.entries, id)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (s *MemoryDedupStore) Mark(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry := dedupEntry{id: id, expires: time.Now().Add(s.ttl)}
+	if el, ok := s.entries[id]; ok {
+		el.Value = entry
+		s.order.MoveToFront(el)
+		return nil
+	}
+	s.entries[id] = s.order.PushFront(entry)
+	for s.capacity > 0 && s.order.Len() > s.capacity {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(dedupEntry).id)
+	}
+	return nil
+}
+
+var dedupBucket = []byte("dedup")
+
+// BoltDedupStore keeps marked IDs in a bbolt file so they survive restarts.
+// Expired IDs are ignored by Seen and removed by Prune.
+type BoltDedupStore struct {
+	db  *bolt.DB
+	ttl time.Duration
+}
+
+// NewBoltDedupStore opens or creates the store at path and prunes it.
+func NewBoltDedupStore(path string, ttl time.Duration) (*BoltDedupStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("could not open dedup store: %v", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(dedupBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not create dedup bucket: %v", err)
+	}
+
+	s := &BoltDedupStore{db: db, ttl: ttl}
+	if _, err := s.Prune(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *BoltDedupStore) Seen(ctx context.Context, id string) (bool, error) {
+	var seen bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(dedupBucket).Get([]byte(id))
+		seen = v != nil && !expired(v)
+		return nil
+	})
+	return seen, err
+}
+
+func (s *BoltDedupStore) Mark(ctx context.Context, id string) error {
+	var expires [8]byte
+	binary.BigEndian.PutUint64(expires[:], uint64(time.Now().Add(s.ttl).UnixNano()))
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(dedupBucket).Put([]byte(id), expires[:])
+	})
+}
+
+// Prune deletes expired IDs and reports how many were removed.
+func (s *BoltDedupStore) Prune() (int, error) {
+	var removed int
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(dedupBucket)
+		// deleting at the cursor makes Next skip the following key
+		var stale [][]byte
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if expired(v) {
+				stale = append(stale, append([]byte{}, k...))
+			}
+		}
+		for _, k := range stale {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	if err != nil {
+		return removed, fmt.Errorf("could not prune dedup store: %v", err)
+	}
+	return removed, nil
+}
+
+func (s *BoltDedupStore) Close() error {
+	return s.db.Close()
+}
+
+func expired(v []byte) bool {
+	if len(v) != 8 {
+		return true
+	}
+	return time.Now().UnixNano() > int64(binary.BigEndian.Uint64(v))
+}
@@ -0,0 +1,127 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type failingDedupStore struct{}
+
+func (failingDedupStore) Seen(context.Context, string) (bool, error) {
+	return false, errors.New("disk on fire")
+}
+
+func (failingDedupStore) Mark(context.Context, string) error {
+	return errors.New("disk on fire")
+}
+
+func TestIdempotent(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	calls := map[string]int{}
+	results := map[string]AckType{"ok": Ack, "failing": NackRequeue}
+	h := Chain(func(d Delivery[string]) AckType {
+		calls[d.MessageID]++
+		return results[d.MessageID]
+	}, Idempotent[string](logger, NewMemoryDedupStore(10, time.Hour)))
+
+	for i := 0; i < 3; i++ {
+		if ack := h(Delivery[string]{Envelope: Envelope{MessageID: "ok"}}); ack != Ack {
+			t.Errorf("copy %d of an acked message: got %v", i+1, ack)
+		}
+		if ack := h(Delivery[string]{Envelope: Envelope{MessageID: "failing"}}); ack != NackRequeue {
+			t.Errorf("copy %d of a failing message: got %v", i+1, ack)
+		}
+		h(Delivery[string]{})
+	}
+	if calls["ok"] != 1 {
+		t.Errorf("duplicates reached the handler: %d calls", calls["ok"])
+	}
+	if calls["failing"] != 3 {
+		t.Errorf("a failed message was marked: %d calls, want every retry handled", calls["failing"])
+	}
+	if calls[""] != 3 {
+		t.Errorf("messages without an ID were skipped: %d calls", calls[""])
+	}
+}
+
+func TestIdempotentStoreFailure(t *testing.T) {
+	var logs syncBuffer
+	h := Chain(func(Delivery[string]) AckType {
+		t.Error("the handler ran without knowing whether the message is a duplicate")
+		return Ack
+	}, Idempotent[string](slog.New(slog.NewTextHandler(&logs, nil)), failingDedupStore{}))
+
+	if ack := h(Delivery[string]{Envelope: Envelope{MessageID: "m1"}}); ack != NackRequeue {
+		t.Errorf("got %v, want NackRequeue", ack)
+	}
+	if out := logs.String(); !strings.Contains(out, "could not look up message") || !strings.Contains(out, "m1") {
+		t.Errorf("the failure was not logged: %s", out)
+	}
+}
+
+func TestBoltDedupStoreReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup.db")
+	s, err := NewBoltDedupStore(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := s.Mark(ctx, "m1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = NewBoltDedupStore(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if seen, err := s.Seen(ctx, "m1"); err != nil || !seen {
+		t.Errorf("m1 was forgotten across a reopen: seen %v, err %v", seen, err)
+	}
+	if seen, err := s.Seen(ctx, "m2"); err != nil || seen {
+		t.Errorf("m2 was never marked: seen %v, err %v", seen, err)
+	}
+}
+
+func TestBoltDedupStorePrune(t *testing.T) {
+	s, err := NewBoltDedupStore(filepath.Join(t.TempDir(), "dedup.db"), 20*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx := context.Background()
+	for i := 0; i < 300; i++ {
+		if err := s.Mark(ctx, fmt.Sprintf("old-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(30 * time.Millisecond)
+	if err := s.Mark(ctx, "new"); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := s.Prune()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 300 {
+		t.Errorf("pruned %d IDs, want all 300 expired ones", removed)
+	}
+	if removed, _ := s.Prune(); removed != 0 {
+		t.Errorf("a second prune found %d more expired IDs", removed)
+	}
+	if seen, err := s.Seen(ctx, "new"); err != nil || !seen {
+		t.Errorf("the unexpired ID is gone: seen %v, err %v", seen, err)
+	}
+}
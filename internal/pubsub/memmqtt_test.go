@@ -0,0 +1,480 @@
+package pubsub
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// MQTTServer is an in-process stand-in for RabbitMQ's MQTT plugin. It serves
+// MQTT 5 clients from a MemoryBroker the way the plugin does: messages are
+// published to exchange, and every session gets a queue per QoS level,
+// named mqtt-subscription-<client id>qos<n>, bound to exchange with its
+// subscriptions. Persistent sessions keep their queues between connections.
+// There is no authentication, retained messages or wills.
+type MQTTServer struct {
+	broker   *MemoryBroker
+	exchange string
+
+	mu       sync.Mutex
+	sessions map[string]*mqttSession
+}
+
+func NewMQTTServer(broker *MemoryBroker, exchange string) *MQTTServer {
+	return &MQTTServer{
+		broker:   broker,
+		exchange: exchange,
+		sessions: map[string]*mqttSession{},
+	}
+}
+
+// Serve accepts MQTT connections on ln until it is closed.
+func (s *MQTTServer) Serve(ln net.Listener) error {
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(nc)
+	}
+}
+
+type mqttSession struct {
+	server     *MQTTServer
+	clientID   string
+	persistent bool
+	nc         net.Conn
+	conn       *MemoryConnection
+	pub        Channel
+
+	wmu sync.Mutex
+	w   *bufio.Writer
+
+	mu       sync.Mutex
+	queues   [2]Channel
+	inflight map[uint16]amqp.Delivery
+	packetID uint16
+}
+
+func (s *MQTTServer) serveConn(nc net.Conn) {
+	defer nc.Close()
+	r := bufio.NewReader(nc)
+
+	nc.SetReadDeadline(time.Now().Add(mqttTimeout))
+	p, err := readMQTTPacket(r)
+	if err != nil || p.kind != mqttConnect {
+		return
+	}
+	session := &mqttSession{
+		server:   s,
+		nc:       nc,
+		w:        bufio.NewWriter(nc),
+		inflight: map[uint16]amqp.Delivery{},
+	}
+	keepAlive, reason := session.readConnect(p)
+	if reason != 0 {
+		var w mqttWriter
+		w.byte(0)
+		w.byte(reason)
+		w.props(mqttProps{})
+		session.send(w.packet(mqttConnack, 0))
+		return
+	}
+
+	session.conn = s.broker.Connect()
+	defer session.conn.Close()
+	s.takeOver(session)
+	defer s.release(session)
+
+	session.pub, err = session.conn.Channel()
+	if err != nil {
+		return
+	}
+	go func() {
+		// the broker went away
+		if reason := <-session.conn.NotifyClose(make(chan *amqp.Error, 1)); reason != nil {
+			session.disconnect(0x8b, reason.Reason)
+		}
+	}()
+
+	left := session.restore()
+	var w mqttWriter
+	if len(left) > 0 {
+		w.byte(1) // session present
+	} else {
+		w.byte(0)
+	}
+	w.byte(0)
+	w.props(mqttProps{})
+	if err := session.send(w.packet(mqttConnack, 0)); err != nil {
+		return
+	}
+	for _, qos := range left {
+		if _, err := session.queue(qos); err != nil {
+			session.disconnect(mqttUnspecifiedError, err.Error())
+			return
+		}
+	}
+
+	for {
+		if keepAlive > 0 {
+			nc.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		} else {
+			nc.SetReadDeadline(time.Time{})
+		}
+		p, err := readMQTTPacket(r)
+		if err != nil {
+			return
+		}
+		if p.kind == mqttDisconnect {
+			return
+		}
+		if err := session.handle(p); err != nil {
+			session.disconnect(mqttUnspecifiedError, err.Error())
+			return
+		}
+	}
+}
+
+// readConnect reads the CONNECT packet, returning the keep alive and a
+// failure reason code, or 0.
+func (s *mqttSession) readConnect(p *mqttPacket) (time.Duration, byte) {
+	r := &mqttReader{buf: p.body}
+	if r.string() != "MQTT" || r.byte() != 5 {
+		return 0, 0x84
+	}
+	flags := r.byte()
+	keepAlive := time.Duration(r.uint16()) * time.Second
+	props := r.props()
+	s.clientID = r.string()
+	if r.err != nil {
+		return 0, 0x81
+	}
+	s.persistent = flags&0x02 == 0 && props.sessionExpiry > 0
+	if s.clientID == "" {
+		if s.persistent {
+			return 0, 0x85
+		}
+		b := s.server.broker
+		b.mu.Lock()
+		s.clientID = b.genName("mqtt-")
+		b.mu.Unlock()
+	}
+	return keepAlive, 0
+}
+
+// takeOver makes session the one for its client id, disconnecting the
+// connection that had it before.
+func (s *MQTTServer) takeOver(session *mqttSession) {
+	s.mu.Lock()
+	old := s.sessions[session.clientID]
+	s.sessions[session.clientID] = session
+	s.mu.Unlock()
+	if old != nil {
+		old.disconnect(0x8e, "")
+		old.conn.Close()
+	}
+}
+
+func (s *MQTTServer) release(session *mqttSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions[session.clientID] == session {
+		delete(s.sessions, session.clientID)
+	}
+}
+
+func (s *mqttSession) queueName(qos byte) string {
+	return fmt.Sprintf("mqtt-subscription-%sqos%d", s.clientID, qos)
+}
+
+// restore finds the queues a persistent session left behind, or deletes
+// them for a clean one. It returns their QoS levels.
+func (s *mqttSession) restore() []byte {
+	b := s.server.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var left []byte
+	for qos := byte(0); qos < 2; qos++ {
+		q, ok := b.queues[s.queueName(qos)]
+		if !ok {
+			continue
+		}
+		if s.persistent {
+			left = append(left, qos)
+		} else {
+			b.deleteQueue(q)
+		}
+	}
+	return left
+}
+
+func (s *mqttSession) send(p *mqttPacket) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.nc.SetWriteDeadline(time.Now().Add(mqttTimeout))
+	return writeMQTTPacket(s.w, p)
+}
+
+// disconnect tells the client why it is being dropped, as MQTT 5 servers
+// do, and closes the network connection.
+func (s *mqttSession) disconnect(reason byte, text string) {
+	var w mqttWriter
+	w.byte(reason)
+	w.props(mqttProps{reasonString: text})
+	s.send(w.packet(mqttDisconnect, 0))
+	s.nc.Close()
+}
+
+func (s *mqttSession) handle(p *mqttPacket) error {
+	r := &mqttReader{buf: p.body}
+	switch p.kind {
+	case mqttPublish:
+		return s.handlePublish(p, r)
+	case mqttPuback:
+		id := r.uint16()
+		reason := byte(0)
+		if r.more() {
+			reason = r.byte()
+		}
+		s.mu.Lock()
+		d, ok := s.inflight[id]
+		delete(s.inflight, id)
+		s.mu.Unlock()
+		if !ok {
+			return nil
+		}
+		if reason >= mqttUnspecifiedError {
+			return d.Nack(false, false)
+		}
+		return d.Ack(false)
+	case mqttSubscribe:
+		return s.handleSubscribe(r)
+	case mqttUnsubscribe:
+		return s.handleUnsubscribe(r)
+	case mqttPingreq:
+		return s.send(&mqttPacket{kind: mqttPingresp})
+	}
+	return fmt.Errorf("unsupported packet type %d", p.kind)
+}
+
+func (s *mqttSession) handlePublish(p *mqttPacket, r *mqttReader) error {
+	topic := r.string()
+	qos := p.flags >> 1 & 0x03
+	var id uint16
+	if qos > 0 {
+		id = r.uint16()
+	}
+	msg := mqttPublishing(r.props(), r.rest())
+	if r.err != nil {
+		return r.err
+	}
+	if qos > 1 {
+		return errors.New("QoS 2 is not supported")
+	}
+
+	key := mqttRoutingKey(topic)
+	if _, err := mqttTopic(key); err != nil {
+		return err
+	}
+	if qos == 1 {
+		// the plugin stores QoS 1 messages persistently
+		msg.DeliveryMode = amqp.Persistent
+	}
+	routed := s.server.broker.routable(s.server.exchange, key)
+	err := s.pub.PublishWithContext(context.Background(), s.server.exchange, key, false, false, msg)
+	if qos == 0 {
+		return err
+	}
+
+	var w mqttWriter
+	w.uint16(id)
+	switch {
+	case err != nil:
+		w.byte(mqttUnspecifiedError)
+		w.props(mqttProps{reasonString: err.Error()})
+	case !routed:
+		w.byte(mqttNoMatchingSubscribers)
+	}
+	return s.send(w.packet(mqttPuback, 0))
+}
+
+// queue declares and consumes the session's queue for qos, once.
+func (s *mqttSession) queue(qos byte) (Channel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.queues[qos] != nil {
+		return s.queues[qos], nil
+	}
+
+	ch, err := s.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	name := s.queueName(qos)
+	_, err = ch.QueueDeclare(name, s.persistent, !s.persistent, !s.persistent, false, nil)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+	deliveries, err := ch.Consume(name, "", qos == 0, false, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+	s.queues[qos] = ch
+	go s.forward(qos, deliveries)
+	return ch, nil
+}
+
+func (s *mqttSession) handleSubscribe(r *mqttReader) error {
+	id := r.uint16()
+	r.props()
+	type subscription struct {
+		filter string
+		qos    byte
+	}
+	var subs []subscription
+	for r.more() {
+		filter := r.string()
+		subs = append(subs, subscription{filter, min(r.byte()&0x03, 1)})
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if len(subs) == 0 {
+		return errors.New("SUBSCRIBE without topic filters")
+	}
+
+	var w mqttWriter
+	w.uint16(id)
+	var reasons []byte
+	var failure string
+	for _, sub := range subs {
+		reason, err := s.subscribe(sub.filter, sub.qos)
+		if err != nil {
+			failure = err.Error()
+		}
+		reasons = append(reasons, reason)
+	}
+	w.props(mqttProps{reasonString: failure})
+	w.buf = append(w.buf, reasons...)
+	return s.send(w.packet(mqttSuback, 0))
+}
+
+// subscribe binds the queue for qos with filter, moving the binding over
+// from the other queue if the filter was subscribed at another QoS. It
+// returns the SUBACK reason code.
+func (s *mqttSession) subscribe(filter string, qos byte) (byte, error) {
+	key := mqttRoutingKey(filter)
+	if _, err := mqttFilter(key); err != nil {
+		return 0x8f, err
+	}
+	ch, err := s.queue(qos)
+	if err != nil {
+		return mqttUnspecifiedError, err
+	}
+	if err := ch.QueueBind(s.queueName(qos), key, s.server.exchange, false, nil); err != nil {
+		return mqttUnspecifiedError, err
+	}
+	s.server.broker.unbind(s.server.exchange, s.queueName(1-qos), key)
+	return qos, nil
+}
+
+func (s *mqttSession) handleUnsubscribe(r *mqttReader) error {
+	id := r.uint16()
+	r.props()
+	var w mqttWriter
+	w.uint16(id)
+	w.props(mqttProps{})
+	for r.more() {
+		key := mqttRoutingKey(r.string())
+		found := false
+		for qos := byte(0); qos < 2; qos++ {
+			if s.server.broker.unbind(s.server.exchange, s.queueName(qos), key) {
+				found = true
+			}
+		}
+		if found {
+			w.byte(0)
+		} else {
+			// no subscription existed
+			w.byte(0x11)
+		}
+	}
+	if r.err != nil {
+		return r.err
+	}
+	return s.send(w.packet(mqttUnsuback, 0))
+}
+
+func (s *mqttSession) forward(qos byte, deliveries <-chan amqp.Delivery) {
+	for d := range deliveries {
+		topic, err := mqttTopic(d.RoutingKey)
+		if err != nil {
+			// the routing key has no topic to deliver it to
+			if qos > 0 {
+				d.Nack(false, false)
+			}
+			continue
+		}
+
+		var w mqttWriter
+		w.string(topic)
+		flags := qos << 1
+		if qos > 0 {
+			s.mu.Lock()
+			for {
+				s.packetID++
+				if _, taken := s.inflight[s.packetID]; s.packetID != 0 && !taken {
+					break
+				}
+			}
+			id := s.packetID
+			s.inflight[id] = d
+			s.mu.Unlock()
+			w.uint16(id)
+			if d.Redelivered {
+				flags |= 0x08
+			}
+		}
+		w.props(mqttPublishProps(Republishing(d)))
+		w.buf = append(w.buf, d.Body...)
+		if err := s.send(w.packet(mqttPublish, flags)); err != nil {
+			return
+		}
+	}
+}
+
+// routable reports whether a message published to exchange with key would
+// reach a queue.
+func (b *MemoryBroker) routable(exchange, key string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	queues, err := b.route(exchange, key)
+	return err == nil && len(queues) > 0
+}
+
+// unbind removes a binding, reporting whether it existed. AMQP channels
+// unbind with queue.unbind, which Channel leaves out.
+func (b *MemoryBroker) unbind(exchange, queue, key string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		return false
+	}
+	for i, binding := range ex.bindings {
+		if binding.queue == queue && binding.key == key {
+			ex.bindings = append(ex.bindings[:i:i], ex.bindings[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,1336 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// MemoryBroker is an in-process stand-in for a RabbitMQ server. It models
+// exchanges, queues, bindings, consumers and acknowledgements closely enough
+// to run the Peril client and server against it without a network.
+type MemoryBroker struct {
+	mu        sync.Mutex
+	exchanges map[string]*memExchange
+	queues    map[string]*memQueue
+	conns     map[*MemoryConnection]struct{}
+	nextID    int
+}
+
+type memExchange struct {
+	name       string
+	kind       string
+	durable    bool
+	autoDelete bool
+	internal   bool
+	args       amqp.Table
+	bindings   []memBinding
+}
+
+type memBinding struct {
+	queue string
+	key   string
+}
+
+type memQueue struct {
+	name        string
+	kind        string
+	durable     bool
+	autoDelete  bool
+	exclusive   bool
+	owner       *MemoryConnection
+	args        amqp.Table
+	messages    []memMessage
+	consumers   []*memConsumer
+	next        int
+	hadConsumer bool
+	// stream queues keep every message here instead of in messages
+	log []memMessage
+}
+
+type memMessage struct {
+	exchange    string
+	key         string
+	msg         amqp.Publishing
+	redelivered bool
+	expires     time.Time
+	// deliveryCount counts returns to a quorum queue
+	deliveryCount int64
+	// offset is the position of the message in a stream, or -1
+	offset int64
+	stored time.Time
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	b := &MemoryBroker{
+		exchanges: map[string]*memExchange{},
+		queues:    map[string]*memQueue{},
+		conns:     map[*MemoryConnection]struct{}{},
+	}
+	b.declareDefaultExchanges()
+	return b
+}
+
+func (b *MemoryBroker) declareDefaultExchanges() {
+	for name, kind := range map[string]string{
+		"":            amqp.ExchangeDirect,
+		"amq.direct":  amqp.ExchangeDirect,
+		"amq.fanout":  amqp.ExchangeFanout,
+		"amq.topic":   amqp.ExchangeTopic,
+		"amq.headers": amqp.ExchangeHeaders,
+	} {
+		b.exchanges[name] = &memExchange{name: name, kind: kind, durable: true}
+	}
+}
+
+// Connect opens a new connection to the broker. Exclusive queues declared
+// through it are deleted when it is closed.
+func (b *MemoryBroker) Connect() *MemoryConnection {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	conn := &MemoryConnection{
+		broker:   b,
+		channels: map[*memChannel]struct{}{},
+	}
+	b.conns[conn] = struct{}{}
+	return conn
+}
+
+// Restart simulates a broker restart: every connection is closed and only
+// durable exchanges, durable queues and persistent messages survive.
+func (b *MemoryBroker) Restart() {
+	b.mu.Lock()
+	conns := make([]*MemoryConnection, 0, len(b.conns))
+	for conn := range b.conns {
+		conns = append(conns, conn)
+	}
+	b.mu.Unlock()
+
+	forced := &amqp.Error{
+		Code:   amqp.ConnectionForced,
+		Reason: "CONNECTION_FORCED - broker forced connection closure with reason 'shutdown'",
+		Server: true,
+	}
+	for _, conn := range conns {
+		conn.shutdown(forced)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for name, ex := range b.exchanges {
+		if !ex.durable {
+			delete(b.exchanges, name)
+		}
+	}
+	for _, q := range b.queues {
+		if !q.durable {
+			b.deleteQueue(q)
+			continue
+		}
+		kept := q.messages[:0]
+		for _, m := range q.messages {
+			if m.msg.DeliveryMode == amqp.Persistent {
+				kept = append(kept, m)
+			}
+		}
+		q.messages = kept
+	}
+}
+
+func (b *MemoryBroker) genName(prefix string) string {
+	b.nextID++
+	return fmt.Sprintf("%s%d", prefix, b.nextID)
+}
+
+func (b *MemoryBroker) deleteQueue(q *memQueue) {
+	delete(b.queues, q.name)
+	for _, ex := range b.exchanges {
+		kept := ex.bindings[:0]
+		for _, binding := range ex.bindings {
+			if binding.queue != q.name {
+				kept = append(kept, binding)
+			}
+		}
+		ex.bindings = kept
+	}
+}
+
+func (b *MemoryBroker) route(exchange, key string) ([]*memQueue, error) {
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		return nil, &amqp.Error{
+			Code:   amqp.NotFound,
+			Reason: fmt.Sprintf("NOT_FOUND - no exchange '%s'", exchange),
+		}
+	}
+
+	if exchange == "" {
+		q, ok := b.queues[key]
+		if !ok {
+			return nil, nil
+		}
+		return []*memQueue{q}, nil
+	}
+
+	seen := map[string]struct{}{}
+	queues := []*memQueue{}
+	for _, binding := range ex.bindings {
+		if _, ok := seen[binding.queue]; ok {
+			continue
+		}
+		if !bindingMatches(ex.kind, binding.key, key) {
+			continue
+		}
+		q, ok := b.queues[binding.queue]
+		if !ok {
+			continue
+		}
+		seen[binding.queue] = struct{}{}
+		queues = append(queues, q)
+	}
+	return queues, nil
+}
+
+func bindingMatches(kind, bindingKey, routingKey string) bool {
+	switch kind {
+	case amqp.ExchangeFanout:
+		return true
+	case amqp.ExchangeTopic:
+		return topicMatches(strings.Split(bindingKey, "."), strings.Split(routingKey, "."))
+	default:
+		return bindingKey == routingKey
+	}
+}
+
+func topicMatches(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if topicMatches(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && topicMatches(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && topicMatches(pattern[1:], words[1:])
+	}
+}
+
+func (b *MemoryBroker) enqueue(q *memQueue, m memMessage) {
+	m.offset = -1
+	if q.kind == "stream" {
+		m.offset = int64(len(q.log))
+		m.stored = time.Now()
+		q.log = append(q.log, m)
+		b.dispatchStream(q)
+		return
+	}
+	if ttl, ok := messageTTL(q, m); ok {
+		m.expires = time.Now().Add(ttl)
+		time.AfterFunc(ttl, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			b.expire(q)
+		})
+	}
+	q.messages = append(q.messages, m)
+	b.dispatch(q)
+}
+
+// requeue puts a message that was delivered but not acked back at the head
+// of its queue. Quorum queues count the return and dead-letter the message
+// once it exceeds x-delivery-limit; streams never redeliver.
+func (b *MemoryBroker) requeue(q *memQueue, m memMessage) {
+	switch q.kind {
+	case "stream":
+		return
+	case "quorum":
+		m.deliveryCount++
+		if limit, ok := tableInt(q.args["x-delivery-limit"]); ok && m.deliveryCount > limit {
+			b.deadLetter(q, m, "delivery_limit")
+			return
+		}
+	}
+	m.redelivered = true
+	q.messages = append([]memMessage{m}, q.messages...)
+}
+
+func (b *MemoryBroker) dispatch(q *memQueue) {
+	if q.kind == "stream" {
+		b.dispatchStream(q)
+		return
+	}
+	for len(q.messages) > 0 {
+		m := q.messages[0]
+		if m.expired(time.Now()) {
+			q.messages = q.messages[1:]
+			b.deadLetter(q, m, "expired")
+			continue
+		}
+		c := q.nextConsumer()
+		if c == nil {
+			return
+		}
+		q.messages = q.messages[1:]
+		c.deliver(q, m)
+	}
+}
+
+// dispatchStream hands every stream consumer the messages after its offset,
+// as far as its prefetch allows.
+func (b *MemoryBroker) dispatchStream(q *memQueue) {
+	for _, c := range q.consumers {
+		for c.streamNext < int64(len(q.log)) && c.hasCapacity() {
+			c.deliver(q, q.log[c.streamNext])
+			c.streamNext++
+		}
+	}
+}
+
+// streamStart resolves an x-stream-offset consumer argument.
+func streamStart(q *memQueue, spec interface{}) (int64, error) {
+	if t, ok := spec.(time.Time); ok {
+		for i, m := range q.log {
+			// the broker stores timestamps in whole seconds
+			if !m.stored.Before(t.Truncate(time.Second)) {
+				return int64(i), nil
+			}
+		}
+		return int64(len(q.log)), nil
+	}
+	switch spec {
+	case nil, "next":
+		return int64(len(q.log)), nil
+	case "first":
+		return 0, nil
+	case "last":
+		if len(q.log) == 0 {
+			return 0, nil
+		}
+		return int64(len(q.log) - 1), nil
+	}
+	if n, ok := tableInt(spec); ok && n >= 0 {
+		if n > int64(len(q.log)) {
+			n = int64(len(q.log))
+		}
+		return n, nil
+	}
+	return 0, &amqp.Error{
+		Code:   amqp.PreconditionFailed,
+		Reason: fmt.Sprintf("PRECONDITION_FAILED - invalid x-stream-offset %v", spec),
+	}
+}
+
+func (b *MemoryBroker) expire(q *memQueue) {
+	if b.queues[q.name] != q {
+		return
+	}
+	now := time.Now()
+	kept := []memMessage{}
+	expired := []memMessage{}
+	for _, m := range q.messages {
+		if m.expired(now) {
+			expired = append(expired, m)
+		} else {
+			kept = append(kept, m)
+		}
+	}
+	q.messages = kept
+	for _, m := range expired {
+		b.deadLetter(q, m, "expired")
+	}
+}
+
+func (m memMessage) expired(now time.Time) bool {
+	return !m.expires.IsZero() && !m.expires.After(now)
+}
+
+// messageTTL combines the queue's x-message-ttl with the message's own
+// expiration; the shorter one wins, as in RabbitMQ.
+func messageTTL(q *memQueue, m memMessage) (time.Duration, bool) {
+	ttl := time.Duration(-1)
+	if ms, ok := tableInt(q.args["x-message-ttl"]); ok {
+		ttl = time.Duration(ms) * time.Millisecond
+	}
+	if m.msg.Expiration != "" {
+		ms, err := strconv.ParseInt(m.msg.Expiration, 10, 64)
+		if err == nil && (ttl < 0 || time.Duration(ms)*time.Millisecond < ttl) {
+			ttl = time.Duration(ms) * time.Millisecond
+		}
+	}
+	return ttl, ttl >= 0
+}
+
+// argsEquivalent compares declare arguments the way RabbitMQ does, treating
+// integers of any width as equal.
+func argsEquivalent(a, b amqp.Table) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, av := range a {
+		bv, ok := b[k]
+		if !ok {
+			return false
+		}
+		ai, aInt := tableInt(av)
+		bi, bInt := tableInt(bv)
+		if aInt || bInt {
+			if ai != bi || aInt != bInt {
+				return false
+			}
+			continue
+		}
+		if !reflect.DeepEqual(av, bv) {
+			return false
+		}
+	}
+	return true
+}
+
+func tableInt(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int8:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case uint8:
+		return int64(n), true
+	case uint16:
+		return int64(n), true
+	case uint32:
+		return int64(n), true
+	}
+	return 0, false
+}
+
+func (b *MemoryBroker) deadLetter(q *memQueue, m memMessage, reason string) {
+	dlx, ok := q.args["x-dead-letter-exchange"].(string)
+	if !ok {
+		return
+	}
+	key := m.key
+	if dlk, ok := q.args["x-dead-letter-routing-key"].(string); ok {
+		key = dlk
+	}
+
+	msg := m.msg
+	msg.Headers = withDeath(msg.Headers, q.name, reason, m.exchange, m.key)
+	msg.Expiration = ""
+
+	queues, err := b.route(dlx, key)
+	if err != nil {
+		return
+	}
+	for _, target := range queues {
+		b.enqueue(target, memMessage{exchange: dlx, key: key, msg: msg})
+	}
+}
+
+func withDeath(headers amqp.Table, queue, reason, exchange, key string) amqp.Table {
+	out := amqp.Table{}
+	for k, v := range headers {
+		out[k] = v
+	}
+
+	deaths, _ := out["x-death"].([]interface{})
+	count := int64(1)
+	rest := []interface{}{}
+	for _, d := range deaths {
+		death, ok := d.(amqp.Table)
+		if ok && death["queue"] == queue && death["reason"] == reason {
+			if n, ok := death["count"].(int64); ok {
+				count = n + 1
+			}
+			continue
+		}
+		rest = append(rest, d)
+	}
+
+	entry := amqp.Table{
+		"count":        count,
+		"reason":       reason,
+		"queue":        queue,
+		"time":         time.Now(),
+		"exchange":     exchange,
+		"routing-keys": []interface{}{key},
+	}
+	out["x-death"] = append([]interface{}{entry}, rest...)
+
+	if _, ok := out["x-first-death-queue"]; !ok {
+		out["x-first-death-queue"] = queue
+		out["x-first-death-reason"] = reason
+		out["x-first-death-exchange"] = exchange
+	}
+	return out
+}
+
+func (q *memQueue) nextConsumer() *memConsumer {
+	for i := 0; i < len(q.consumers); i++ {
+		c := q.consumers[(q.next+i)%len(q.consumers)]
+		if c.hasCapacity() {
+			q.next = (q.next + i + 1) % len(q.consumers)
+			return c
+		}
+	}
+	return nil
+}
+
+func (q *memQueue) removeConsumer(c *memConsumer) {
+	for i, other := range q.consumers {
+		if other == c {
+			q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
+			break
+		}
+	}
+	if q.next >= len(q.consumers) {
+		q.next = 0
+	}
+}
+
+type MemoryConnection struct {
+	broker   *MemoryBroker
+	channels map[*memChannel]struct{}
+	notify   []chan *amqp.Error
+	closed   bool
+}
+
+// Dial returns a new connection to the broker, so a MemoryBroker can back a
+// ConnectionManager.
+func (b *MemoryBroker) Dial() (Connection, error) {
+	return b.Connect(), nil
+}
+
+func (conn *MemoryConnection) Channel() (Channel, error) {
+	b := conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if conn.closed {
+		return nil, amqp.ErrClosed
+	}
+	ch := &memChannel{
+		conn:      conn,
+		unacked:   map[uint64]*memUnacked{},
+		consumers: map[string]*memConsumer{},
+	}
+	conn.channels[ch] = struct{}{}
+	return ch, nil
+}
+
+func (conn *MemoryConnection) NotifyClose(c chan *amqp.Error) chan *amqp.Error {
+	b := conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if conn.closed {
+		close(c)
+		return c
+	}
+	conn.notify = append(conn.notify, c)
+	return c
+}
+
+func (conn *MemoryConnection) Close() error {
+	return conn.shutdown(nil)
+}
+
+func (conn *MemoryConnection) shutdown(reason *amqp.Error) error {
+	b := conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if conn.closed {
+		return amqp.ErrClosed
+	}
+	conn.closed = true
+	for ch := range conn.channels {
+		ch.closeLocked(reason)
+	}
+	for _, q := range b.queues {
+		if q.exclusive && q.owner == conn {
+			b.deleteQueue(q)
+		}
+	}
+	delete(b.conns, conn)
+	notifyClosed(conn.notify, reason)
+	conn.notify = nil
+	return nil
+}
+
+func notifyClosed(listeners []chan *amqp.Error, reason *amqp.Error) {
+	for _, c := range listeners {
+		if reason != nil {
+			c <- reason
+		}
+		close(c)
+	}
+}
+
+type memChannel struct {
+	conn          *MemoryConnection
+	prefetchCount int
+	prefetchSize  int
+	global        bool
+	nextTag       uint64
+	unacked       map[uint64]*memUnacked
+	consumers     map[string]*memConsumer
+	inflight      int
+	inflightSize  int
+	confirm       bool
+	publishSeq    uint64
+	notifyMu      sync.Mutex
+	notifyClosed  bool
+	confirms      []chan amqp.Confirmation
+	returns       []chan amqp.Return
+	notify        []chan *amqp.Error
+	closed        bool
+}
+
+type memUnacked struct {
+	queue    *memQueue
+	consumer *memConsumer
+	message  memMessage
+}
+
+func (ch *memChannel) lock() (*MemoryBroker, error) {
+	b := ch.conn.broker
+	b.mu.Lock()
+	if ch.closed {
+		b.mu.Unlock()
+		return nil, amqp.ErrClosed
+	}
+	return b, nil
+}
+
+func (ch *memChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b, err := ch.lock()
+	if err != nil {
+		return err
+	}
+
+	queues, err := b.route(exchange, key)
+	if err != nil {
+		b.mu.Unlock()
+		return err
+	}
+	for _, q := range queues {
+		b.enqueue(q, memMessage{exchange: exchange, key: key, msg: msg})
+	}
+
+	returned := mandatory && len(queues) == 0
+	confirm := ch.confirm
+	var tag uint64
+	if confirm {
+		ch.publishSeq++
+		tag = ch.publishSeq
+	}
+	ch.notifyMu.Lock()
+	defer ch.notifyMu.Unlock()
+	b.mu.Unlock()
+
+	if returned {
+		for _, c := range ch.returns {
+			c <- newReturn(exchange, key, msg)
+		}
+	}
+	if confirm {
+		for _, c := range ch.confirms {
+			c <- amqp.Confirmation{DeliveryTag: tag, Ack: true}
+		}
+	}
+	return nil
+}
+
+func newReturn(exchange, key string, msg amqp.Publishing) amqp.Return {
+	return amqp.Return{
+		ReplyCode:       amqp.NoRoute,
+		ReplyText:       "NO_ROUTE",
+		Exchange:        exchange,
+		RoutingKey:      key,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		Headers:         msg.Headers,
+		DeliveryMode:    msg.DeliveryMode,
+		Priority:        msg.Priority,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+		Expiration:      msg.Expiration,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		UserId:          msg.UserId,
+		AppId:           msg.AppId,
+		Body:            msg.Body,
+	}
+}
+
+func (ch *memChannel) Confirm(noWait bool) error {
+	b, err := ch.lock()
+	if err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+	ch.confirm = true
+	return nil
+}
+
+func (ch *memChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	ch.notifyMu.Lock()
+	defer ch.notifyMu.Unlock()
+	if ch.notifyClosed {
+		close(confirm)
+		return confirm
+	}
+	ch.confirms = append(ch.confirms, confirm)
+	return confirm
+}
+
+func (ch *memChannel) NotifyReturn(c chan amqp.Return) chan amqp.Return {
+	ch.notifyMu.Lock()
+	defer ch.notifyMu.Unlock()
+	if ch.notifyClosed {
+		close(c)
+		return c
+	}
+	ch.returns = append(ch.returns, c)
+	return c
+}
+
+func (ch *memChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	b, err := ch.lock()
+	if err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+	ch.prefetchCount = prefetchCount
+	ch.prefetchSize = prefetchSize
+	ch.global = global
+	return nil
+}
+
+func (ch *memChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	b, err := ch.lock()
+	if err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+
+	if ex, ok := b.exchanges[name]; ok {
+		if ex.kind != kind || ex.durable != durable || ex.autoDelete != autoDelete ||
+			ex.internal != internal || !argsEquivalent(ex.args, args) {
+			return &amqp.Error{
+				Code:   amqp.PreconditionFailed,
+				Reason: fmt.Sprintf("PRECONDITION_FAILED - inequivalent arg for exchange '%s'", name),
+			}
+		}
+		return nil
+	}
+	switch kind {
+	case amqp.ExchangeDirect, amqp.ExchangeFanout, amqp.ExchangeTopic, amqp.ExchangeHeaders:
+	default:
+		return &amqp.Error{
+			Code:   amqp.CommandInvalid,
+			Reason: fmt.Sprintf("COMMAND_INVALID - unknown exchange type '%s'", kind),
+		}
+	}
+	b.exchanges[name] = &memExchange{
+		name:       name,
+		kind:       kind,
+		durable:    durable,
+		autoDelete: autoDelete,
+		internal:   internal,
+		args:       args,
+	}
+	return nil
+}
+
+func (ch *memChannel) ExchangeDeclarePassive(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	b, err := ch.lock()
+	if err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+
+	if _, ok := b.exchanges[name]; !ok {
+		return &amqp.Error{
+			Code:   amqp.NotFound,
+			Reason: fmt.Sprintf("NOT_FOUND - no exchange '%s'", name),
+		}
+	}
+	return nil
+}
+
+func (ch *memChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b, err := ch.lock()
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+	defer b.mu.Unlock()
+
+	if name == "" {
+		name = b.genName("amq.gen-")
+	}
+
+	if q, ok := b.queues[name]; ok {
+		if q.exclusive && q.owner != ch.conn {
+			return amqp.Queue{}, &amqp.Error{
+				Code:   amqp.ResourceLocked,
+				Reason: fmt.Sprintf("RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s'", name),
+			}
+		}
+		if q.durable != durable || q.autoDelete != autoDelete || q.exclusive != exclusive ||
+			!argsEquivalent(q.args, args) {
+			return amqp.Queue{}, &amqp.Error{
+				Code:   amqp.PreconditionFailed,
+				Reason: fmt.Sprintf("PRECONDITION_FAILED - inequivalent arg for queue '%s'", name),
+			}
+		}
+		return q.info(), nil
+	}
+
+	kind := "classic"
+	if k, ok := args["x-queue-type"].(string); ok {
+		kind = k
+	}
+	switch kind {
+	case "classic":
+	case "quorum", "stream":
+		for property, invalid := range map[string]bool{
+			"non-durable": !durable,
+			"auto-delete": autoDelete,
+			"exclusive":   exclusive,
+		} {
+			if invalid {
+				return amqp.Queue{}, &amqp.Error{
+					Code:   amqp.PreconditionFailed,
+					Reason: fmt.Sprintf("PRECONDITION_FAILED - invalid property '%s' for queue '%s'", property, name),
+				}
+			}
+		}
+	default:
+		return amqp.Queue{}, &amqp.Error{
+			Code:   amqp.PreconditionFailed,
+			Reason: fmt.Sprintf("PRECONDITION_FAILED - invalid arg 'x-queue-type' for queue '%s'", name),
+		}
+	}
+
+	q := &memQueue{
+		name:       name,
+		kind:       kind,
+		durable:    durable,
+		autoDelete: autoDelete,
+		exclusive:  exclusive,
+		args:       args,
+	}
+	if exclusive {
+		q.owner = ch.conn
+	}
+	b.queues[name] = q
+	return q.info(), nil
+}
+
+func (ch *memChannel) QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	b, err := ch.lock()
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+	defer b.mu.Unlock()
+
+	q, ok := b.queues[name]
+	if !ok {
+		return amqp.Queue{}, &amqp.Error{
+			Code:   amqp.NotFound,
+			Reason: fmt.Sprintf("NOT_FOUND - no queue '%s'", name),
+		}
+	}
+	return q.info(), nil
+}
+
+func (ch *memChannel) QueuePurge(name string, noWait bool) (int, error) {
+	b, err := ch.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer b.mu.Unlock()
+
+	q, ok := b.queues[name]
+	if !ok {
+		return 0, &amqp.Error{
+			Code:   amqp.NotFound,
+			Reason: fmt.Sprintf("NOT_FOUND - no queue '%s'", name),
+		}
+	}
+	if q.kind == "stream" {
+		return 0, streamNotSupported(q, "queue.purge")
+	}
+	n := len(q.messages)
+	q.messages = nil
+	return n, nil
+}
+
+func (ch *memChannel) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	b, err := ch.lock()
+	if err != nil {
+		return amqp.Delivery{}, false, err
+	}
+	defer b.mu.Unlock()
+
+	q, ok := b.queues[queue]
+	if !ok {
+		return amqp.Delivery{}, false, &amqp.Error{
+			Code:   amqp.NotFound,
+			Reason: fmt.Sprintf("NOT_FOUND - no queue '%s'", queue),
+		}
+	}
+	if q.kind == "stream" {
+		return amqp.Delivery{}, false, streamNotSupported(q, "basic.get")
+	}
+	if len(q.messages) == 0 {
+		return amqp.Delivery{}, false, nil
+	}
+
+	m := q.messages[0]
+	q.messages = q.messages[1:]
+	ch.nextTag++
+	tag := ch.nextTag
+	if !autoAck {
+		ch.unacked[tag] = &memUnacked{queue: q, message: m}
+	}
+	d := newMemDelivery(ch, "", tag, m)
+	d.MessageCount = uint32(len(q.messages))
+	return d, true, nil
+}
+
+func streamNotSupported(q *memQueue, method string) *amqp.Error {
+	return &amqp.Error{
+		Code:   amqp.NotImplemented,
+		Reason: fmt.Sprintf("NOT_IMPLEMENTED - %s not supported by stream queue '%s'", method, q.name),
+	}
+}
+
+func (q *memQueue) info() amqp.Queue {
+	return amqp.Queue{
+		Name:      q.name,
+		Messages:  len(q.messages),
+		Consumers: len(q.consumers),
+	}
+}
+
+func (ch *memChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	b, err := ch.lock()
+	if err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		return &amqp.Error{
+			Code:   amqp.NotFound,
+			Reason: fmt.Sprintf("NOT_FOUND - no exchange '%s'", exchange),
+		}
+	}
+	if _, ok := b.queues[name]; !ok {
+		return &amqp.Error{
+			Code:   amqp.NotFound,
+			Reason: fmt.Sprintf("NOT_FOUND - no queue '%s'", name),
+		}
+	}
+	for _, binding := range ex.bindings {
+		if binding.queue == name && binding.key == key {
+			return nil
+		}
+	}
+	ex.bindings = append(ex.bindings, memBinding{queue: name, key: key})
+	return nil
+}
+
+func (ch *memChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	b, err := ch.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer b.mu.Unlock()
+
+	q, ok := b.queues[queue]
+	if !ok {
+		return nil, &amqp.Error{
+			Code:   amqp.NotFound,
+			Reason: fmt.Sprintf("NOT_FOUND - no queue '%s'", queue),
+		}
+	}
+	if q.exclusive && q.owner != ch.conn {
+		return nil, &amqp.Error{
+			Code:   amqp.ResourceLocked,
+			Reason: fmt.Sprintf("RESOURCE_LOCKED - cannot obtain exclusive access to locked queue '%s'", queue),
+		}
+	}
+	for _, other := range q.consumers {
+		if exclusive || other.exclusive {
+			return nil, &amqp.Error{
+				Code:   amqp.AccessRefused,
+				Reason: fmt.Sprintf("ACCESS_REFUSED - queue '%s' in exclusive use", queue),
+			}
+		}
+	}
+
+	var streamNext int64
+	if q.kind == "stream" {
+		if autoAck || ch.prefetchCount == 0 {
+			return nil, &amqp.Error{
+				Code:   amqp.PreconditionFailed,
+				Reason: fmt.Sprintf("PRECONDITION_FAILED - stream queue '%s' needs manual acks and a prefetch count", queue),
+			}
+		}
+		streamNext, err = streamStart(q, args["x-stream-offset"])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if consumer == "" {
+		consumer = b.genName("ctag-")
+	}
+	if _, ok := ch.consumers[consumer]; ok {
+		return nil, &amqp.Error{
+			Code:   amqp.NotAllowed,
+			Reason: fmt.Sprintf("NOT_ALLOWED - attempt to reuse consumer tag '%s'", consumer),
+		}
+	}
+
+	c := &memConsumer{
+		tag:           consumer,
+		ch:            ch,
+		queue:         q,
+		autoAck:       autoAck,
+		exclusive:     exclusive,
+		prefetchCount: ch.prefetchCount,
+		prefetchSize:  ch.prefetchSize,
+		streamNext:    streamNext,
+		out:           make(chan amqp.Delivery),
+		wake:          make(chan struct{}, 1),
+		done:          make(chan struct{}),
+	}
+	ch.consumers[consumer] = c
+	q.consumers = append(q.consumers, c)
+	q.hadConsumer = true
+	go c.run()
+
+	b.dispatch(q)
+	return c.out, nil
+}
+
+func (ch *memChannel) Cancel(consumer string, noWait bool) error {
+	b, err := ch.lock()
+	if err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+
+	c, ok := ch.consumers[consumer]
+	if !ok {
+		return nil
+	}
+	ch.cancelLocked(c)
+	return nil
+}
+
+func (ch *memChannel) cancelLocked(c *memConsumer) {
+	b := ch.conn.broker
+	delete(ch.consumers, c.tag)
+	c.queue.removeConsumer(c)
+	close(c.done)
+
+	for _, d := range c.pending {
+		if u, ok := ch.unacked[d.DeliveryTag]; ok {
+			ch.settleLocked(d.DeliveryTag, u)
+			b.requeue(u.queue, u.message)
+		}
+	}
+	c.pending = nil
+
+	q := c.queue
+	if q.autoDelete && q.hadConsumer && len(q.consumers) == 0 {
+		b.deleteQueue(q)
+		return
+	}
+	b.dispatch(q)
+}
+
+func (ch *memChannel) Close() error {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	ch.closeLocked(nil)
+	return nil
+}
+
+func (ch *memChannel) NotifyClose(c chan *amqp.Error) chan *amqp.Error {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.closed {
+		close(c)
+		return c
+	}
+	ch.notify = append(ch.notify, c)
+	return c
+}
+
+func (ch *memChannel) closeLocked(reason *amqp.Error) {
+	b := ch.conn.broker
+	ch.closed = true
+	for _, c := range ch.consumers {
+		ch.cancelLocked(c)
+	}
+
+	touched := map[*memQueue]struct{}{}
+	for tag, u := range ch.unacked {
+		ch.settleLocked(tag, u)
+		b.requeue(u.queue, u.message)
+		touched[u.queue] = struct{}{}
+	}
+	for q := range touched {
+		if _, ok := b.queues[q.name]; ok {
+			b.dispatch(q)
+		}
+	}
+	delete(ch.conn.channels, ch)
+	notifyClosed(ch.notify, reason)
+	ch.notify = nil
+
+	ch.notifyMu.Lock()
+	defer ch.notifyMu.Unlock()
+	ch.notifyClosed = true
+	for _, c := range ch.confirms {
+		close(c)
+	}
+	ch.confirms = nil
+	for _, c := range ch.returns {
+		close(c)
+	}
+	ch.returns = nil
+}
+
+func (ch *memChannel) settleLocked(tag uint64, u *memUnacked) {
+	delete(ch.unacked, tag)
+	if u.consumer == nil {
+		return
+	}
+	size := len(u.message.msg.Body)
+	u.consumer.inflight--
+	u.consumer.inflightSize -= size
+	ch.inflight--
+	ch.inflightSize -= size
+}
+
+func (ch *memChannel) settle(tag uint64, multiple bool, fn func(*memUnacked)) error {
+	b, err := ch.lock()
+	if err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+
+	tags := []uint64{}
+	if multiple {
+		for t := range ch.unacked {
+			if t <= tag {
+				tags = append(tags, t)
+			}
+		}
+	} else if _, ok := ch.unacked[tag]; ok {
+		tags = append(tags, tag)
+	}
+	if len(tags) == 0 {
+		return &amqp.Error{
+			Code:   amqp.PreconditionFailed,
+			Reason: fmt.Sprintf("PRECONDITION_FAILED - unknown delivery tag %d", tag),
+		}
+	}
+
+	touched := map[*memQueue]struct{}{}
+	for _, t := range tags {
+		u := ch.unacked[t]
+		ch.settleLocked(t, u)
+		fn(u)
+		touched[u.queue] = struct{}{}
+	}
+	for _, c := range ch.consumers {
+		touched[c.queue] = struct{}{}
+	}
+	for q := range touched {
+		if _, ok := b.queues[q.name]; ok {
+			b.dispatch(q)
+		}
+	}
+	return nil
+}
+
+func (ch *memChannel) Ack(tag uint64, multiple bool) error {
+	return ch.settle(tag, multiple, func(*memUnacked) {})
+}
+
+func (ch *memChannel) Nack(tag uint64, multiple bool, requeue bool) error {
+	b := ch.conn.broker
+	return ch.settle(tag, multiple, func(u *memUnacked) {
+		if requeue {
+			b.requeue(u.queue, u.message)
+			return
+		}
+		b.deadLetter(u.queue, u.message, "rejected")
+	})
+}
+
+func (ch *memChannel) Reject(tag uint64, requeue bool) error {
+	return ch.Nack(tag, false, requeue)
+}
+
+type memConsumer struct {
+	tag           string
+	ch            *memChannel
+	queue         *memQueue
+	autoAck       bool
+	exclusive     bool
+	prefetchCount int
+	prefetchSize  int
+	inflight      int
+	inflightSize  int
+	streamNext    int64
+	pending       []amqp.Delivery
+	out           chan amqp.Delivery
+	wake          chan struct{}
+	done          chan struct{}
+}
+
+func (c *memConsumer) hasCapacity() bool {
+	if c.autoAck {
+		return true
+	}
+	count, size := c.inflight, c.inflightSize
+	prefetchCount, prefetchSize := c.prefetchCount, c.prefetchSize
+	if c.ch.global {
+		count, size = c.ch.inflight, c.ch.inflightSize
+		prefetchCount, prefetchSize = c.ch.prefetchCount, c.ch.prefetchSize
+	}
+	if prefetchCount > 0 && count >= prefetchCount {
+		return false
+	}
+	if prefetchSize > 0 && size >= prefetchSize {
+		return false
+	}
+	return true
+}
+
+func (c *memConsumer) deliver(q *memQueue, m memMessage) {
+	ch := c.ch
+	ch.nextTag++
+	tag := ch.nextTag
+
+	if !c.autoAck {
+		size := len(m.msg.Body)
+		ch.unacked[tag] = &memUnacked{queue: q, consumer: c, message: m}
+		c.inflight++
+		c.inflightSize += size
+		ch.inflight++
+		ch.inflightSize += size
+	}
+
+	c.pending = append(c.pending, newMemDelivery(ch, c.tag, tag, m))
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+func newMemDelivery(ch *memChannel, consumerTag string, tag uint64, m memMessage) amqp.Delivery {
+	headers := m.msg.Headers
+	if m.deliveryCount > 0 || m.offset >= 0 {
+		headers = amqp.Table{}
+		for k, v := range m.msg.Headers {
+			headers[k] = v
+		}
+		if m.deliveryCount > 0 {
+			headers["x-delivery-count"] = m.deliveryCount
+		}
+		if m.offset >= 0 {
+			headers["x-stream-offset"] = m.offset
+		}
+	}
+	return amqp.Delivery{
+		Acknowledger:    ch,
+		Headers:         headers,
+		ContentType:     m.msg.ContentType,
+		ContentEncoding: m.msg.ContentEncoding,
+		DeliveryMode:    m.msg.DeliveryMode,
+		Priority:        m.msg.Priority,
+		CorrelationId:   m.msg.CorrelationId,
+		ReplyTo:         m.msg.ReplyTo,
+		Expiration:      m.msg.Expiration,
+		MessageId:       m.msg.MessageId,
+		Timestamp:       m.msg.Timestamp,
+		Type:            m.msg.Type,
+		UserId:          m.msg.UserId,
+		AppId:           m.msg.AppId,
+		ConsumerTag:     consumerTag,
+		DeliveryTag:     tag,
+		Redelivered:     m.redelivered,
+		Exchange:        m.exchange,
+		RoutingKey:      m.key,
+		Body:            m.msg.Body,
+	}
+}
+
+func (c *memConsumer) run() {
+	defer close(c.out)
+	b := c.ch.conn.broker
+	for {
+		b.mu.Lock()
+		if len(c.pending) == 0 {
+			b.mu.Unlock()
+			select {
+			case <-c.wake:
+				continue
+			case <-c.done:
+				return
+			}
+		}
+		d := c.pending[0]
+		c.pending = c.pending[1:]
+		b.mu.Unlock()
+
+		select {
+		case c.out <- d:
+		case <-c.done:
+			b.mu.Lock()
+			if u, ok := c.ch.unacked[d.DeliveryTag]; ok && u.consumer == c {
+				c.ch.settleLocked(d.DeliveryTag, u)
+				b.requeue(u.queue, u.message)
+				if _, ok := b.queues[u.queue.name]; ok {
+					b.dispatch(u.queue)
+				}
+			}
+			b.mu.Unlock()
+			return
+		}
+	}
+}
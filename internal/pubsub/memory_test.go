@@ -0,0 +1,473 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestTopicBindings(t *testing.T) {
+	tests := []struct {
+		binding string
+		key     string
+		want    bool
+	}{
+		{"army_moves.*", "army_moves.alice", true},
+		{"army_moves.*", "army_moves", false},
+		{"army_moves.*", "army_moves.alice.extra", false},
+		{"*.alice", "war.alice", true},
+		{"game_logs.#", "game_logs", true},
+		{"game_logs.#", "game_logs.alice.today", true},
+		{"#", "anything.at.all", true},
+		{"#.alice", "war.alice", true},
+		{"#.alice", "war.bob", false},
+		{"a.#.z", "a.z", true},
+		{"a.#.z", "a.b.c.z", true},
+		{"a.*.z", "a.z", false},
+		{"pause", "pause", true},
+		{"pause", "pause.now", false},
+	}
+	for _, tt := range tests {
+		if got := bindingMatches(amqp.ExchangeTopic, tt.binding, tt.key); got != tt.want {
+			t.Errorf("binding %q, key %q: got %v, want %v", tt.binding, tt.key, got, tt.want)
+		}
+	}
+
+	if bindingMatches(amqp.ExchangeDirect, "army_moves.*", "army_moves.alice") {
+		t.Error("a direct exchange matched a wildcard binding")
+	}
+	if !bindingMatches(amqp.ExchangeFanout, "ignored", "army_moves.alice") {
+		t.Error("a fanout exchange did not match every key")
+	}
+}
+
+func TestMemoryBrokerRoutesTopicExchange(t *testing.T) {
+	b := NewMemoryBroker()
+	ch := memChannelFor(t, b)
+	declareExchange(t, ch, "peril_topic", amqp.ExchangeTopic)
+	declareQueue(t, ch, "moves", true, nil)
+	declareQueue(t, ch, "logs", true, nil)
+	bindQueue(t, ch, "moves", "army_moves.*", "peril_topic")
+	bindQueue(t, ch, "logs", "game_logs.#", "peril_topic")
+
+	publish(t, ch, "peril_topic", "army_moves.alice", amqp.Publishing{Body: []byte("move")})
+	publish(t, ch, "peril_topic", "game_logs.alice", amqp.Publishing{Body: []byte("log")})
+	publish(t, ch, "peril_topic", "war.alice", amqp.Publishing{Body: []byte("unrouted")})
+
+	if msg := get(t, ch, "moves"); string(msg.Body) != "move" || msg.RoutingKey != "army_moves.alice" {
+		t.Errorf("moves got %q with key %q", msg.Body, msg.RoutingKey)
+	}
+	if msg := get(t, ch, "logs"); string(msg.Body) != "log" {
+		t.Errorf("logs got %q", msg.Body)
+	}
+	expectEmpty(t, ch, "moves")
+	expectEmpty(t, ch, "logs")
+}
+
+func TestMemoryBrokerRestart(t *testing.T) {
+	b := NewMemoryBroker()
+	conn := b.Connect()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	declareExchange(t, ch, "peril_topic", amqp.ExchangeTopic)
+	declareQueue(t, ch, "durable", true, nil)
+	_, err = ch.QueueDeclare("transient", false, true, true, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bindQueue(t, ch, "durable", "#", "peril_topic")
+	bindQueue(t, ch, "transient", "#", "peril_topic")
+
+	publish(t, ch, "peril_topic", "k", amqp.Publishing{Body: []byte("persistent"), DeliveryMode: amqp.Persistent})
+	publish(t, ch, "peril_topic", "k", amqp.Publishing{Body: []byte("transient"), DeliveryMode: amqp.Transient})
+
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	b.Restart()
+	select {
+	case err := <-closed:
+		if err == nil || err.Code != amqp.ConnectionForced {
+			t.Errorf("connection closed with %v, want CONNECTION_FORCED", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("restart did not close the connection")
+	}
+	if _, err := ch.QueueDeclarePassive("durable", true, false, false, false, nil); err == nil {
+		t.Error("a channel of the old connection still works")
+	}
+
+	ch = memChannelFor(t, b)
+	if msg := get(t, ch, "durable"); string(msg.Body) != "persistent" {
+		t.Errorf("durable queue kept %q, want the persistent message", msg.Body)
+	}
+	expectEmpty(t, ch, "durable")
+	if _, err := ch.QueueDeclarePassive("transient", false, true, true, false, nil); err == nil {
+		t.Error("transient queue survived the restart")
+	}
+	if err := ch.ExchangeDeclarePassive("peril_topic", amqp.ExchangeTopic, true, false, false, false, nil); err != nil {
+		t.Errorf("durable exchange did not survive the restart: %v", err)
+	}
+}
+
+func TestMemoryBrokerSubscriptionSurvivesRestart(t *testing.T) {
+	b := NewMemoryBroker()
+	m, err := NewConnectionManager(b.Dial, WithBackoff(time.Millisecond, 10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	ch := memChannelFor(t, b)
+	declareExchange(t, ch, "peril_topic", amqp.ExchangeTopic)
+
+	got := make(chan string, 10)
+	sub, err := Subscribe(context.Background(), m, "peril_topic", "moves", "army_moves.*", DurableSimpleQueue,
+		func(d Delivery[string]) AckType {
+			got <- d.Body
+			return Ack
+		},
+		WithDefaultCodec(JSONCodec),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	b.Restart()
+	// the durable queue outlives the restart, so the message waits there
+	// until the manager has reconnected and restored the consumer
+	err = PublishJSON(memChannelFor(t, b), "peril_topic", "army_moves.alice", "after restart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case body := <-got:
+		if body != "after restart" {
+			t.Errorf("got %q", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscription did not receive anything after the restart")
+	}
+}
+
+func TestMemoryBrokerPrefetch(t *testing.T) {
+	b := NewMemoryBroker()
+	ch := memChannelFor(t, b)
+	declareQueue(t, ch, "q", true, nil)
+	for i := 0; i < 5; i++ {
+		publish(t, ch, "", "q", amqp.Publishing{Body: []byte{byte('0' + i)}})
+	}
+
+	if err := ch.Qos(2, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := ch.Consume("q", "c", false, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := receive(t, msgs)
+	receive(t, msgs)
+	select {
+	case d := <-msgs:
+		t.Fatalf("got %q beyond the prefetch count", d.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := first.Ack(false); err != nil {
+		t.Fatal(err)
+	}
+	if d := receive(t, msgs); string(d.Body) != "2" {
+		t.Errorf("after an ack got %q, want the third message", d.Body)
+	}
+}
+
+func TestMemoryBrokerSettling(t *testing.T) {
+	b := NewMemoryBroker()
+	ch := memChannelFor(t, b)
+	declareExchange(t, ch, "peril_topic", amqp.ExchangeTopic)
+	declareExchange(t, ch, "peril_dlx", amqp.ExchangeTopic)
+	declareQueue(t, ch, "dlq", true, nil)
+	bindQueue(t, ch, "dlq", "#", "peril_dlx")
+	declareQueue(t, ch, "war", true, amqp.Table{"x-dead-letter-exchange": "peril_dlx"})
+	bindQueue(t, ch, "war", "war.*", "peril_topic")
+
+	if err := ch.Qos(1, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := ch.Consume("war", "c", false, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publish(t, ch, "peril_topic", "war.alice", amqp.Publishing{Body: []byte("acked")})
+	d := receive(t, msgs)
+	if err := d.Ack(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Ack(false); err == nil {
+		t.Error("acking a delivery twice succeeded")
+	}
+
+	publish(t, ch, "peril_topic", "war.alice", amqp.Publishing{Body: []byte("requeued")})
+	d = receive(t, msgs)
+	if d.Redelivered {
+		t.Error("first delivery is marked redelivered")
+	}
+	if err := d.Nack(false, true); err != nil {
+		t.Fatal(err)
+	}
+	d = receive(t, msgs)
+	if string(d.Body) != "requeued" || !d.Redelivered {
+		t.Errorf("after NackRequeue got %q, redelivered %v", d.Body, d.Redelivered)
+	}
+	if err := d.Nack(false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	dead := get(t, ch, "dlq")
+	if string(dead.Body) != "requeued" || dead.RoutingKey != "war.alice" {
+		t.Errorf("dead-letter queue got %q with key %q", dead.Body, dead.RoutingKey)
+	}
+	deaths := Deaths(dead.Headers)
+	if len(deaths) != 1 {
+		t.Fatalf("got %d x-death entries, want 1", len(deaths))
+	}
+	want := Death{Queue: "war", Reason: "rejected", Exchange: "peril_topic", RoutingKeys: []string{"war.alice"}, Count: 1}
+	got := deaths[0]
+	got.Time = time.Time{}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("x-death is %+v, want %+v", got, want)
+	}
+	expectEmpty(t, ch, "war")
+}
+
+func TestMemoryBrokerDeliveryLimit(t *testing.T) {
+	b := NewMemoryBroker()
+	ch := memChannelFor(t, b)
+	declareExchange(t, ch, "peril_dlx", amqp.ExchangeTopic)
+	declareQueue(t, ch, "dlq", true, nil)
+	bindQueue(t, ch, "dlq", "#", "peril_dlx")
+	declareQueue(t, ch, "war", true, amqp.Table{
+		"x-queue-type":           "quorum",
+		"x-delivery-limit":       int64(2),
+		"x-dead-letter-exchange": "peril_dlx",
+	})
+	if err := ch.Qos(1, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := ch.Consume("war", "c", false, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publish(t, ch, "", "war", amqp.Publishing{Body: []byte("war")})
+	// the first delivery and two returns are within the limit
+	for i := int64(0); i < 3; i++ {
+		d := receive(t, msgs)
+		if n, _ := tableInt(d.Headers["x-delivery-count"]); n != i {
+			t.Errorf("delivery %d has x-delivery-count %v", i+1, d.Headers["x-delivery-count"])
+		}
+		if err := d.Nack(false, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dead := getEventually(t, ch, "dlq")
+	deaths := Deaths(dead.Headers)
+	if string(dead.Body) != "war" || len(deaths) != 1 || deaths[0].Reason != "delivery_limit" {
+		t.Errorf("dead-letter queue got %q with deaths %+v", dead.Body, deaths)
+	}
+	select {
+	case d := <-msgs:
+		t.Errorf("got %q after it was dead-lettered", d.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMemoryBrokerStreamOffsets(t *testing.T) {
+	b := NewMemoryBroker()
+	ch := memChannelFor(t, b)
+	declareQueue(t, ch, "logs", true, amqp.Table{"x-queue-type": "stream"})
+	for _, body := range []string{"0", "1", "2"} {
+		publish(t, ch, "", "logs", amqp.Publishing{Body: []byte(body)})
+	}
+
+	consume := func(offset interface{}) (<-chan amqp.Delivery, error) {
+		ch := memChannelFor(t, b)
+		if err := ch.Qos(10, 0, false); err != nil {
+			t.Fatal(err)
+		}
+		return ch.Consume("logs", "", false, false, false, false, amqp.Table{"x-stream-offset": offset})
+	}
+	for _, tc := range []struct {
+		offset interface{}
+		want   []string
+	}{
+		{offset: "first", want: []string{"0", "1", "2"}},
+		{offset: "last", want: []string{"2"}},
+		{offset: int64(1), want: []string{"1", "2"}},
+		{offset: int64(7), want: nil},
+		{offset: "next", want: nil},
+	} {
+		msgs, err := consume(tc.offset)
+		if err != nil {
+			t.Fatalf("offset %v: %v", tc.offset, err)
+		}
+		for _, want := range tc.want {
+			d := receive(t, msgs)
+			offset, _ := tableInt(d.Headers["x-stream-offset"])
+			if string(d.Body) != want || fmt.Sprint(offset) != want {
+				t.Errorf("offset %v: got %q at x-stream-offset %d, want %s", tc.offset, d.Body, offset, want)
+			}
+			d.Ack(false)
+		}
+		select {
+		case d := <-msgs:
+			t.Errorf("offset %v: got %q past the end of the stream", tc.offset, d.Body)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+
+	// a consumer at the end gets what is published next, and acks do not
+	// remove anything from the stream
+	msgs, err := consume("next")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish(t, ch, "", "logs", amqp.Publishing{Body: []byte("3")})
+	if d := receive(t, msgs); string(d.Body) != "3" {
+		t.Errorf("next: got %q", d.Body)
+	}
+	msgs, err = consume("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := receive(t, msgs); string(d.Body) != "0" {
+		t.Errorf("first after acks: got %q", d.Body)
+	}
+
+	_, err = consume("middle")
+	var amqpErr *amqp.Error
+	if !errors.As(err, &amqpErr) || amqpErr.Code != amqp.PreconditionFailed {
+		t.Errorf("invalid offset: got %v, want PRECONDITION_FAILED", err)
+	}
+}
+
+func TestMemoryBrokerMandatoryReturn(t *testing.T) {
+	b := NewMemoryBroker()
+	ch := memChannelFor(t, b)
+	declareExchange(t, ch, "peril_topic", amqp.ExchangeTopic)
+	returns := ch.NotifyReturn(make(chan amqp.Return, 1))
+
+	err := ch.PublishWithContext(context.Background(), "peril_topic", "nobody.listens", true, false, amqp.Publishing{Body: []byte("x")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-returns:
+		if r.ReplyCode != amqp.NoRoute || r.RoutingKey != "nobody.listens" {
+			t.Errorf("got return %d for %q", r.ReplyCode, r.RoutingKey)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("unroutable mandatory message was not returned")
+	}
+}
+
+func memChannelFor(t *testing.T, b *MemoryBroker) Channel {
+	t.Helper()
+	ch, err := b.Connect().Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ch
+}
+
+func declareExchange(t *testing.T, ch Channel, name, kind string) {
+	t.Helper()
+	if err := ch.ExchangeDeclare(name, kind, true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func declareQueue(t *testing.T, ch Channel, name string, durable bool, args amqp.Table) {
+	t.Helper()
+	if _, err := ch.QueueDeclare(name, durable, false, false, false, args); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func bindQueue(t *testing.T, ch Channel, queue, key, exchange string) {
+	t.Helper()
+	if err := ch.QueueBind(queue, key, exchange, false, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func publish(t *testing.T, ch Channel, exchange, key string, msg amqp.Publishing) {
+	t.Helper()
+	if err := ch.PublishWithContext(context.Background(), exchange, key, false, false, msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func get(t *testing.T, ch Channel, queue string) amqp.Delivery {
+	t.Helper()
+	msg, ok, err := ch.Get(queue, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatalf("queue %s is empty", queue)
+	}
+	return msg
+}
+
+// getEventually waits for a message that is still on its way to queue.
+func getEventually(t *testing.T, ch Channel, queue string) amqp.Delivery {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		msg, ok, err := ch.Get(queue, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			return msg
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("nothing arrived in queue %s", queue)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func expectEmpty(t *testing.T, ch Channel, queue string) {
+	t.Helper()
+	msg, ok, err := ch.Get(queue, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Errorf("queue %s still holds %q", queue, msg.Body)
+	}
+}
+
+func receive(t *testing.T, msgs <-chan amqp.Delivery) amqp.Delivery {
+	t.Helper()
+	select {
+	case d, ok := <-msgs:
+		if !ok {
+			t.Fatal("delivery channel closed")
+		}
+		return d
+	case <-time.After(time.Second):
+		t.Fatal("no delivery")
+	}
+	return amqp.Delivery{}
+}
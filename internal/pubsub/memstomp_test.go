@@ -0,0 +1,287 @@
+package pubsub
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// StompServer is an in-process stand-in for RabbitMQ's STOMP plugin. It
+// serves the destinations DialStomp uses from a MemoryBroker, so the STOMP
+// transport can be run without a RabbitMQ server. Every STOMP connection
+// gets a MemoryConnection of its own; restarting the MemoryBroker drops
+// them all.
+type StompServer struct {
+	broker *MemoryBroker
+}
+
+func NewStompServer(broker *MemoryBroker) *StompServer {
+	return &StompServer{broker: broker}
+}
+
+// Serve accepts STOMP connections on ln until it is closed.
+func (s *StompServer) Serve(ln net.Listener) error {
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(nc)
+	}
+}
+
+type stompSession struct {
+	nc   net.Conn
+	conn *MemoryConnection
+	pub  Channel
+
+	wmu sync.Mutex
+	w   *bufio.Writer
+
+	mu     sync.Mutex
+	subs   map[string]Channel
+	acks   map[string]amqp.Delivery
+	nextID int
+}
+
+func (s *StompServer) serveConn(nc net.Conn) {
+	defer nc.Close()
+	r := bufio.NewReader(nc)
+
+	f, err := readStompFrame(r)
+	if err != nil || (f.command != "CONNECT" && f.command != "STOMP") {
+		return
+	}
+
+	conn := s.broker.Connect()
+	defer conn.Close()
+	pub, err := conn.Channel()
+	if err != nil {
+		return
+	}
+	session := &stompSession{
+		nc:   nc,
+		conn: conn,
+		pub:  pub,
+		w:    bufio.NewWriter(nc),
+		subs: map[string]Channel{},
+		acks: map[string]amqp.Delivery{},
+	}
+	go func() {
+		// the broker went away
+		if reason := <-conn.NotifyClose(make(chan *amqp.Error, 1)); reason != nil {
+			session.fail(reason)
+		}
+	}()
+
+	err = session.send(newStompFrame("CONNECTED",
+		"version", "1.2",
+		"heart-beat", "0,0",
+		"server", "peril-memory-stomp",
+	))
+	if err != nil {
+		return
+	}
+
+	for {
+		f, err := readStompFrame(r)
+		if err != nil {
+			return
+		}
+		if f.command == "DISCONNECT" {
+			session.receipt(f)
+			return
+		}
+		if err := session.handle(f); err != nil {
+			session.fail(err)
+			return
+		}
+		session.receipt(f)
+	}
+}
+
+func (s *stompSession) send(f *stompFrame) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	return writeStompFrame(s.w, f)
+}
+
+func (s *stompSession) receipt(f *stompFrame) {
+	if id, ok := f.get("receipt"); ok {
+		s.send(newStompFrame("RECEIPT", "receipt-id", id))
+	}
+}
+
+// fail sends an ERROR frame named after the AMQP error, as RabbitMQ does,
+// and drops the connection.
+func (s *stompSession) fail(err error) {
+	message := "internal_error"
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) {
+		switch amqpErr.Code {
+		case amqp.NotFound:
+			message = "not_found"
+		case amqp.PreconditionFailed:
+			message = "precondition_failed"
+		case amqp.AccessRefused:
+			message = "access_refused"
+		case amqp.ResourceLocked:
+			message = "resource_locked"
+		}
+		err = errors.New(amqpErr.Reason)
+	}
+	f := newStompFrame("ERROR", "message", message, "content-type", "text/plain")
+	f.body = []byte(err.Error())
+	s.send(f)
+	s.nc.Close()
+}
+
+func (s *stompSession) handle(f *stompFrame) error {
+	switch f.command {
+	case "SEND":
+		return s.handleSend(f)
+	case "SUBSCRIBE":
+		return s.handleSubscribe(f)
+	case "UNSUBSCRIBE":
+		s.mu.Lock()
+		ch, ok := s.subs[f.header("id")]
+		delete(s.subs, f.header("id"))
+		s.mu.Unlock()
+		if ok {
+			ch.Close()
+		}
+		return nil
+	case "ACK", "NACK":
+		s.mu.Lock()
+		d, ok := s.acks[f.header("id")]
+		delete(s.acks, f.header("id"))
+		s.mu.Unlock()
+		if !ok {
+			// the subscription was cancelled and its messages requeued
+			return nil
+		}
+		if f.command == "ACK" {
+			return d.Ack(false)
+		}
+		return d.Nack(false, f.header("requeue") != "false")
+	}
+	return fmt.Errorf("unsupported frame %s", f.command)
+}
+
+func isStompDeclareArg(name string) bool {
+	return stompQueueArgs[name] && name != "x-queue-name" && name != streamOffsetArg
+}
+
+// declareStompQueue declares the durable queue /queue/ destinations name.
+func declareStompQueue(ch Channel, name string, f *stompFrame) error {
+	_, err := ch.QueueDeclare(name, true, false, false, false, stompTable(f, isStompDeclareArg))
+	return err
+}
+
+func (s *stompSession) handleSend(f *stompFrame) error {
+	kind, exchange, key, err := parseStompDestination(f.header("destination"))
+	if err != nil {
+		return err
+	}
+	if kind == "queue" {
+		if err := declareStompQueue(s.pub, key, f); err != nil {
+			return err
+		}
+	}
+	return s.pub.PublishWithContext(context.Background(), exchange, key, false, false, stompPublishing(f))
+}
+
+func (s *stompSession) handleSubscribe(f *stompFrame) error {
+	id := f.header("id")
+	kind, exchange, key, err := parseStompDestination(f.header("destination"))
+	if err != nil {
+		return err
+	}
+
+	ch, err := s.conn.Channel()
+	if err != nil {
+		return err
+	}
+	if n, err := strconv.Atoi(f.header("prefetch-count")); err == nil {
+		if err := ch.Qos(n, 0, false); err != nil {
+			return err
+		}
+	}
+
+	queue := key
+	switch kind {
+	case "exchange", "topic":
+		queue = f.header("x-queue-name")
+		durable := f.header("durable") == "true"
+		autoDelete, err := strconv.ParseBool(f.header("auto-delete"))
+		if err != nil {
+			autoDelete = !durable
+		}
+		exclusive, err := strconv.ParseBool(f.header("exclusive"))
+		if err != nil {
+			exclusive = queue == ""
+		}
+		q, err := ch.QueueDeclare(queue, durable, autoDelete, exclusive, false, stompTable(f, isStompDeclareArg))
+		if err != nil {
+			return err
+		}
+		queue = q.Name
+		if err := ch.QueueBind(queue, key, exchange, false, nil); err != nil {
+			return err
+		}
+	case "queue":
+		if err := declareStompQueue(ch, queue, f); err != nil {
+			return err
+		}
+	}
+
+	autoAck := f.header("ack") == "" || f.header("ack") == "auto"
+	args := stompTable(f, func(name string) bool { return name == streamOffsetArg })
+	deliveries, err := ch.Consume(queue, id, autoAck, f.header("exclusive") == "true", false, false, args)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.subs[id] = ch
+	s.mu.Unlock()
+	go s.forward(id, autoAck, deliveries)
+	return nil
+}
+
+func (s *stompSession) forward(id string, autoAck bool, deliveries <-chan amqp.Delivery) {
+	for d := range deliveries {
+		dest := "/exchange/" + d.Exchange + "/" + d.RoutingKey
+		if d.Exchange == "" {
+			dest = "/queue/" + d.RoutingKey
+		}
+
+		s.mu.Lock()
+		s.nextID++
+		messageID := fmt.Sprintf("T_%s@@session@@%d", id, s.nextID)
+		if !autoAck {
+			s.acks[messageID] = d
+		}
+		s.mu.Unlock()
+
+		f := newStompFrame("MESSAGE",
+			"subscription", id,
+			"destination", dest,
+			"message-id", messageID,
+			"redelivered", strconv.FormatBool(d.Redelivered),
+		)
+		if !autoAck {
+			f.set("ack", messageID)
+		}
+		setStompPublishing(f, Republishing(d))
+		if err := s.send(f); err != nil {
+			return
+		}
+	}
+}
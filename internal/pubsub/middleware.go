@@ -0,0 +1,116 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"runtime/debug"
+	"time"
+)
+
+// Middleware wraps a handler to add behaviour around every delivery.
+type Middleware[T any] func(Handler[T]) Handler[T]
+
+// Chain wraps handler in middlewares. The first middleware is the outermost
+// one, so it sees each delivery first and the final AckType last.
+func Chain[T any](handler Handler[T], middlewares ...Middleware[T]) Handler[T] {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// HandlerMiddleware is what the game's event handlers are wrapped in. A zero
+// timeout lets handlers run as long as they need. Idempotent sits outside
+// Timeout so a message is only marked once its handler has returned.
+func HandlerMiddleware[T any](logger *slog.Logger, dedup DedupStore, timeout time.Duration) []Middleware[T] {
+	middleware := []Middleware[T]{
+		Recover[T](logger, NackDiscard),
+		Logging[T](logger),
+		Idempotent[T](logger, dedup),
+	}
+	if timeout > 0 {
+		middleware = append(middleware, Timeout[T](timeout, NackRequeue))
+	}
+	return middleware
+}
+
+// Recover turns a panicking handler into ack. NackDiscard is usually the
+// right choice: a message that panics once will most likely panic again.
+func Recover[T any](logger *slog.Logger, ack AckType) Middleware[T] {
+	return func(next Handler[T]) Handler[T] {
+		return func(d Delivery[T]) (result AckType) {
+			defer func() {
+				if r := recover(); r != nil {
+					logger.Error("handler panicked",
+						"message_id", d.MessageID,
+						"routing_key", d.RoutingKey,
+						"panic", r,
+						"stack", string(debug.Stack()),
+					)
+					result = ack
+				}
+			}()
+			return next(d)
+		}
+	}
+}
+
+// Logging logs every delivery once the handler has settled it: acks at
+// debug level, nacks at warn level.
+func Logging[T any](logger *slog.Logger) Middleware[T] {
+	return func(next Handler[T]) Handler[T] {
+		return func(d Delivery[T]) AckType {
+			start := time.Now()
+			ack := next(d)
+
+			level := slog.LevelDebug
+			if ack != Ack {
+				level = slog.LevelWarn
+			}
+			logger.Log(d.Context(), level, "handled delivery",
+				"message_id", d.MessageID,
+				"correlation_id", d.CorrelationID,
+				"exchange", d.Exchange,
+				"routing_key", d.RoutingKey,
+				"attempt", d.Attempt,
+				"ack", ack.String(),
+				"duration", time.Since(start),
+			)
+			return ack
+		}
+	}
+}
+
+// Timing reports how long the handler took for each delivery, e.g. to feed a
+// histogram.
+func Timing[T any](observe func(env Envelope, ack AckType, elapsed time.Duration)) Middleware[T] {
+	return func(next Handler[T]) Handler[T] {
+		return func(d Delivery[T]) AckType {
+			start := time.Now()
+			ack := next(d)
+			observe(d.Envelope, ack, time.Since(start))
+			return ack
+		}
+	}
+}
+
+// Timeout gives the handler at most timeout per delivery by cancelling the
+// delivery's Context when the time is up. Handlers must honour that Context:
+// Timeout waits for the handler to return, so one that ignores it holds up
+// its worker for as long as it runs. A handler that returns after the
+// deadline settles with ack, unless it acked, as its effect has happened.
+func Timeout[T any](timeout time.Duration, ack AckType) Middleware[T] {
+	return func(next Handler[T]) Handler[T] {
+		return func(d Delivery[T]) AckType {
+			ctx, cancel := context.WithTimeout(d.Context(), timeout)
+			defer cancel()
+
+			result := next(d.WithContext(ctx))
+			if result != Ack && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return ack
+			}
+			return result
+		}
+	}
+}
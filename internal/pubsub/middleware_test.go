@@ -0,0 +1,126 @@
+package pubsub
+
+import (
+	"io"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChainOrder(t *testing.T) {
+	var calls []string
+	trace := func(name string) Middleware[string] {
+		return func(next Handler[string]) Handler[string] {
+			return func(d Delivery[string]) AckType {
+				calls = append(calls, name+" in")
+				ack := next(d)
+				calls = append(calls, name+" out")
+				return ack
+			}
+		}
+	}
+	h := Chain(func(Delivery[string]) AckType {
+		calls = append(calls, "handler")
+		return Ack
+	}, trace("outer"), trace("inner"))
+
+	h(Delivery[string]{})
+	want := []string{"outer in", "inner in", "handler", "inner out", "outer out"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("got %q, want %q", calls, want)
+	}
+}
+
+func TestTimeoutWaitsForHandler(t *testing.T) {
+	returned := false
+	h := Chain(func(d Delivery[string]) AckType {
+		<-d.Context().Done()
+		time.Sleep(20 * time.Millisecond)
+		returned = true
+		return NackDiscard
+	}, Timeout[string](10*time.Millisecond, NackRequeue))
+
+	if ack := h(Delivery[string]{}); ack != NackRequeue {
+		t.Errorf("got %v from a handler that ran out of time, want NackRequeue", ack)
+	}
+	if !returned {
+		t.Error("Timeout returned while the handler was still running")
+	}
+
+	h = Chain(func(d Delivery[string]) AckType {
+		<-d.Context().Done()
+		return Ack
+	}, Timeout[string](10*time.Millisecond, NackRequeue))
+	if ack := h(Delivery[string]{}); ack != Ack {
+		t.Errorf("got %v from a handler that acked late, want Ack", ack)
+	}
+}
+
+func TestRecoverCatchesPanicThroughTimeout(t *testing.T) {
+	var logs syncBuffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	h := Chain(func(Delivery[string]) AckType {
+		panic("boom")
+	}, Recover[string](logger, NackDiscard), Timeout[string](time.Second, NackRequeue))
+
+	if ack := h(Delivery[string]{Envelope: Envelope{MessageID: "m1"}}); ack != NackDiscard {
+		t.Errorf("got %v, want NackDiscard", ack)
+	}
+	if out := logs.String(); !strings.Contains(out, "handler panicked") || !strings.Contains(out, "boom") {
+		t.Errorf("the panic was not logged: %s", out)
+	}
+}
+
+func TestTiming(t *testing.T) {
+	var (
+		observed int
+		env      Envelope
+		ack      AckType
+		elapsed  time.Duration
+	)
+	h := Chain(func(Delivery[string]) AckType {
+		time.Sleep(10 * time.Millisecond)
+		return NackRequeue
+	}, Timing[string](func(e Envelope, a AckType, d time.Duration) {
+		observed++
+		env, ack, elapsed = e, a, d
+	}))
+
+	h(Delivery[string]{Envelope: Envelope{MessageID: "m1"}})
+	if observed != 1 || env.MessageID != "m1" || ack != NackRequeue {
+		t.Errorf("observed %d time(s): message %q settled with %v", observed, env.MessageID, ack)
+	}
+	if elapsed < 10*time.Millisecond {
+		t.Errorf("observed %v for a handler that took 10ms", elapsed)
+	}
+}
+
+func TestHandlerMiddlewareRetriesTimedOutMessage(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	slow := true
+	calls := 0
+	h := Chain(func(d Delivery[string]) AckType {
+		calls++
+		if slow {
+			<-d.Context().Done()
+			return NackRequeue
+		}
+		return Ack
+	}, HandlerMiddleware[string](logger, NewMemoryDedupStore(10, time.Hour), 10*time.Millisecond)...)
+
+	d := Delivery[string]{Envelope: Envelope{MessageID: "m1"}}
+	if ack := h(d); ack != NackRequeue {
+		t.Fatalf("timed out delivery: got %v", ack)
+	}
+	// the timed out handler is finished, so the redelivery is not turned
+	// away as in flight
+	slow = false
+	if ack := h(d); ack != Ack || calls != 2 {
+		t.Fatalf("redelivery: got %v after %d call(s)", ack, calls)
+	}
+	if ack := h(d); ack != Ack || calls != 2 {
+		t.Errorf("duplicate: got %v after %d call(s), want the handler skipped", ack, calls)
+	}
+}
@@ -0,0 +1,337 @@
+package pubsub
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/albsko/learn-pub-sub/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestMQTTPacketRoundTrip(t *testing.T) {
+	// the remaining length takes one more byte at each power of 128
+	for _, tc := range []struct {
+		length, lengthBytes int
+	}{
+		{0, 1}, {127, 1}, {128, 2}, {16383, 2}, {16384, 3}, {2097152, 4},
+	} {
+		body := bytes.Repeat([]byte{0xab}, tc.length)
+		var buf bytes.Buffer
+		if err := writeMQTTPacket(bufio.NewWriter(&buf), &mqttPacket{kind: mqttPublish, flags: 0x0b, body: body}); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.Len() - 1 - tc.length; got != tc.lengthBytes {
+			t.Errorf("%d byte body: remaining length took %d bytes, want %d", tc.length, got, tc.lengthBytes)
+		}
+		p, err := readMQTTPacket(bufio.NewReader(&buf))
+		if err != nil {
+			t.Fatalf("%d byte body: %v", tc.length, err)
+		}
+		if p.kind != mqttPublish || p.flags != 0x0b || !bytes.Equal(p.body, body) {
+			t.Errorf("%d byte body: read back type %d flags %#x and %d bytes", tc.length, p.kind, p.flags, len(p.body))
+		}
+	}
+
+	for name, raw := range map[string][]byte{
+		"five length bytes": {mqttPublish << 4, 0x80, 0x80, 0x80, 0x80, 0x01},
+		"too large":         append([]byte{mqttPublish << 4}, appendVarint(nil, mqttMaxPacket+1)...),
+		"truncated body":    {mqttPublish << 4, 0x05, 0x00},
+	} {
+		if _, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(raw))); err == nil {
+			t.Errorf("%s: read succeeded", name)
+		}
+	}
+}
+
+func TestMQTTPropsRoundTrip(t *testing.T) {
+	expiry := uint32(90)
+	props := mqttProps{
+		messageExpiry:   &expiry,
+		contentType:     "application/json",
+		responseTopic:   "peril/replies",
+		correlationData: []byte("req-1"),
+		sessionExpiry:   3600,
+		serverKeepAlive: 60,
+		reasonString:    "because",
+		user:            [][2]string{{"x-retry-count", "2"}, {"player", "alice"}, {"player", "bob"}},
+	}
+	var w mqttWriter
+	w.string("game_logs/alice")
+	w.uint16(7)
+	w.props(props)
+	w.buf = append(w.buf, "payload"...)
+
+	r := &mqttReader{buf: w.buf}
+	topic, id, got, payload := r.string(), r.uint16(), r.props(), r.rest()
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if topic != "game_logs/alice" || id != 7 || string(payload) != "payload" {
+		t.Errorf("read back %q, %d, %q", topic, id, payload)
+	}
+	if !reflect.DeepEqual(got, props) {
+		t.Errorf("read back properties %+v, want %+v", got, props)
+	}
+	if v, _ := got.userProperty("player"); v != "alice" {
+		t.Errorf("first player property is %q", v)
+	}
+
+	// properties a broker may send that the package has no use for
+	var skipped mqttWriter
+	skipped.byte(0x01) // payload format indicator
+	skipped.byte(1)
+	skipped.byte(0x23) // topic alias
+	skipped.uint16(3)
+	skipped.byte(0x0b) // subscription identifier
+	skipped.buf = appendVarint(skipped.buf, 300)
+	skipped.byte(0x03)
+	skipped.string("text/plain")
+	w = mqttWriter{buf: appendVarint(nil, len(skipped.buf))}
+	w.buf = append(w.buf, skipped.buf...)
+	r = &mqttReader{buf: w.buf}
+	if got := r.props(); r.err != nil || got.contentType != "text/plain" {
+		t.Errorf("got %+v, %v, want the content type past the skipped properties", got, r.err)
+	}
+
+	for name, raw := range map[string][]byte{
+		"unknown property": {2, 0x7f, 0},
+		"truncated":        {5, 0x03, 0, 9, 'a'},
+	} {
+		r := &mqttReader{buf: raw}
+		r.props()
+		if r.err == nil {
+			t.Errorf("%s: read succeeded", name)
+		}
+	}
+}
+
+func TestMQTTPublishingRoundTrip(t *testing.T) {
+	msg := amqp.Publishing{
+		Headers:         amqp.Table{"x-retry-count": int64(2), "player": "alice"},
+		ContentType:     "application/json",
+		ContentEncoding: "gzip",
+		DeliveryMode:    amqp.Persistent,
+		Priority:        3,
+		CorrelationId:   "req-1",
+		ReplyTo:         "peril/replies",
+		Expiration:      "2000",
+		MessageId:       "msg-1",
+		Timestamp:       time.Unix(1700000000, 0),
+		Type:            "GameLog",
+		AppId:           "peril",
+		Body:            []byte(`{"message":"hi"}`),
+	}
+	got := mqttPublishing(mqttPublishProps(msg), msg.Body)
+	if !reflect.DeepEqual(got, msg) {
+		t.Errorf("read back %+v, want %+v", got, msg)
+	}
+
+	// MQTT expiries are in seconds
+	msg.Expiration = "1500"
+	if got := mqttPublishing(mqttPublishProps(msg), nil); got.Expiration != "2000" {
+		t.Errorf("expiration %q, want it rounded up to 2000", got.Expiration)
+	}
+}
+
+func TestMQTTTopics(t *testing.T) {
+	for key, topic := range map[string]string{
+		"army_moves.alice": "army_moves/alice",
+		"game_logs.bob":    "game_logs/bob",
+		"pause/resume.x":   "pause.resume/x",
+	} {
+		got, err := mqttTopic(key)
+		if err != nil || got != topic {
+			t.Errorf("mqttTopic(%q) = %q, %v, want %q", key, got, err, topic)
+		}
+		if back := mqttRoutingKey(got); back != key {
+			t.Errorf("mqttRoutingKey(%q) = %q, want %q", got, back, key)
+		}
+	}
+	for _, key := range []string{"", "game_logs.*", "war.#", "a+b"} {
+		if _, err := mqttTopic(key); !errors.Is(err, ErrNotSupported) {
+			t.Errorf("mqttTopic(%q) = %v, want ErrNotSupported", key, err)
+		}
+	}
+
+	for key, filter := range map[string]string{
+		"game_logs.*":    "game_logs/+",
+		"army_moves.#":   "army_moves/#",
+		"#":              "#",
+		"*.alice":        "+/alice",
+		"war.alice.bob":  "war/alice/bob",
+		"pause/resume.*": "pause.resume/+",
+	} {
+		got, err := mqttFilter(key)
+		if err != nil || got != filter {
+			t.Errorf("mqttFilter(%q) = %q, %v, want %q", key, got, err, filter)
+		}
+		if back := mqttRoutingKey(got); back != key {
+			t.Errorf("mqttRoutingKey(%q) = %q, want %q", got, back, key)
+		}
+	}
+	for _, key := range []string{"", "#.alice", "war.#.alice", "war*", "war.a#", "a+b"} {
+		if _, err := mqttFilter(key); !errors.Is(err, ErrNotSupported) {
+			t.Errorf("mqttFilter(%q) = %v, want ErrNotSupported", key, err)
+		}
+	}
+}
+
+func serveMQTT(t *testing.T, b *MemoryBroker) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go NewMQTTServer(b, routing.ExchangePerilTopic).Serve(ln)
+	return ln.Addr().String()
+}
+
+func dialMQTTFor(t *testing.T, url string) Connection {
+	t.Helper()
+	conn, err := DialMQTT(nil, routing.ExchangePerilTopic, url)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func consumeMQTT(t *testing.T, ch Channel, queue, key string, autoAck bool) <-chan amqp.Delivery {
+	t.Helper()
+	if _, err := ch.QueueDeclare(queue, true, false, false, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind(queue, key, routing.ExchangePerilTopic, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := ch.Consume(queue, "", autoAck, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msgs
+}
+
+func TestMQTTServerAckNack(t *testing.T) {
+	b := NewMemoryBroker()
+	mem := memChannelFor(t, b)
+	declareExchange(t, mem, routing.ExchangePerilTopic, amqp.ExchangeTopic)
+	conn := dialMQTTFor(t, "mqtt://guest:guest@"+serveMQTT(t, b)+"?client_id=bot")
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// QoS 1: a delivery is only gone once it is acked
+	logs := consumeMQTT(t, ch, "logs", "game_logs.*", false)
+	publish(t, mem, routing.ExchangePerilTopic, "game_logs.alice", amqp.Publishing{
+		Headers: amqp.Table{"player": "alice"},
+		Body:    []byte("requeued"),
+	})
+	d := receive(t, logs)
+	if d.Redelivered || d.Exchange != routing.ExchangePerilTopic || d.RoutingKey != "game_logs.alice" || d.Headers["player"] != "alice" {
+		t.Errorf("got %+v, want a first delivery from game_logs.alice", d)
+	}
+	if err := d.Nack(false, true); err != nil {
+		t.Fatal(err)
+	}
+	d = receive(t, logs)
+	if !d.Redelivered || string(d.Body) != "requeued" {
+		t.Errorf("got %q redelivered=%v, want the requeued message again", d.Body, d.Redelivered)
+	}
+	if err := d.Ack(false); err != nil {
+		t.Fatal(err)
+	}
+
+	publish(t, mem, routing.ExchangePerilTopic, "game_logs.bob", amqp.Publishing{Body: []byte("discarded")})
+	if err := receive(t, logs).Nack(false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// QoS 0: auto-acked, and acking again is harmless
+	moves := consumeMQTT(t, ch, "moves", "army_moves.*", true)
+	publish(t, mem, routing.ExchangePerilTopic, "army_moves.alice", amqp.Publishing{Body: []byte("move")})
+	if d := receive(t, moves); string(d.Body) != "move" || d.Ack(false) != nil {
+		t.Errorf("got %q on the auto-ack consumer", d.Body)
+	}
+
+	// what is still unacked when the client goes away goes back to the
+	// session's queue, so the acked and the discarded messages must not
+	publish(t, mem, routing.ExchangePerilTopic, "game_logs.carol", amqp.Publishing{Body: []byte("unacked")})
+	receive(t, logs)
+	conn.Close()
+	queue := "mqtt-subscription-botqos1"
+	if d := getEventually(t, mem, queue); string(d.Body) != "unacked" {
+		t.Errorf("session queue holds %q, want only the unacked message", d.Body)
+	}
+	expectEmpty(t, mem, queue)
+}
+
+func TestMQTTServerPublish(t *testing.T) {
+	b := NewMemoryBroker()
+	mem := memChannelFor(t, b)
+	declareExchange(t, mem, routing.ExchangePerilTopic, amqp.ExchangeTopic)
+	declareQueue(t, mem, "war", true, nil)
+	bindQueue(t, mem, "war", "war.*", routing.ExchangePerilTopic)
+
+	ch, err := dialMQTTFor(t, "mqtt://"+serveMQTT(t, b)).Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.Confirm(false); err != nil {
+		t.Fatal(err)
+	}
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 2))
+	returns := ch.NotifyReturn(make(chan amqp.Return, 1))
+	confirm := func(tag uint64) {
+		t.Helper()
+		select {
+		case c := <-confirms:
+			if c.DeliveryTag != tag || !c.Ack {
+				t.Errorf("got %+v, want an ack for tag %d", c, tag)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no confirm")
+		}
+	}
+
+	err = ch.PublishWithContext(context.Background(), routing.ExchangePerilTopic, "war.alice", true, false, amqp.Publishing{
+		ContentType: "application/json",
+		Body:        []byte("war"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	confirm(1)
+	d := get(t, mem, "war")
+	if string(d.Body) != "war" || d.RoutingKey != "war.alice" || d.ContentType != "application/json" {
+		t.Errorf("queue holds %+v", d)
+	}
+	// in confirm mode everything goes at QoS 1, which the broker persists
+	if d.DeliveryMode != amqp.Persistent {
+		t.Errorf("delivery mode %d, want persistent", d.DeliveryMode)
+	}
+
+	if err := ch.PublishWithContext(context.Background(), routing.ExchangePerilTopic, "nobody.home", true, false, amqp.Publishing{}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-returns:
+		if r.RoutingKey != "nobody.home" || r.ReplyCode != amqp.NoRoute {
+			t.Errorf("got return %+v", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("unroutable mandatory message was not returned")
+	}
+	confirm(2)
+
+	if err := ch.PublishWithContext(context.Background(), routing.ExchangePerilDirect, "pause", false, false, amqp.Publishing{}); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("publishing to another exchange: got %v, want ErrNotSupported", err)
+	}
+}
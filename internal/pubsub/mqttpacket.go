@@ -0,0 +1,332 @@
+package pubsub
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MQTT 5 control packet types.
+const (
+	mqttConnect     byte = 1
+	mqttConnack     byte = 2
+	mqttPublish     byte = 3
+	mqttPuback      byte = 4
+	mqttSubscribe   byte = 8
+	mqttSuback      byte = 9
+	mqttUnsubscribe byte = 10
+	mqttUnsuback    byte = 11
+	mqttPingreq     byte = 12
+	mqttPingresp    byte = 13
+	mqttDisconnect  byte = 14
+)
+
+const (
+	mqttMaxPacket = 64 << 20
+
+	// no matching subscribers, in a PUBACK
+	mqttNoMatchingSubscribers byte = 0x10
+	mqttUnspecifiedError      byte = 0x80
+)
+
+// mqttPacket is a control packet with its fixed header decoded and the
+// rest left to the packet's reader.
+type mqttPacket struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+func readMQTTPacket(r *bufio.Reader) (*mqttPacket, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	var length, shift int
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, errors.New("mqtt: malformed remaining length")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length |= int(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	if length > mqttMaxPacket {
+		return nil, fmt.Errorf("mqtt: %d byte packet is too large", length)
+	}
+	p := &mqttPacket{kind: first >> 4, flags: first & 0x0f, body: make([]byte, length)}
+	if _, err := io.ReadFull(r, p.body); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func writeMQTTPacket(w *bufio.Writer, p *mqttPacket) error {
+	w.WriteByte(p.kind<<4 | p.flags)
+	w.Write(appendVarint(nil, len(p.body)))
+	w.Write(p.body)
+	return w.Flush()
+}
+
+func appendVarint(b []byte, n int) []byte {
+	for {
+		digit := byte(n & 0x7f)
+		n >>= 7
+		if n > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+// mqttWriter builds the variable header and payload of a packet.
+type mqttWriter struct {
+	buf []byte
+}
+
+func (w *mqttWriter) byte(b byte) {
+	w.buf = append(w.buf, b)
+}
+
+func (w *mqttWriter) uint16(n uint16) {
+	w.buf = binary.BigEndian.AppendUint16(w.buf, n)
+}
+
+func (w *mqttWriter) uint32(n uint32) {
+	w.buf = binary.BigEndian.AppendUint32(w.buf, n)
+}
+
+func (w *mqttWriter) string(s string) {
+	w.binary([]byte(s))
+}
+
+func (w *mqttWriter) binary(b []byte) {
+	w.uint16(uint16(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *mqttWriter) props(p mqttProps) {
+	var pw mqttWriter
+	if p.messageExpiry != nil {
+		pw.byte(0x02)
+		pw.uint32(*p.messageExpiry)
+	}
+	if p.contentType != "" {
+		pw.byte(0x03)
+		pw.string(p.contentType)
+	}
+	if p.responseTopic != "" {
+		pw.byte(0x08)
+		pw.string(p.responseTopic)
+	}
+	if p.correlationData != nil {
+		pw.byte(0x09)
+		pw.binary(p.correlationData)
+	}
+	if p.sessionExpiry != 0 {
+		pw.byte(0x11)
+		pw.uint32(p.sessionExpiry)
+	}
+	if p.serverKeepAlive != 0 {
+		pw.byte(0x13)
+		pw.uint16(p.serverKeepAlive)
+	}
+	if p.reasonString != "" {
+		pw.byte(0x1f)
+		pw.string(p.reasonString)
+	}
+	for _, u := range p.user {
+		pw.byte(0x26)
+		pw.string(u[0])
+		pw.string(u[1])
+	}
+	w.buf = appendVarint(w.buf, len(pw.buf))
+	w.buf = append(w.buf, pw.buf...)
+}
+
+func (w *mqttWriter) packet(kind, flags byte) *mqttPacket {
+	return &mqttPacket{kind: kind, flags: flags, body: w.buf}
+}
+
+// mqttReader decodes a packet body. The first error sticks and turns every
+// later read into a zero value, so a packet is checked once at the end.
+type mqttReader struct {
+	buf []byte
+	err error
+}
+
+func (r *mqttReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.buf) {
+		r.err = errors.New("mqtt: truncated packet")
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *mqttReader) more() bool {
+	return r.err == nil && len(r.buf) > 0
+}
+
+func (r *mqttReader) byte() byte {
+	if b := r.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *mqttReader) uint16() uint16 {
+	if b := r.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *mqttReader) uint32() uint32 {
+	if b := r.take(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *mqttReader) varint() int {
+	var n, shift int
+	for i := 0; i < 4; i++ {
+		b := r.byte()
+		n |= int(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			return n
+		}
+	}
+	if r.err == nil {
+		r.err = errors.New("mqtt: malformed variable byte integer")
+	}
+	return 0
+}
+
+func (r *mqttReader) binary() []byte {
+	return r.take(int(r.uint16()))
+}
+
+func (r *mqttReader) string() string {
+	return string(r.binary())
+}
+
+func (r *mqttReader) rest() []byte {
+	b := r.take(len(r.buf))
+	if b == nil {
+		return []byte{}
+	}
+	return b
+}
+
+// props reads a property list, keeping the properties this package uses
+// and skipping the rest.
+func (r *mqttReader) props() mqttProps {
+	var p mqttProps
+	pr := &mqttReader{buf: r.take(r.varint())}
+	for pr.more() {
+		switch id := pr.varint(); id {
+		case 0x02:
+			n := pr.uint32()
+			p.messageExpiry = &n
+		case 0x03:
+			p.contentType = pr.string()
+		case 0x08:
+			p.responseTopic = pr.string()
+		case 0x09:
+			p.correlationData = pr.binary()
+		case 0x11:
+			p.sessionExpiry = pr.uint32()
+		case 0x13:
+			p.serverKeepAlive = pr.uint16()
+		case 0x1f:
+			p.reasonString = pr.string()
+		case 0x26:
+			p.user = append(p.user, [2]string{pr.string(), pr.string()})
+		case 0x01, 0x17, 0x19, 0x24, 0x25, 0x28, 0x29, 0x2a:
+			pr.byte()
+		case 0x21, 0x22, 0x23:
+			pr.uint16()
+		case 0x18, 0x27:
+			pr.uint32()
+		case 0x0b:
+			pr.varint()
+		case 0x12, 0x15, 0x1a, 0x1c:
+			pr.string()
+		case 0x16:
+			pr.binary()
+		default:
+			pr.err = fmt.Errorf("mqtt: unknown property 0x%02x", id)
+		}
+	}
+	if r.err == nil {
+		r.err = pr.err
+	}
+	return p
+}
+
+// mqttProps holds the MQTT 5 properties this package reads and writes.
+type mqttProps struct {
+	messageExpiry   *uint32
+	contentType     string
+	responseTopic   string
+	correlationData []byte
+	sessionExpiry   uint32
+	serverKeepAlive uint16
+	reasonString    string
+	user            [][2]string
+}
+
+func (p mqttProps) userProperty(name string) (string, bool) {
+	for _, u := range p.user {
+		if u[0] == name {
+			return u[1], true
+		}
+	}
+	return "", false
+}
+
+// mqttReasons names the reason codes a broker is likely to fail a request
+// or a connection with.
+var mqttReasons = map[byte]string{
+	0x80: "unspecified error",
+	0x81: "malformed packet",
+	0x82: "protocol error",
+	0x83: "implementation specific error",
+	0x84: "unsupported protocol version",
+	0x85: "client identifier not valid",
+	0x86: "bad user name or password",
+	0x87: "not authorized",
+	0x88: "server unavailable",
+	0x89: "server busy",
+	0x8b: "server shutting down",
+	0x8d: "keep alive timeout",
+	0x8e: "session taken over",
+	0x8f: "topic filter invalid",
+	0x90: "topic name invalid",
+	0x93: "receive maximum exceeded",
+	0x95: "packet too large",
+	0x97: "quota exceeded",
+	0x99: "payload format invalid",
+	0x9a: "retain not supported",
+	0x9b: "QoS not supported",
+	0x9e: "shared subscriptions not supported",
+	0xa2: "wildcard subscriptions not supported",
+}
@@ -0,0 +1,209 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func natsChannelFor(t *testing.T) Channel {
+	t.Helper()
+	srv, err := StartEmbeddedNATS("127.0.0.1:0", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Shutdown)
+
+	conn, err := DialNATS(nil, srv.ClientURL())()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ch
+}
+
+// declareDeadLetters gives ch a dead-letter exchange, peril_dlx, whose
+// messages all end up in the dlq queue.
+func declareDeadLetters(t *testing.T, ch Channel) {
+	t.Helper()
+	declareExchange(t, ch, "peril_dlx", amqp.ExchangeTopic)
+	declareQueue(t, ch, "dlq", true, nil)
+	bindQueue(t, ch, "dlq", "#", "peril_dlx")
+}
+
+func TestNATSPublishConsume(t *testing.T) {
+	ch := natsChannelFor(t)
+	declareExchange(t, ch, "peril_topic", amqp.ExchangeTopic)
+	declareQueue(t, ch, "moves", true, nil)
+	bindQueue(t, ch, "moves", "army_moves.*", "peril_topic")
+	if err := ch.Qos(10, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := ch.Consume("moves", "c", false, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publish(t, ch, "peril_topic", "war.alice", amqp.Publishing{Body: []byte("unrouted")})
+	publish(t, ch, "peril_topic", "army_moves.alice", amqp.Publishing{
+		ContentType: "application/json",
+		MessageId:   "move-1",
+		Headers:     amqp.Table{"x-attempt": int64(2)},
+		Body:        []byte("move"),
+	})
+	d := receive(t, msgs)
+	if string(d.Body) != "move" || d.Exchange != "peril_topic" || d.RoutingKey != "army_moves.alice" {
+		t.Errorf("got %q from %s with key %s", d.Body, d.Exchange, d.RoutingKey)
+	}
+	if d.ContentType != "application/json" || d.MessageId != "move-1" {
+		t.Errorf("got content type %q and message ID %q", d.ContentType, d.MessageId)
+	}
+	if n, ok := tableInt(d.Headers["x-attempt"]); !ok || n != 2 {
+		t.Errorf("got x-attempt %v", d.Headers["x-attempt"])
+	}
+	if err := d.Ack(false); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case d := <-msgs:
+		t.Errorf("got %q after the only routed message was acked", d.Body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestNATSConfirms(t *testing.T) {
+	ch := natsChannelFor(t)
+	declareQueue(t, ch, "q", true, nil)
+	if err := ch.Confirm(false); err != nil {
+		t.Fatal(err)
+	}
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 2))
+
+	for i := 0; i < 2; i++ {
+		publish(t, ch, "", "q", amqp.Publishing{Body: []byte("x")})
+	}
+	for tag := uint64(1); tag <= 2; tag++ {
+		select {
+		case c := <-confirms:
+			if c.DeliveryTag != tag || !c.Ack {
+				t.Errorf("got confirmation %+v, want an ack of %d", c, tag)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("publish %d was not confirmed", tag)
+		}
+	}
+}
+
+func TestNATSDeadLetterOnNack(t *testing.T) {
+	ch := natsChannelFor(t)
+	declareDeadLetters(t, ch)
+	declareExchange(t, ch, "peril_topic", amqp.ExchangeTopic)
+	declareQueue(t, ch, "war", true, amqp.Table{"x-dead-letter-exchange": "peril_dlx"})
+	bindQueue(t, ch, "war", "war.*", "peril_topic")
+	if err := ch.Qos(1, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := ch.Consume("war", "c", false, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publish(t, ch, "peril_topic", "war.alice", amqp.Publishing{Body: []byte("war")})
+	if err := receive(t, msgs).Nack(false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	dead := getEventually(t, ch, "dlq")
+	deaths := Deaths(dead.Headers)
+	if string(dead.Body) != "war" || len(deaths) != 1 {
+		t.Fatalf("dead-letter queue got %q with deaths %+v", dead.Body, deaths)
+	}
+	if d := deaths[0]; d.Queue != "war" || d.Reason != "rejected" || d.Exchange != "peril_topic" {
+		t.Errorf("got death %+v", d)
+	}
+}
+
+func TestNATSExpire(t *testing.T) {
+	ch := natsChannelFor(t)
+	declareDeadLetters(t, ch)
+	declareQueue(t, ch, "retry", true, amqp.Table{
+		"x-message-ttl":          int64(50),
+		"x-dead-letter-exchange": "peril_dlx",
+	})
+
+	start := time.Now()
+	publish(t, ch, "", "retry", amqp.Publishing{Body: []byte("later")})
+	dead := getEventually(t, ch, "dlq")
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("message expired after %v, before its TTL", elapsed)
+	}
+	deaths := Deaths(dead.Headers)
+	if string(dead.Body) != "later" || len(deaths) != 1 || deaths[0].Reason != "expired" {
+		t.Errorf("dead-letter queue got %q with deaths %+v", dead.Body, deaths)
+	}
+}
+
+func TestNATSInequivalentDeclare(t *testing.T) {
+	ch := natsChannelFor(t)
+	declareQueue(t, ch, "war", true, amqp.Table{"x-dead-letter-exchange": "peril_dlx"})
+	declareQueue(t, ch, "war", true, amqp.Table{"x-dead-letter-exchange": "peril_dlx"})
+
+	_, err := ch.QueueDeclare("war", true, false, false, false, amqp.Table{"x-dead-letter-exchange": "other_dlx"})
+	var amqpErr *amqp.Error
+	if !errors.As(err, &amqpErr) || amqpErr.Code != amqp.PreconditionFailed {
+		t.Errorf("redeclaring with other arguments: got %v, want PRECONDITION_FAILED", err)
+	}
+	_, err = ch.QueueDeclare("war", false, false, false, false, amqp.Table{"x-dead-letter-exchange": "peril_dlx"})
+	if !errors.As(err, &amqpErr) || amqpErr.Code != amqp.PreconditionFailed {
+		t.Errorf("redeclaring as transient: got %v, want PRECONDITION_FAILED", err)
+	}
+}
+
+func TestNATSSubscribe(t *testing.T) {
+	srv, err := StartEmbeddedNATS("127.0.0.1:0", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown()
+	broker, err := NewConnectionManager(DialNATS(nil, srv.ClientURL()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	ch, err := broker.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	declareExchange(t, ch, "peril_topic", amqp.ExchangeTopic)
+
+	got := make(chan string, 1)
+	sub, err := Subscribe(context.Background(), broker, "peril_topic", "moves", "army_moves.*", TransientSimpleQueue,
+		func(d Delivery[string]) AckType {
+			got <- d.Body
+			return Ack
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	if err := PublishJSON(ch, "peril_topic", "army_moves.alice", "move"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case body := <-got:
+		if body != "move" {
+			t.Errorf("got %q", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscriber got nothing")
+	}
+}
@@ -0,0 +1,452 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// natsSubjectRoot prefixes every subject the transport publishes on;
+	// the stream captures all of them.
+	natsSubjectRoot = "peril"
+	// natsStreamQueueRoot prefixes the subjects stream queues are copied
+	// to, outside of the stream.
+	natsStreamQueueRoot = "peril_stream"
+	// natsQueueToken stands in for the default exchange, so publishing to
+	// queue Q goes to peril.queue.Q.
+	natsQueueToken = "queue"
+)
+
+// Headers carrying what AMQP has a field of its own for. Message headers
+// travel JSON encoded in natsTableHeader so their types survive.
+const (
+	natsExchangeHeader      = "Peril-Exchange"
+	natsRoutingKeyHeader    = "Peril-Routing-Key"
+	natsTableHeader         = "Peril-Headers"
+	natsContentTypeHeader   = "Content-Type"
+	natsEncodingHeader      = "Content-Encoding"
+	natsPersistentHeader    = "Peril-Persistent"
+	natsPriorityHeader      = "Peril-Priority"
+	natsCorrelationIDHeader = "Peril-Correlation-Id"
+	natsReplyToHeader       = "Peril-Reply-To"
+	natsExpirationHeader    = "Peril-Expiration"
+	natsMessageIDHeader     = "Peril-Message-Id"
+	natsTimestampHeader     = "Peril-Timestamp"
+	natsTypeHeader          = "Peril-Type"
+	natsUserIDHeader        = "Peril-User-Id"
+	natsAppIDHeader         = "Peril-App-Id"
+)
+
+// natsExchangeSubject is the subject prefix of an exchange: peril_topic
+// becomes peril.topic and the default exchange peril.queue.
+func natsExchangeSubject(exchange string) string {
+	if exchange == "" {
+		return natsSubjectRoot + "." + natsQueueToken
+	}
+	token := strings.ReplaceAll(strings.TrimPrefix(exchange, "peril_"), ".", "_")
+	return natsSubjectRoot + "." + token
+}
+
+// natsSubject is the subject a message published to exchange with key is
+// sent on. Keys may not contain anything NATS reads as a wildcard.
+func natsSubject(exchange, key string) (string, error) {
+	prefix := natsExchangeSubject(exchange)
+	if key == "" {
+		return prefix, nil
+	}
+	for _, word := range strings.Split(key, ".") {
+		if word == "" || word == "*" || word == ">" || strings.ContainsAny(word, " \t\r\n") {
+			return "", fmt.Errorf("routing key %q has no NATS subject: %w", key, ErrNotSupported)
+		}
+	}
+	return prefix + "." + key, nil
+}
+
+func natsStreamQueueSubject(queue string) string {
+	return natsStreamQueueRoot + "." + natsName(queue)
+}
+
+// natsFilters are the subject filters standing in for binding a queue to
+// exchange with key. A topic key's trailing # matches zero or more words,
+// so it becomes the parent subject plus everything below it.
+func natsFilters(kind, exchange, key string) ([]string, error) {
+	prefix := natsExchangeSubject(exchange)
+	switch kind {
+	case amqp.ExchangeFanout:
+		return []string{prefix, prefix + ".>"}, nil
+	case amqp.ExchangeDirect:
+		subject, err := natsSubject(exchange, key)
+		if err != nil {
+			return nil, err
+		}
+		return []string{subject}, nil
+	case amqp.ExchangeTopic:
+	default:
+		return nil, fmt.Errorf("%s exchanges: %w", kind, ErrNotSupported)
+	}
+
+	if key == "" {
+		return []string{prefix}, nil
+	}
+	words := strings.Split(key, ".")
+	subject := prefix
+	for i, word := range words {
+		switch {
+		case word == "#" && i == len(words)-1:
+			return []string{subject, subject + ".>"}, nil
+		case word == "" || word == ">" || strings.ContainsAny(word, "# \t\r\n"):
+			return nil, fmt.Errorf("binding key %q has no NATS filter: %w", key, ErrNotSupported)
+		}
+		subject += "." + word
+	}
+	return []string{subject}, nil
+}
+
+// natsCovers reports whether every subject filter b matches is matched by
+// filter a as well.
+func natsCovers(a, b string) bool {
+	at := strings.Split(a, ".")
+	bt := strings.Split(b, ".")
+	for i, t := range at {
+		if t == ">" {
+			return i < len(bt)
+		}
+		if i >= len(bt) || bt[i] == ">" {
+			return false
+		}
+		if t != "*" && t != bt[i] {
+			return false
+		}
+	}
+	return len(at) == len(bt)
+}
+
+// addNATSFilters merges filters into existing. A consumer's filters must
+// not overlap, so filters another one already covers are left out.
+func addNATSFilters(existing, filters []string) []string {
+	out := append([]string(nil), existing...)
+	for _, f := range filters {
+		covered := false
+		for _, e := range out {
+			if natsCovers(e, f) {
+				covered = true
+				break
+			}
+		}
+		if covered {
+			continue
+		}
+		kept := out[:0]
+		for _, e := range out {
+			if !natsCovers(f, e) {
+				kept = append(kept, e)
+			}
+		}
+		out = append(kept, f)
+	}
+	return out
+}
+
+// natsName turns a queue name into a consumer or stream name, which may
+// not contain dots or wildcards. Names that had to change get a hash of
+// the original so two queues never share one.
+func natsName(queue string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+			return r
+		}
+		return '_'
+	}, queue)
+	if name == queue {
+		return name
+	}
+	h := fnv.New32a()
+	h.Write([]byte(queue))
+	return fmt.Sprintf("%s-%08x", name, h.Sum32())
+}
+
+// natsQueue is what a queue was declared with, kept in its consumer's or
+// stream's metadata so later declarations can be checked against it.
+type natsQueue struct {
+	name       string
+	durable    bool
+	autoDelete bool
+	exclusive  bool
+	args       amqp.Table
+}
+
+func (q natsQueue) kind() string {
+	if k, ok := q.args["x-queue-type"].(string); ok {
+		return k
+	}
+	return "classic"
+}
+
+func (q natsQueue) metadata() (map[string]string, error) {
+	args, err := encodeNATSTable(q.args)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"peril-queue":       q.name,
+		"peril-durable":     strconv.FormatBool(q.durable),
+		"peril-auto-delete": strconv.FormatBool(q.autoDelete),
+		"peril-exclusive":   strconv.FormatBool(q.exclusive),
+		"peril-args":        args,
+	}, nil
+}
+
+func natsQueueFromMetadata(md map[string]string) (natsQueue, error) {
+	args, err := decodeNATSTable(md["peril-args"])
+	if err != nil {
+		return natsQueue{}, err
+	}
+	return natsQueue{
+		name:       md["peril-queue"],
+		durable:    md["peril-durable"] == "true",
+		autoDelete: md["peril-auto-delete"] == "true",
+		exclusive:  md["peril-exclusive"] == "true",
+		args:       args,
+	}, nil
+}
+
+func (q natsQueue) equivalent(other natsQueue) bool {
+	return q.durable == other.durable && q.autoDelete == other.autoDelete &&
+		q.exclusive == other.exclusive && argsEquivalent(q.args, other.args)
+}
+
+// natsMaxAge reads an x-max-age argument such as 7D or 12h.
+func natsMaxAge(v interface{}) (time.Duration, error) {
+	if v == nil {
+		return 0, nil
+	}
+	s, _ := v.(string)
+	units := map[byte]time.Duration{
+		'Y': 365 * 24 * time.Hour,
+		'M': 30 * 24 * time.Hour,
+		'D': 24 * time.Hour,
+		'h': time.Hour,
+		'm': time.Minute,
+		's': time.Second,
+	}
+	if len(s) < 2 {
+		return 0, fmt.Errorf("invalid x-max-age %v", v)
+	}
+	unit, ok := units[s[len(s)-1]]
+	n, err := strconv.Atoi(s[:len(s)-1])
+	if !ok || err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid x-max-age %v", v)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// natsMsg is the NATS message a publishing is sent as.
+func natsMsg(subject, exchange, key string, msg amqp.Publishing) (*nats.Msg, error) {
+	m := nats.NewMsg(subject)
+	m.Data = msg.Body
+	m.Header.Set(natsExchangeHeader, exchange)
+	m.Header.Set(natsRoutingKeyHeader, key)
+	if len(msg.Headers) > 0 {
+		table, err := encodeNATSTable(msg.Headers)
+		if err != nil {
+			return nil, err
+		}
+		m.Header.Set(natsTableHeader, table)
+	}
+	props := []struct{ name, value string }{
+		{natsContentTypeHeader, msg.ContentType},
+		{natsEncodingHeader, msg.ContentEncoding},
+		{natsCorrelationIDHeader, msg.CorrelationId},
+		{natsReplyToHeader, msg.ReplyTo},
+		{natsExpirationHeader, msg.Expiration},
+		{natsMessageIDHeader, msg.MessageId},
+		{natsTypeHeader, msg.Type},
+		{natsUserIDHeader, msg.UserId},
+		{natsAppIDHeader, msg.AppId},
+	}
+	for _, prop := range props {
+		if prop.value != "" {
+			m.Header.Set(prop.name, prop.value)
+		}
+	}
+	if msg.DeliveryMode == amqp.Persistent {
+		m.Header.Set(natsPersistentHeader, "true")
+	}
+	if msg.Priority != 0 {
+		m.Header.Set(natsPriorityHeader, strconv.Itoa(int(msg.Priority)))
+	}
+	if !msg.Timestamp.IsZero() {
+		m.Header.Set(natsTimestampHeader, strconv.FormatInt(msg.Timestamp.Unix(), 10))
+	}
+	return m, nil
+}
+
+// natsPublishing reads the publishing a NATS message carries, along with
+// the exchange and routing key it was published with.
+func natsPublishing(h nats.Header, body []byte) (amqp.Publishing, string, string) {
+	msg := amqp.Publishing{
+		ContentType:     h.Get(natsContentTypeHeader),
+		ContentEncoding: h.Get(natsEncodingHeader),
+		CorrelationId:   h.Get(natsCorrelationIDHeader),
+		ReplyTo:         h.Get(natsReplyToHeader),
+		Expiration:      h.Get(natsExpirationHeader),
+		MessageId:       h.Get(natsMessageIDHeader),
+		Type:            h.Get(natsTypeHeader),
+		UserId:          h.Get(natsUserIDHeader),
+		AppId:           h.Get(natsAppIDHeader),
+		Body:            body,
+	}
+	if table := h.Get(natsTableHeader); table != "" {
+		// a header that does not decode was not written by this package
+		msg.Headers, _ = decodeNATSTable(table)
+	}
+	if h.Get(natsPersistentHeader) == "true" {
+		msg.DeliveryMode = amqp.Persistent
+	}
+	if n, err := strconv.Atoi(h.Get(natsPriorityHeader)); err == nil {
+		msg.Priority = uint8(n)
+	}
+	if sec, err := strconv.ParseInt(h.Get(natsTimestampHeader), 10, 64); err == nil {
+		msg.Timestamp = time.Unix(sec, 0)
+	}
+	return msg, h.Get(natsExchangeHeader), h.Get(natsRoutingKeyHeader)
+}
+
+func natsDelivery(h nats.Header, body []byte) amqp.Delivery {
+	msg, exchange, key := natsPublishing(h, body)
+	return amqp.Delivery{
+		Headers:         msg.Headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    msg.DeliveryMode,
+		Priority:        msg.Priority,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+		Expiration:      msg.Expiration,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		UserId:          msg.UserId,
+		AppId:           msg.AppId,
+		Exchange:        exchange,
+		RoutingKey:      key,
+		Body:            msg.Body,
+	}
+}
+
+// natsValue is an AMQP table value in JSON, tagged with its type so it
+// decodes to what was encoded, nested tables and x-death included.
+type natsValue struct {
+	Bool   *bool                 `json:"b,omitempty"`
+	Int    *int64                `json:"i,omitempty"`
+	Float  *float64              `json:"f,omitempty"`
+	String *string               `json:"s,omitempty"`
+	Bytes  *[]byte               `json:"x,omitempty"`
+	Time   *int64                `json:"t,omitempty"`
+	Table  *map[string]natsValue `json:"m,omitempty"`
+	Array  *[]natsValue          `json:"a,omitempty"`
+}
+
+func encodeNATSTable(t amqp.Table) (string, error) {
+	b, err := json.Marshal(natsTableValues(t))
+	if err != nil {
+		return "", fmt.Errorf("could not encode headers: %v", err)
+	}
+	return string(b), nil
+}
+
+func decodeNATSTable(s string) (amqp.Table, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var values map[string]natsValue
+	if err := json.Unmarshal([]byte(s), &values); err != nil {
+		return nil, fmt.Errorf("could not decode headers: %v", err)
+	}
+	return natsTable(values), nil
+}
+
+func natsTableValues(t amqp.Table) map[string]natsValue {
+	out := make(map[string]natsValue, len(t))
+	for k, v := range t {
+		out[k] = newNATSValue(v)
+	}
+	return out
+}
+
+func natsTable(values map[string]natsValue) amqp.Table {
+	t := make(amqp.Table, len(values))
+	for k, v := range values {
+		t[k] = v.value()
+	}
+	return t
+}
+
+func newNATSValue(v interface{}) natsValue {
+	if n, ok := tableInt(v); ok {
+		return natsValue{Int: &n}
+	}
+	switch v := v.(type) {
+	case nil:
+		return natsValue{}
+	case bool:
+		return natsValue{Bool: &v}
+	case float32:
+		f := float64(v)
+		return natsValue{Float: &f}
+	case float64:
+		return natsValue{Float: &v}
+	case string:
+		return natsValue{String: &v}
+	case []byte:
+		return natsValue{Bytes: &v}
+	case time.Time:
+		sec := v.Unix()
+		return natsValue{Time: &sec}
+	case amqp.Table:
+		m := natsTableValues(v)
+		return natsValue{Table: &m}
+	case []interface{}:
+		a := make([]natsValue, len(v))
+		for i, e := range v {
+			a[i] = newNATSValue(e)
+		}
+		return natsValue{Array: &a}
+	}
+	s := fmt.Sprint(v)
+	return natsValue{String: &s}
+}
+
+func (v natsValue) value() interface{} {
+	switch {
+	case v.Bool != nil:
+		return *v.Bool
+	case v.Int != nil:
+		return *v.Int
+	case v.Float != nil:
+		return *v.Float
+	case v.String != nil:
+		return *v.String
+	case v.Bytes != nil:
+		return *v.Bytes
+	case v.Time != nil:
+		return time.Unix(*v.Time, 0)
+	case v.Table != nil:
+		return natsTable(*v.Table)
+	case v.Array != nil:
+		a := make([]interface{}, len(*v.Array))
+		for i, e := range *v.Array {
+			a[i] = e.value()
+		}
+		return a
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+// EmbeddedNATS is a NATS server with JetStream running inside this process,
+// so a game needs no broker of its own. Connect to it with DialNATS.
+type EmbeddedNATS struct {
+	srv *server.Server
+}
+
+// StartEmbeddedNATS listens on listen, a host:port where port 0 picks a free
+// one, and keeps JetStream's streams under storeDir so queued messages
+// survive a restart.
+func StartEmbeddedNATS(listen, storeDir string) (*EmbeddedNATS, error) {
+	host, portStr, err := net.SplitHostPort(listen)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse listen address: %v", err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse listen port: %v", err)
+	}
+	if port == 0 {
+		// the server reads 0 as its default port
+		port = server.RANDOM_PORT
+	}
+
+	srv, err := server.NewServer(&server.Options{
+		ServerName: "peril",
+		Host:       host,
+		Port:       port,
+		JetStream:  true,
+		StoreDir:   storeDir,
+		NoSigs:     true,
+		NoLog:      true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create NATS server: %v", err)
+	}
+	srv.Start()
+	if !srv.ReadyForConnections(natsTimeout) {
+		srv.Shutdown()
+		return nil, errors.New("NATS server did not start accepting connections")
+	}
+	return &EmbeddedNATS{srv: srv}, nil
+}
+
+// ClientURL is the nats:// URL clients connect to.
+func (e *EmbeddedNATS) ClientURL() string {
+	return e.srv.ClientURL()
+}
+
+// Shutdown closes every client connection and waits for the server to stop.
+func (e *EmbeddedNATS) Shutdown() {
+	e.srv.Shutdown()
+	e.srv.WaitForShutdown()
+}
@@ -0,0 +1,82 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/albsko/learn-pub-sub/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	decodeErrorHeader   = "x-decode-error"
+	originalQueueHeader = "x-original-queue"
+)
+
+// DecodeFailurePolicy says what happens to a delivery whose body cannot be
+// decoded into the handler's type. Such a message never reaches the handler.
+type DecodeFailurePolicy int
+
+const (
+	// DecodeDiscard rejects the message, so it is dead-lettered to the
+	// queue's DLX.
+	DecodeDiscard DecodeFailurePolicy = iota
+	// DecodeRequeue puts the message back on the queue. Only useful while a
+	// codec is being rolled out, otherwise the message is redelivered forever.
+	DecodeRequeue
+	// DecodeQuarantine moves the raw message to routing.QuarantineQueue with
+	// the decode error and its origin in the headers.
+	DecodeQuarantine
+)
+
+func WithDecodeFailurePolicy(policy DecodeFailurePolicy) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.decodeFailure = policy
+	}
+}
+
+// OnDecodeFailure registers a hook that sees every undecodable delivery
+// before it is settled according to the policy.
+func OnDecodeFailure(hook func(msg amqp.Delivery, err error)) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.onDecodeFailure = hook
+	}
+}
+
+func declareQuarantineQueue(ch Channel) error {
+	_, err := ch.QueueDeclare(
+		routing.QuarantineQueue, // name
+		true,                    // durable
+		false,                   // delete when unused
+		false,                   // exclusive
+		false,                   // no-wait
+		nil,                     // args
+	)
+	if err != nil {
+		return fmt.Errorf("could not declare quarantine queue: %v", err)
+	}
+	return nil
+}
+
+func quarantine(ch Publisher, queueName string, msg amqp.Delivery, decodeErr error) error {
+	q := Republishing(msg)
+	q.Headers = amqp.Table{}
+	for k, v := range msg.Headers {
+		q.Headers[k] = v
+	}
+	q.Headers[decodeErrorHeader] = decodeErr.Error()
+	q.Headers[originalQueueHeader] = queueName
+	if _, ok := q.Headers[originalExchangeHeader]; !ok {
+		q.Headers[originalExchangeHeader] = msg.Exchange
+		q.Headers[originalRoutingKeyHeader] = msg.RoutingKey
+	}
+
+	return ch.PublishWithContext(
+		context.Background(),
+		"",
+		routing.QuarantineQueue,
+		false,
+		false,
+		q,
+	)
+}
@@ -1,42 +1,185 @@
 package pubsub
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
-	"encoding/json"
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-func PublishJSON[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	jsonBytes, err := json.Marshal(val)
+type PublishOption func(*publishOptions)
+
+type publishOptions struct {
+	codec         Codec
+	messageID     string
+	correlationID string
+	timestamp     time.Time
+	appID         string
+	userID        string
+	replyTo       string
+	expiration    time.Duration
+	headers       amqp.Table
+}
+
+// WithCodec selects how the value is encoded. Publish uses JSONCodec when
+// no codec is given.
+func WithCodec(c Codec) PublishOption {
+	return func(o *publishOptions) {
+		o.codec = c
+	}
+}
+
+// WithMessageID overrides the random message ID Publish assigns.
+func WithMessageID(id string) PublishOption {
+	return func(o *publishOptions) {
+		o.messageID = id
+	}
+}
+
+// WithCorrelationID ties the message to the one that caused it, usually by
+// passing on that message's ID.
+func WithCorrelationID(id string) PublishOption {
+	return func(o *publishOptions) {
+		o.correlationID = id
+	}
+}
+
+// WithTimestamp overrides the publish time Publish stamps on the message.
+func WithTimestamp(t time.Time) PublishOption {
+	return func(o *publishOptions) {
+		o.timestamp = t
+	}
+}
+
+func WithAppID(id string) PublishOption {
+	return func(o *publishOptions) {
+		o.appID = id
+	}
+}
+
+// WithUserID sets the user-id property. RabbitMQ rejects the message unless
+// it matches the user the connection authenticated as.
+func WithUserID(id string) PublishOption {
+	return func(o *publishOptions) {
+		o.userID = id
+	}
+}
+
+// WithReplyTo names the queue a reply to the message should be sent to.
+func WithReplyTo(queue string) PublishOption {
+	return func(o *publishOptions) {
+		o.replyTo = queue
+	}
+}
+
+// WithExpiration makes the broker drop the message if it has not been
+// delivered within d.
+func WithExpiration(d time.Duration) PublishOption {
+	return func(o *publishOptions) {
+		if d < time.Millisecond {
+			d = time.Millisecond
+		}
+		o.expiration = d
+	}
+}
+
+func WithHeader(key string, value interface{}) PublishOption {
+	return func(o *publishOptions) {
+		if o.headers == nil {
+			o.headers = amqp.Table{}
+		}
+		o.headers[key] = value
+	}
+}
+
+func WithHeaders(headers amqp.Table) PublishOption {
+	return func(o *publishOptions) {
+		if o.headers == nil {
+			o.headers = amqp.Table{}
+		}
+		for k, v := range headers {
+			o.headers[k] = v
+		}
+	}
+}
+
+func NewMessageID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+func Publish[T any](ctx context.Context, ch Publisher, exchange, key string, val T, opts ...PublishOption) error {
+	options := publishOptions{
+		codec: JSONCodec,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.messageID == "" {
+		options.messageID = NewMessageID()
+	}
+	if options.timestamp.IsZero() {
+		options.timestamp = time.Now()
+	}
+
+	body, err := options.codec.Marshal(val)
 	if err != nil {
 		return err
 	}
+	var expiration string
+	if options.expiration > 0 {
+		expiration = strconv.FormatInt(options.expiration.Milliseconds(), 10)
+	}
 
 	return ch.PublishWithContext(
-		context.Background(),
+		ctx,
 		exchange,
 		key,
 		false,
 		false,
 		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        jsonBytes,
+			Headers:       options.headers,
+			ContentType:   options.codec.ContentType(),
+			MessageId:     options.messageID,
+			CorrelationId: options.correlationID,
+			Timestamp:     options.timestamp,
+			AppId:         options.appID,
+			UserId:        options.userID,
+			ReplyTo:       options.replyTo,
+			Expiration:    expiration,
+			Body:          body,
 		},
 	)
 }
 
-func PublishGob[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	var buffer bytes.Buffer
-	encoder := gob.NewEncoder(&buffer)
-	err := encoder.Encode(val)
-	if err != nil {
-		return err
+func PublishJSON[T any](ch Publisher, exchange, key string, val T) error {
+	return Publish(context.Background(), ch, exchange, key, val, WithCodec(JSONCodec))
+}
+
+func PublishGob[T any](ch Publisher, exchange, key string, val T) error {
+	return Publish(context.Background(), ch, exchange, key, val, WithCodec(GobCodec))
+}
+
+// Republishing copies a delivery's properties, headers and body so it can be
+// published again unchanged.
+func Republishing(msg amqp.Delivery) amqp.Publishing {
+	return amqp.Publishing{
+		Headers:         msg.Headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    msg.DeliveryMode,
+		Priority:        msg.Priority,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		UserId:          msg.UserId,
+		AppId:           msg.AppId,
+		Body:            msg.Body,
 	}
-	return ch.PublishWithContext(context.Background(), exchange, key, false, false, amqp.Publishing{
-		ContentType: "application/gob",
-		Body:        buffer.Bytes(),
-	})
 }
@@ -0,0 +1,98 @@
+package pubsub
+
+import (
+	"errors"
+	"time"
+
+	"github.com/albsko/learn-pub-sub/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	streamOffsetArg     = "x-stream-offset"
+	deliveryCountHeader = "x-delivery-count"
+)
+
+func (t SimpleQueueType) durable() bool {
+	return t != TransientSimpleQueue
+}
+
+// args returns the declare arguments for a queue of type t.
+func (t SimpleQueueType) args() amqp.Table {
+	switch t {
+	case QuorumQueue:
+		return amqp.Table(routing.QuorumArgs())
+	case StreamQueue:
+		return amqp.Table(routing.StreamArgs())
+	default:
+		return amqp.Table(routing.DeadLetterArgs())
+	}
+}
+
+// WithDeliveryLimit dead-letters a message once a quorum queue has delivered
+// it limit times, however the handler settled it. It only applies to
+// QuorumQueue.
+func WithDeliveryLimit(limit int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.deliveryLimit = limit
+	}
+}
+
+// StreamOffset is where a consumer of a StreamQueue starts reading.
+type StreamOffset struct {
+	value interface{}
+}
+
+var (
+	// StreamFirst reads the stream from the oldest message it still keeps.
+	StreamFirst = StreamOffset{"first"}
+	// StreamLast starts at the last chunk the broker wrote, so the most
+	// recent few messages are read again.
+	StreamLast = StreamOffset{"last"}
+	// StreamNext only reads messages published after the consumer started.
+	StreamNext = StreamOffset{"next"}
+)
+
+// StreamAt starts at the first message the broker stored at or after t. The
+// broker works in whole seconds and chunks, so a few earlier messages may be
+// read as well.
+func StreamAt(t time.Time) StreamOffset {
+	return StreamOffset{t}
+}
+
+// StreamFromOffset starts at the message with the given offset, as carried
+// in the x-stream-offset header of every delivery from a stream.
+func StreamFromOffset(offset int64) StreamOffset {
+	return StreamOffset{offset}
+}
+
+// WithStreamOffset sets where a StreamQueue subscription starts reading. The
+// default is StreamNext. After a reconnect the subscription continues after
+// the last message it received instead.
+func WithStreamOffset(offset StreamOffset) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.streamOffset = &offset
+	}
+}
+
+func (o subscribeOptions) checkQueueType(t SimpleQueueType) error {
+	if o.deliveryLimit > 0 && t != QuorumQueue {
+		return errors.New("a delivery limit needs a quorum queue")
+	}
+	if o.streamOffset != nil && t != StreamQueue {
+		return errors.New("a stream offset needs a stream queue")
+	}
+	if t != StreamQueue {
+		return nil
+	}
+	if o.retry != nil {
+		return errors.New("messages in a stream queue cannot be retried")
+	}
+	if o.prefetchCount <= 0 {
+		return errors.New("stream queues need a prefetch count")
+	}
+	if o.autoAck {
+		return errors.New("stream queues need manual acks")
+	}
+	return nil
+}
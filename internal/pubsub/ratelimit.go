@@ -0,0 +1,138 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"golang.org/x/time/rate"
+)
+
+// ErrRateLimited is returned by a RateLimitedPublisher for a message over
+// its limit.
+var ErrRateLimited = errors.New("pubsub: publish rate limit exceeded")
+
+// rateLimitSweep is how often a RateLimiter forgets keys it has not seen
+// for a while.
+const rateLimitSweep = time.Minute
+
+// RateLimiter is a token bucket per key, e.g. per player: each key may pass
+// burst messages at once and perSecond on average.
+type RateLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu        sync.Mutex
+	buckets   map[string]*rateBucket
+	lastSweep time.Time
+
+	dropped atomic.Int64
+}
+
+type rateBucket struct {
+	limiter *rate.Limiter
+	dropped int64
+}
+
+func NewRateLimiter(perSecond float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		limit:     rate.Limit(perSecond),
+		burst:     burst,
+		buckets:   map[string]*rateBucket{},
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow takes a token from key's bucket and reports whether there was one.
+func (l *RateLimiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > rateLimitSweep {
+		// a full bucket is as good as a new one
+		for k, b := range l.buckets {
+			if b.limiter.TokensAt(now) >= float64(l.burst) {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &rateBucket{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.buckets[key] = b
+	}
+	if b.limiter.AllowN(now, 1) {
+		return true
+	}
+	b.dropped++
+	l.dropped.Add(1)
+	return false
+}
+
+// Dropped counts the messages refused since the limiter was created.
+func (l *RateLimiter) Dropped() int64 {
+	return l.dropped.Load()
+}
+
+// DroppedByKey counts the refused messages of the keys that are being
+// limited at the moment. Keys that have been quiet for a while are left out.
+func (l *RateLimiter) DroppedByKey() map[string]int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	dropped := map[string]int64{}
+	for k, b := range l.buckets {
+		if b.dropped > 0 {
+			dropped[k] = b.dropped
+		}
+	}
+	return dropped
+}
+
+// RateLimit settles deliveries over limiter's limit with ack instead of
+// handling them. key picks the bucket, e.g. the player a message is from.
+// NackDiscard dead-letters them where the queue has a dead-letter exchange,
+// Ack drops them.
+func RateLimit[T any](limiter *RateLimiter, key func(Delivery[T]) string, ack AckType) Middleware[T] {
+	return func(next Handler[T]) Handler[T] {
+		return func(d Delivery[T]) AckType {
+			if !limiter.Allow(key(d)) {
+				return ack
+			}
+			return next(d)
+		}
+	}
+}
+
+// RateLimitedPublisher refuses publishes over a token bucket's limit with
+// ErrRateLimited rather than making the caller wait.
+type RateLimitedPublisher struct {
+	pub     Publisher
+	limiter *rate.Limiter
+	dropped atomic.Int64
+}
+
+func NewRateLimitedPublisher(pub Publisher, perSecond float64, burst int) *RateLimitedPublisher {
+	return &RateLimitedPublisher{
+		pub:     pub,
+		limiter: rate.NewLimiter(rate.Limit(perSecond), burst),
+	}
+}
+
+func (p *RateLimitedPublisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if !p.limiter.Allow() {
+		p.dropped.Add(1)
+		return ErrRateLimited
+	}
+	return p.pub.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg)
+}
+
+// Dropped counts the publishes refused so far.
+func (p *RateLimitedPublisher) Dropped() int64 {
+	return p.dropped.Load()
+}
@@ -0,0 +1,75 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestRateLimiterBurstAndRefill(t *testing.T) {
+	// one token every 50ms
+	l := NewRateLimiter(20, 3)
+	for i := 0; i < 3; i++ {
+		if !l.Allow("alice") {
+			t.Fatalf("message %d of the burst was refused", i+1)
+		}
+	}
+	if l.Allow("alice") {
+		t.Error("a message over the burst passed")
+	}
+	if !l.Allow("bob") {
+		t.Error("bob was limited by alice's messages")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !l.Allow("alice") {
+		t.Error("the bucket did not refill")
+	}
+	if l.Allow("alice") {
+		t.Error("the bucket refilled faster than its rate")
+	}
+	if n := l.Dropped(); n != 2 {
+		t.Errorf("dropped %d, want 2", n)
+	}
+	if dropped := l.DroppedByKey(); dropped["alice"] != 2 || len(dropped) != 1 {
+		t.Errorf("dropped %v, want 2 of alice's", dropped)
+	}
+}
+
+type countingPublisher struct {
+	published int
+}
+
+func (p *countingPublisher) PublishWithContext(context.Context, string, string, bool, bool, amqp.Publishing) error {
+	p.published++
+	return nil
+}
+
+func TestRateLimitedPublisherRefusesWithoutWaiting(t *testing.T) {
+	var pub countingPublisher
+	// the next token is an hour away
+	p := NewRateLimitedPublisher(&pub, 1.0/3600, 2)
+	ctx := context.Background()
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := p.PublishWithContext(ctx, "", "q", false, false, amqp.Publishing{}); err != nil {
+			t.Fatalf("publish %d of the burst: %v", i+1, err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		err := p.PublishWithContext(ctx, "", "q", false, false, amqp.Publishing{})
+		if !errors.Is(err, ErrRateLimited) {
+			t.Errorf("publish over the limit: got %v, want ErrRateLimited", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("publishes over the limit waited %v", elapsed)
+	}
+	if pub.published != 2 || p.Dropped() != 3 {
+		t.Errorf("published %d and dropped %d, want 2 and 3", pub.published, p.Dropped())
+	}
+}
@@ -0,0 +1,121 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	retryCountHeader         = "x-retry-count"
+	originalExchangeHeader   = "x-original-exchange"
+	originalRoutingKeyHeader = "x-original-routing-key"
+)
+
+// RetryPolicy bounds how often a message the handler answers with
+// NackRequeue is redelivered. Each retry waits in a per-delay queue whose
+// x-message-ttl dead-letters the message back to the source queue; once
+// MaxAttempts deliveries have failed the message is dead-lettered for good.
+type RetryPolicy struct {
+	MaxAttempts  int
+	InitialDelay time.Duration
+	Multiplier   float64
+	MaxDelay     time.Duration
+}
+
+func WithRetry(policy RetryPolicy) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.retry = &policy
+	}
+}
+
+// Delay returns how long to wait after the given failed attempt.
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+	delay := float64(p.InitialDelay)
+	for i := 1; i < attempt; i++ {
+		delay *= multiplier
+		if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+			break
+		}
+	}
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		return p.MaxDelay
+	}
+	return time.Duration(delay)
+}
+
+func retryQueueName(queueName string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%dms", queueName, delay.Milliseconds())
+}
+
+func declareRetryQueues(ch Channel, queueName string, simpleQueueType SimpleQueueType, policy RetryPolicy) error {
+	declared := map[time.Duration]struct{}{}
+	for attempt := 1; attempt < policy.MaxAttempts; attempt++ {
+		delay := policy.Delay(attempt)
+		if _, ok := declared[delay]; ok {
+			continue
+		}
+		declared[delay] = struct{}{}
+
+		args := amqp.Table{
+			"x-message-ttl":             delay.Milliseconds(),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": queueName,
+		}
+		if !simpleQueueType.durable() {
+			// nobody consumes a retry queue, so auto-delete would never fire
+			args["x-expires"] = (delay + time.Minute).Milliseconds()
+		}
+
+		_, err := ch.QueueDeclare(
+			retryQueueName(queueName, delay), // name
+			simpleQueueType.durable(),        // durable
+			false,                            // delete when unused
+			false,                            // exclusive
+			false,                            // no-wait
+			args,                             // args
+		)
+		if err != nil {
+			return fmt.Errorf("could not declare retry queue: %v", err)
+		}
+	}
+	return nil
+}
+
+// attemptOf counts retries through a retry policy as well as redeliveries
+// by a quorum queue.
+func attemptOf(msg amqp.Delivery) int {
+	retries, _ := tableInt(msg.Headers[retryCountHeader])
+	redeliveries, _ := tableInt(msg.Headers[deliveryCountHeader])
+	return int(retries+redeliveries) + 1
+}
+
+func scheduleRetry(ch Publisher, queueName string, msg amqp.Delivery, policy RetryPolicy, attempt int) error {
+	retry := Republishing(msg)
+	retry.Headers = amqp.Table{}
+	for k, v := range msg.Headers {
+		retry.Headers[k] = v
+	}
+	// attempt already includes the quorum queue's redeliveries
+	delete(retry.Headers, deliveryCountHeader)
+	retry.Headers[retryCountHeader] = int64(attempt)
+	if _, ok := retry.Headers[originalExchangeHeader]; !ok {
+		retry.Headers[originalExchangeHeader] = msg.Exchange
+		retry.Headers[originalRoutingKeyHeader] = msg.RoutingKey
+	}
+
+	return ch.PublishWithContext(
+		context.Background(),
+		"",
+		retryQueueName(queueName, policy.Delay(attempt)),
+		false,
+		false,
+		retry,
+	)
+}
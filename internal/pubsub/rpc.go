@@ -0,0 +1,270 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const rpcErrorHeader = "x-rpc-error"
+
+var (
+	ErrRPCClientClosed = errors.New("pubsub: rpc client closed")
+	ErrNoResponder     = errors.New("pubsub: no queue is bound for the request")
+)
+
+// RemoteError is returned by Call when the server's handler failed.
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "pubsub: remote handler failed: " + e.Message
+}
+
+// RPCClient sends requests and matches replies to them by correlation ID.
+// Replies arrive on an exclusive queue owned by the client, so one client
+// can be shared by any number of concurrent calls.
+type RPCClient struct {
+	ch          Channel
+	replyQueue  string
+	consumerTag string
+
+	mu      sync.Mutex
+	closed  bool
+	pending map[string]chan rpcReply
+}
+
+type rpcReply struct {
+	msg amqp.Delivery
+	err error
+}
+
+func NewRPCClient(broker Broker) (*RPCClient, error) {
+	ch, err := broker.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("could not create channel: %v", err)
+	}
+
+	c := &RPCClient{
+		ch:          ch,
+		replyQueue:  "rpc.reply." + NewMessageID(),
+		consumerTag: newConsumerTag(),
+		pending:     map[string]chan rpcReply{},
+	}
+
+	_, err = ch.QueueDeclare(
+		c.replyQueue,
+		false, // durable
+		true,  // autoDelete
+		true,  // exclusive
+		false, // noWait
+		nil,   // args
+	)
+	if err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("could not declare reply queue: %v", err)
+	}
+
+	replies, err := ch.Consume(
+		c.replyQueue,
+		c.consumerTag,
+		true,  // autoAck
+		true,  // exclusive
+		false, // noLocal
+		false, // noWait
+		nil,   // args
+	)
+	if err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("could not consume reply queue: %v", err)
+	}
+
+	returns := ch.NotifyReturn(make(chan amqp.Return, 1))
+	go c.dispatch(replies, returns)
+	return c, nil
+}
+
+func (c *RPCClient) dispatch(replies <-chan amqp.Delivery, returns chan amqp.Return) {
+	for replies != nil || returns != nil {
+		select {
+		case msg, ok := <-replies:
+			if !ok {
+				replies = nil
+				continue
+			}
+			c.resolve(msg.CorrelationId, rpcReply{msg: msg})
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			c.resolve(r.CorrelationId, rpcReply{err: ErrNoResponder})
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for id, reply := range c.pending {
+		close(reply)
+		delete(c.pending, id)
+	}
+}
+
+func (c *RPCClient) resolve(correlationID string, r rpcReply) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	reply, ok := c.pending[correlationID]
+	if !ok {
+		// the caller has already given up
+		return
+	}
+	delete(c.pending, correlationID)
+	reply <- r
+}
+
+func (c *RPCClient) register(correlationID string) (chan rpcReply, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, ErrRPCClientClosed
+	}
+	reply := make(chan rpcReply, 1)
+	c.pending[correlationID] = reply
+	return reply, nil
+}
+
+func (c *RPCClient) forget(correlationID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, correlationID)
+}
+
+func (c *RPCClient) Close() error {
+	return c.ch.Close()
+}
+
+// Call publishes req and waits for the reply. The request is encoded with
+// JSONCodec unless a WithCodec option says otherwise; the reply is decoded
+// by its content type. If ctx has a deadline the request expires with it,
+// so a server that comes back late does not answer calls nobody waits for.
+func Call[Req, Resp any](ctx context.Context, c *RPCClient, exchange, key string, req Req, opts ...PublishOption) (Resp, error) {
+	var resp Resp
+
+	correlationID := NewMessageID()
+	reply, err := c.register(correlationID)
+	if err != nil {
+		return resp, err
+	}
+	defer c.forget(correlationID)
+
+	opts = append(opts, WithCorrelationID(correlationID), WithReplyTo(c.replyQueue))
+	if deadline, ok := ctx.Deadline(); ok {
+		opts = append(opts, WithExpiration(time.Until(deadline)))
+	}
+	err = Publish(ctx, mandatoryPublisher{c.ch}, exchange, key, req, opts...)
+	if err != nil {
+		return resp, fmt.Errorf("could not publish request: %v", err)
+	}
+
+	select {
+	case r, ok := <-reply:
+		if !ok {
+			return resp, ErrRPCClientClosed
+		}
+		if r.err != nil {
+			return resp, r.err
+		}
+		if text, ok := r.msg.Headers[rpcErrorHeader].(string); ok {
+			return resp, &RemoteError{Message: text}
+		}
+		return decode[Resp](r.msg, JSONCodec)
+	case <-ctx.Done():
+		return resp, fmt.Errorf("pubsub: waiting for reply: %w", ctx.Err())
+	}
+}
+
+// mandatoryPublisher makes the broker return requests no queue is bound for,
+// so Call fails right away instead of waiting for its deadline.
+type mandatoryPublisher struct {
+	Publisher
+}
+
+func (p mandatoryPublisher) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	return p.Publisher.PublishWithContext(ctx, exchange, key, true, immediate, msg)
+}
+
+// RPCHandler answers one request. A non-nil error is sent back to the
+// caller, which gets it as a *RemoteError.
+type RPCHandler[Req, Resp any] func(Delivery[Req]) (Resp, error)
+
+// Serve answers requests sent with Call to exchange under key. Requests are
+// consumed from a transient queue, so only the server that declared it
+// answers them and they do not outlive it. Replies use the codec the request
+// was encoded with.
+func Serve[Req, Resp any](
+	ctx context.Context,
+	broker Broker,
+	exchange,
+	queueName,
+	key string,
+	handler RPCHandler[Req, Resp],
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	replyCh, err := broker.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("could not create reply channel: %v", err)
+	}
+
+	opts = append([]SubscribeOption{WithDefaultCodec(JSONCodec)}, opts...)
+	options := defaultSubscribeOptions()
+	for _, opt := range opts {
+		opt(&options)
+	}
+	logger := options.logger.With("queue", queueName)
+
+	sub, err := Subscribe(ctx, broker, exchange, queueName, key, TransientSimpleQueue, func(d Delivery[Req]) AckType {
+		if d.ReplyTo == "" {
+			logger.Warn("dropping request without reply-to", "message_id", d.MessageID)
+			return NackDiscard
+		}
+
+		resp, err := handler(d)
+
+		codec, ok := CodecFor(d.ContentType)
+		if !ok {
+			codec = JSONCodec
+		}
+		replyOpts := []PublishOption{WithCodec(codec), WithCorrelationID(d.CorrelationID)}
+		if err != nil {
+			replyOpts = append(replyOpts, WithHeader(rpcErrorHeader, err.Error()))
+		}
+		err = Publish(context.Background(), replyCh, "", d.ReplyTo, resp, replyOpts...)
+		if err != nil {
+			// the handler has already run, answering twice is worse than
+			// letting the caller time out
+			logger.Error("could not reply to request",
+				"message_id", d.MessageID,
+				"reply_to", d.ReplyTo,
+				"error", err,
+			)
+			return NackDiscard
+		}
+		return Ack
+	}, opts...)
+	if err != nil {
+		replyCh.Close()
+		return nil, err
+	}
+
+	go func() {
+		<-sub.Done()
+		replyCh.Close()
+	}()
+	return sub, nil
+}
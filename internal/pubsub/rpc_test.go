@@ -0,0 +1,137 @@
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/albsko/learn-pub-sub/internal/routing"
+)
+
+func rpcBroker(t *testing.T) (*MemoryBroker, *RPCClient) {
+	t.Helper()
+	b := NewMemoryBroker()
+	if err := DeclareTopology(b.Connect(), routing.PerilTopology()); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewRPCClient(b.Connect())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return b, c
+}
+
+func serveRPC[Req, Resp any](t *testing.T, b *MemoryBroker, key string, handler RPCHandler[Req, Resp], opts ...SubscribeOption) {
+	t.Helper()
+	sub, err := Serve(context.Background(), b.Connect(), routing.ExchangePerilDirect, key, key, handler, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sub.Close() })
+}
+
+func TestCall(t *testing.T) {
+	b, c := rpcBroker(t)
+	serveRPC(t, b, "double", func(d Delivery[int]) (int, error) {
+		if d.Body < 0 {
+			return 0, fmt.Errorf("%d is negative", d.Body)
+		}
+		return 2 * d.Body, nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	got, err := Call[int, int](ctx, c, routing.ExchangePerilDirect, "double", 21)
+	if err != nil || got != 42 {
+		t.Fatalf("got %d, %v, want 42", got, err)
+	}
+
+	_, err = Call[int, int](ctx, c, routing.ExchangePerilDirect, "double", -1)
+	var remote *RemoteError
+	if !errors.As(err, &remote) || remote.Message != "-1 is negative" {
+		t.Errorf("got %v, want the handler's error as a RemoteError", err)
+	}
+}
+
+func TestCallWithoutResponder(t *testing.T) {
+	_, c := rpcBroker(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := Call[int, int](ctx, c, routing.ExchangePerilDirect, "nobody", 1)
+	if !errors.Is(err, ErrNoResponder) {
+		t.Errorf("got %v, want ErrNoResponder", err)
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
+	b, c := rpcBroker(t)
+	release := make(chan struct{})
+	defer close(release)
+	serveRPC(t, b, "slow", func(d Delivery[int]) (int, error) {
+		<-release
+		return d.Body, nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := Call[int, int](ctx, c, routing.ExchangePerilDirect, "slow", 1)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want the deadline to be exceeded", err)
+	}
+}
+
+// syncBuffer is a bytes.Buffer that a logger and a test can share.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestServeDropsRequestsWithoutReplyTo(t *testing.T) {
+	b, c := rpcBroker(t)
+	var logs syncBuffer
+	called := make(chan int, 2)
+	serveRPC(t, b, "echo", func(d Delivery[int]) (int, error) {
+		called <- d.Body
+		return d.Body, nil
+	}, WithLogger(slog.New(slog.NewTextHandler(&logs, nil))))
+
+	ch := memChannelFor(t, b)
+	if err := Publish(context.Background(), ch, routing.ExchangePerilDirect, "echo", 1, WithMessageID("no-reply-to")); err != nil {
+		t.Fatal(err)
+	}
+
+	// calls are answered in order, so the dropped request is settled by the
+	// time the call returns
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if got, err := Call[int, int](ctx, c, routing.ExchangePerilDirect, "echo", 2); err != nil || got != 2 {
+		t.Fatalf("got %d, %v, want 2", got, err)
+	}
+	if got := <-called; got != 2 {
+		t.Errorf("the handler ran for request %d without a reply-to", got)
+	}
+	if out := logs.String(); !strings.Contains(out, "dropping request without reply-to") || !strings.Contains(out, "no-reply-to") {
+		t.Errorf("dropped request was not logged: %q", out)
+	}
+	expectEmpty(t, ch, "echo")
+}
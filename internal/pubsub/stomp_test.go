@@ -0,0 +1,329 @@
+package pubsub
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func writeFrame(t *testing.T, f *stompFrame) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := writeStompFrame(bufio.NewWriter(&buf), f); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func readFrame(t *testing.T, raw string) *stompFrame {
+	t.Helper()
+	f, err := readStompFrame(bufio.NewReader(strings.NewReader(raw)))
+	if err != nil {
+		t.Fatalf("reading %q: %v", raw, err)
+	}
+	return f
+}
+
+func TestStompFrameEscaping(t *testing.T) {
+	value := "a:b\nc\\d\re"
+	f := newStompFrame("SEND", "destination", "/queue/q", "note:1", value)
+	raw := writeFrame(t, f)
+	if want := `note\c1:a\cb\nc\\d\re` + "\n"; !bytes.Contains(raw, []byte(want)) {
+		t.Errorf("frame %q does not contain %q", raw, want)
+	}
+	got := readFrame(t, string(raw))
+	if v, ok := got.get("note:1"); !ok || v != value {
+		t.Errorf("read back note:1 = %q, want %q", v, value)
+	}
+
+	// CONNECT and CONNECTED predate escaping, so a colon stays a colon
+	connect := writeFrame(t, newStompFrame("CONNECT", "passcode", `p:w\d`))
+	if !bytes.Contains(connect, []byte("passcode:p:w\\d\n")) {
+		t.Errorf("CONNECT frame %q escaped its headers", connect)
+	}
+	if v := readFrame(t, string(connect)).header("passcode"); v != `p:w\d` {
+		t.Errorf("read back passcode %q", v)
+	}
+
+	if v := readFrame(t, "MESSAGE\nx:first\nx:second\n\n\x00").header("x"); v != "first" {
+		t.Errorf("repeated header read as %q, want the first one", v)
+	}
+
+	for _, raw := range []string{
+		"SEND\nnote:a\\tb\n\n\x00",
+		"SEND\nnote:trailing\\\n\n\x00",
+		"SEND\nno colon\n\n\x00",
+	} {
+		if _, err := readStompFrame(bufio.NewReader(strings.NewReader(raw))); err == nil {
+			t.Errorf("reading %q succeeded", raw)
+		}
+	}
+}
+
+func TestStompFrameBodies(t *testing.T) {
+	f := newStompFrame("SEND", "destination", "/queue/q")
+	f.body = []byte("a\x00b")
+	raw := writeFrame(t, f)
+	if !bytes.Contains(raw, []byte("content-length:3\n")) {
+		t.Errorf("frame %q has no content-length", raw)
+	}
+	if got := readFrame(t, string(raw)); !bytes.Equal(got.body, f.body) {
+		t.Errorf("read back body %q, want %q", got.body, f.body)
+	}
+
+	if got := readFrame(t, "SEND\ndestination:/queue/q\n\nhello\x00"); string(got.body) != "hello" {
+		t.Errorf("body without content-length read as %q", got.body)
+	}
+	if got := readFrame(t, "SEND\ncontent-length:0\n\n\x00"); len(got.body) != 0 {
+		t.Errorf("empty body read as %q", got.body)
+	}
+
+	for _, raw := range []string{
+		"SEND\ncontent-length:2\n\nhello\x00",
+		"SEND\ncontent-length:-1\n\n\x00",
+		"SEND\ncontent-length:9\n\nshort\x00",
+	} {
+		if _, err := readStompFrame(bufio.NewReader(strings.NewReader(raw))); err == nil {
+			t.Errorf("reading %q succeeded", raw)
+		}
+	}
+}
+
+func TestStompFrameHeartBeats(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("\n\r\n\nSEND\n\none\x00\n\nMESSAGE\r\nx:y\r\n\r\ntwo\x00"))
+	for _, want := range []string{"SEND", "MESSAGE"} {
+		f, err := readStompFrame(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.command != want {
+			t.Errorf("got %s, want %s", f.command, want)
+		}
+	}
+}
+
+func serveStomp(t *testing.T, b *MemoryBroker) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go NewStompServer(b).Serve(ln)
+	return ln.Addr().String()
+}
+
+// rawStomp talks to a StompServer frame by frame.
+type rawStomp struct {
+	nc net.Conn
+	r  *bufio.Reader
+	w  *bufio.Writer
+}
+
+func dialRawStomp(t *testing.T, addr string) *rawStomp {
+	t.Helper()
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { nc.Close() })
+	return &rawStomp{nc: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+}
+
+func (c *rawStomp) send(t *testing.T, f *stompFrame) {
+	t.Helper()
+	if err := writeStompFrame(c.w, f); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *rawStomp) read(t *testing.T) *stompFrame {
+	t.Helper()
+	c.nc.SetReadDeadline(time.Now().Add(time.Second))
+	f, err := readStompFrame(c.r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestStompServerReceiptsAndHeartBeats(t *testing.T) {
+	b := NewMemoryBroker()
+	ch := memChannelFor(t, b)
+	addr := serveStomp(t, b)
+	c := dialRawStomp(t, addr)
+
+	c.send(t, newStompFrame("CONNECT", "accept-version", "1.2", "host", "/", "heart-beat", "10000,10000"))
+	connected := c.read(t)
+	if connected.command != "CONNECTED" || connected.header("version") != "1.2" {
+		t.Fatalf("got %s %v, want CONNECTED 1.2", connected.command, connected.headers)
+	}
+	// the stand-in neither sends nor expects heart-beats, which the client
+	// takes as leaving the connection without read deadlines
+	if hb := connected.header("heart-beat"); hb != "0,0" {
+		t.Errorf("heart-beat is %q, want 0,0", hb)
+	}
+
+	// a client still beats if it likes; the server skips the bare EOLs
+	c.w.WriteString("\n\r\n")
+	send := newStompFrame("SEND", "destination", "/queue/scores", "receipt", "r-1")
+	send.body = []byte("1\x002")
+	c.send(t, send)
+	if f := c.read(t); f.command != "RECEIPT" || f.header("receipt-id") != "r-1" {
+		t.Fatalf("got %s %v, want the receipt for r-1", f.command, f.headers)
+	}
+	if msg := get(t, ch, "scores"); string(msg.Body) != "1\x002" {
+		t.Errorf("queue holds %q", msg.Body)
+	}
+
+	c.send(t, newStompFrame("SEND", "destination", "/exchange/missing/key", "receipt", "r-2"))
+	f := c.read(t)
+	if f.command != "ERROR" || f.header("message") != "not_found" {
+		t.Fatalf("got %s %v, want a not_found ERROR", f.command, f.headers)
+	}
+	if _, ok := f.get("receipt-id"); ok {
+		t.Error("a failed frame got a receipt")
+	}
+
+	c = dialRawStomp(t, addr)
+	c.send(t, newStompFrame("CONNECT", "accept-version", "1.2", "host", "/"))
+	c.read(t)
+	c.send(t, newStompFrame("DISCONNECT", "receipt", "bye"))
+	if f := c.read(t); f.command != "RECEIPT" || f.header("receipt-id") != "bye" {
+		t.Fatalf("got %s %v, want the receipt for the DISCONNECT", f.command, f.headers)
+	}
+	c.nc.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Error("connection still open after DISCONNECT")
+	}
+}
+
+func dialStompFor(t *testing.T, b *MemoryBroker) Channel {
+	t.Helper()
+	conn, err := DialStomp(nil, "stomp://guest:guest@"+serveStomp(t, b))()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ch
+}
+
+func TestStompConfirmsAreReceipts(t *testing.T) {
+	b := NewMemoryBroker()
+	declareExchange(t, memChannelFor(t, b), "ex", amqp.ExchangeTopic)
+	ch := dialStompFor(t, b)
+	if err := ch.Confirm(false); err != nil {
+		t.Fatal(err)
+	}
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 2))
+
+	if err := ch.PublishWithContext(context.Background(), "ex", "key", false, false, amqp.Publishing{Body: []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case c := <-confirms:
+		if c.DeliveryTag != 1 || !c.Ack {
+			t.Errorf("got %+v, want an ack for tag 1", c)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no confirm")
+	}
+
+	// the broker answers a publish to a missing exchange with an ERROR and
+	// hangs up, so the receipt never comes
+	if err := ch.PublishWithContext(context.Background(), "missing", "key", false, false, amqp.Publishing{}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case c := <-confirms:
+		if c.DeliveryTag != 2 || c.Ack {
+			t.Errorf("got %+v, want a nack for tag 2", c)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no confirm")
+	}
+}
+
+func TestStompAckNack(t *testing.T) {
+	b := NewMemoryBroker()
+	mem := memChannelFor(t, b)
+	declareExchange(t, mem, "ex", amqp.ExchangeTopic)
+	declareExchange(t, mem, "dlx", amqp.ExchangeFanout)
+	declareQueue(t, mem, "dead", true, nil)
+	bindQueue(t, mem, "dead", "", "dlx")
+
+	ch := dialStompFor(t, b)
+	if _, err := ch.QueueDeclare("work", true, false, false, false, amqp.Table{"x-dead-letter-exchange": "dlx"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.QueueBind("work", "moves.*", "ex", false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.Qos(1, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := ch.Consume("work", "", false, false, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publish(t, mem, "ex", "moves.alice", amqp.Publishing{Body: []byte("requeued")})
+	d := receive(t, msgs)
+	if d.Redelivered || d.Exchange != "ex" || d.RoutingKey != "moves.alice" {
+		t.Errorf("got %+v, want a first delivery from ex/moves.alice", d)
+	}
+	if err := d.Nack(false, true); err != nil {
+		t.Fatal(err)
+	}
+	d = receive(t, msgs)
+	if !d.Redelivered || string(d.Body) != "requeued" {
+		t.Errorf("got %q redelivered=%v, want the requeued message again", d.Body, d.Redelivered)
+	}
+	if err := d.Ack(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// with a prefetch of 1 the next message only arrives once the last one
+	// is settled, so by then the ack has been applied
+	publish(t, mem, "ex", "moves.bob", amqp.Publishing{Body: []byte("discarded")})
+	d = receive(t, msgs)
+	if string(d.Body) != "discarded" {
+		t.Fatalf("got %q after the ack, want the next message", d.Body)
+	}
+	if err := d.Nack(false, false); err != nil {
+		t.Fatal(err)
+	}
+	if dead := getEventually(t, mem, "dead"); string(dead.Body) != "discarded" {
+		t.Errorf("dead-letter queue holds %q", dead.Body)
+	}
+
+	publish(t, mem, "ex", "moves.carol", amqp.Publishing{Body: []byte("rejected")})
+	d = receive(t, msgs)
+	if err := d.Reject(false); err != nil {
+		t.Fatal(err)
+	}
+	if dead := getEventually(t, mem, "dead"); string(dead.Body) != "rejected" {
+		t.Errorf("dead-letter queue holds %q", dead.Body)
+	}
+	expectEmpty(t, mem, "work")
+
+	// settling a message twice is a no-op, not a protocol error
+	if err := d.Ack(false); err != nil && !errors.Is(err, amqp.ErrClosed) {
+		t.Fatal(err)
+	}
+	publish(t, mem, "ex", "moves.dave", amqp.Publishing{Body: []byte("still open")})
+	if d := receive(t, msgs); string(d.Body) != "still open" {
+		t.Errorf("got %q", d.Body)
+	}
+}
@@ -0,0 +1,185 @@
+package pubsub
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// stompFrame is a STOMP 1.2 frame. Headers keep their order because the
+// protocol lets the first of repeated headers win.
+type stompFrame struct {
+	command string
+	headers [][2]string
+	body    []byte
+}
+
+func newStompFrame(command string, headers ...string) *stompFrame {
+	f := &stompFrame{command: command}
+	for i := 0; i+1 < len(headers); i += 2 {
+		f.set(headers[i], headers[i+1])
+	}
+	return f
+}
+
+func (f *stompFrame) get(name string) (string, bool) {
+	for _, h := range f.headers {
+		if h[0] == name {
+			return h[1], true
+		}
+	}
+	return "", false
+}
+
+func (f *stompFrame) header(name string) string {
+	v, _ := f.get(name)
+	return v
+}
+
+func (f *stompFrame) set(name, value string) {
+	for i, h := range f.headers {
+		if h[0] == name {
+			f.headers[i][1] = value
+			return
+		}
+	}
+	f.headers = append(f.headers, [2]string{name, value})
+}
+
+// CONNECT and CONNECTED are the only frames whose headers are not escaped.
+func (f *stompFrame) escaped() bool {
+	return f.command != "CONNECT" && f.command != "CONNECTED"
+}
+
+var stompEscaper = strings.NewReplacer(`\`, `\\`, "\r", `\r`, "\n", `\n`, ":", `\c`)
+
+func writeStompFrame(w *bufio.Writer, f *stompFrame) error {
+	w.WriteString(f.command)
+	w.WriteByte('\n')
+	for _, h := range f.headers {
+		name, value := h[0], h[1]
+		if f.escaped() {
+			name, value = stompEscaper.Replace(name), stompEscaper.Replace(value)
+		}
+		w.WriteString(name)
+		w.WriteByte(':')
+		w.WriteString(value)
+		w.WriteByte('\n')
+	}
+	if f.body != nil {
+		if _, ok := f.get("content-length"); !ok {
+			fmt.Fprintf(w, "content-length:%d\n", len(f.body))
+		}
+	}
+	w.WriteByte('\n')
+	w.Write(f.body)
+	w.WriteByte(0)
+	return w.Flush()
+}
+
+// readStompFrame reads the next frame, skipping the bare end-of-lines that
+// serve as heart-beats.
+func readStompFrame(r *bufio.Reader) (*stompFrame, error) {
+	var command string
+	for command == "" {
+		line, err := readStompLine(r)
+		if err != nil {
+			return nil, err
+		}
+		command = line
+	}
+
+	f := &stompFrame{command: command}
+	for {
+		line, err := readStompLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("stomp: malformed header %q", line)
+		}
+		if f.escaped() {
+			if name, err = unescapeStomp(name); err != nil {
+				return nil, err
+			}
+			if value, err = unescapeStomp(value); err != nil {
+				return nil, err
+			}
+		}
+		if _, ok := f.get(name); !ok {
+			f.headers = append(f.headers, [2]string{name, value})
+		}
+	}
+
+	if length, ok := f.get("content-length"); ok {
+		n, err := strconv.Atoi(length)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("stomp: invalid content-length %q", length)
+		}
+		f.body = make([]byte, n)
+		if _, err := io.ReadFull(r, f.body); err != nil {
+			return nil, err
+		}
+		nul, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if nul != 0 {
+			return nil, fmt.Errorf("stomp: frame body longer than content-length")
+		}
+		return f, nil
+	}
+
+	body, err := r.ReadBytes(0)
+	if err != nil {
+		return nil, err
+	}
+	f.body = body[:len(body)-1]
+	return f, nil
+}
+
+func readStompLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\n")
+	return strings.TrimSuffix(line, "\r"), nil
+}
+
+func unescapeStomp(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			return "", fmt.Errorf("stomp: header ends in an escape: %q", s)
+		}
+		switch s[i] {
+		case '\\':
+			b.WriteByte('\\')
+		case 'r':
+			b.WriteByte('\r')
+		case 'n':
+			b.WriteByte('\n')
+		case 'c':
+			b.WriteByte(':')
+		default:
+			return "", fmt.Errorf("stomp: undefined escape \\%c in %q", s[i], s)
+		}
+	}
+	return b.String(), nil
+}
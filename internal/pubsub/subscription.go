@@ -0,0 +1,72 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrDeliveriesClosed = errors.New("pubsub: delivery channel closed by the broker")
+
+var consumerSeq atomic.Int64
+
+func newConsumerTag() string {
+	return fmt.Sprintf("peril-%d-%d", os.Getpid(), consumerSeq.Add(1))
+}
+
+type SubscriptionStats struct {
+	Acked          int64
+	Nacked         int64
+	DecodeFailures int64
+}
+
+// Subscription is a handle on a running consumer. Closing it, or cancelling
+// the context it was started with, stops new deliveries, lets the handler
+// that is currently running finish and settle its message, then closes the
+// consumer's channel so unprocessed prefetched messages are requeued.
+type Subscription struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu  sync.Mutex
+	err error
+
+	acked          atomic.Int64
+	nacked         atomic.Int64
+	decodeFailures atomic.Int64
+}
+
+func (s *Subscription) Close() error {
+	s.cancel()
+	<-s.done
+	return nil
+}
+
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err reports why the subscription stopped. It is nil while the subscription
+// is running and after a requested shutdown.
+func (s *Subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *Subscription) Stats() SubscriptionStats {
+	return SubscriptionStats{
+		Acked:          s.acked.Load(),
+		Nacked:         s.nacked.Load(),
+		DecodeFailures: s.decodeFailures.Load(),
+	}
+}
+
+func (s *Subscription) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
@@ -0,0 +1,163 @@
+package pubsub
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSFiles names the PEM files for a TLS connection to the broker. CAFile
+// replaces the system roots when set. CertFile and KeyFile are the client
+// certificate for mutual TLS. ServerName overrides the host name the
+// broker's certificate is checked against, for brokers reached through an
+// address their certificate does not name.
+type TLSFiles struct {
+	CAFile     string
+	CertFile   string
+	KeyFile    string
+	ServerName string
+}
+
+// NewTLSConfig loads files into a client TLS config. The CA bundle and the
+// client certificate are read again on the next handshake whenever their
+// files change, so a rotated CA or certificate is picked up on reconnect
+// without a restart. A reload that fails keeps the previous one.
+func NewTLSConfig(files TLSFiles) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName: files.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if files.CAFile != "" {
+		r := &caReloader{file: files.CAFile}
+		if _, err := r.pool(); err != nil {
+			return nil, err
+		}
+		// RootCAs cannot change once the config is in use, so the broker's
+		// certificate is verified against the current pool here instead
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			roots, err := r.pool()
+			if err != nil {
+				return err
+			}
+			return verifyPeer(cs, roots)
+		}
+	}
+
+	if files.CertFile != "" || files.KeyFile != "" {
+		r := &certReloader{certFile: files.CertFile, keyFile: files.KeyFile}
+		if _, err := r.certificate(); err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return r.certificate()
+		}
+	}
+	return cfg, nil
+}
+
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	certTime time.Time
+	keyTime  time.Time
+}
+
+func (r *certReloader) certificate() (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	certInfo, certErr := os.Stat(r.certFile)
+	keyInfo, keyErr := os.Stat(r.keyFile)
+	if certErr == nil && keyErr == nil && r.cert != nil &&
+		certInfo.ModTime().Equal(r.certTime) && keyInfo.ModTime().Equal(r.keyTime) {
+		return r.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		if r.cert != nil {
+			// probably caught halfway through a rotation
+			return r.cert, nil
+		}
+		return nil, fmt.Errorf("could not load client certificate: %v", err)
+	}
+	r.cert = &cert
+	if certErr == nil && keyErr == nil {
+		r.certTime = certInfo.ModTime()
+		r.keyTime = keyInfo.ModTime()
+	}
+	return r.cert, nil
+}
+
+// verifyPeer does what crypto/tls does for a client with RootCAs set.
+func verifyPeer(cs tls.ConnectionState, roots *x509.CertPool) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("broker sent no certificate")
+	}
+	if cs.ServerName == "" {
+		// x509 would skip the host name check
+		return fmt.Errorf("no server name to check the broker's certificate against")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		DNSName:       cs.ServerName,
+	})
+	return err
+}
+
+type caReloader struct {
+	file string
+
+	mu      sync.Mutex
+	roots   *x509.CertPool
+	modTime time.Time
+}
+
+func (r *caReloader) pool() (*x509.CertPool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	info, statErr := os.Stat(r.file)
+	if statErr == nil && r.roots != nil && info.ModTime().Equal(r.modTime) {
+		return r.roots, nil
+	}
+
+	roots, err := loadCAFile(r.file)
+	if err != nil {
+		if r.roots != nil {
+			// probably caught halfway through a rotation
+			return r.roots, nil
+		}
+		return nil, err
+	}
+	r.roots = roots
+	if statErr == nil {
+		r.modTime = info.ModTime()
+	}
+	return r.roots, nil
+}
+
+func loadCAFile(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read CA file: %v", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return roots, nil
+}
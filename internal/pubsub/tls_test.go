@@ -0,0 +1,287 @@
+package pubsub
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+var testSerial atomic.Int64
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(testSerial.Add(1)),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a leaf certificate and its key, both PEM encoded.
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(testSerial.Add(1)),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeFile writes data with a modification time later than any before, as
+// some file systems only keep whole seconds.
+func writeFile(t *testing.T, path string, data []byte, version int) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(time.Duration(version) * time.Minute)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tlsBroker accepts TLS connections with the server certificate it is
+// given and reports the client certificate of each handshake.
+type tlsBroker struct {
+	t       *testing.T
+	addr    string
+	cert    atomic.Pointer[tls.Certificate]
+	clients chan string
+}
+
+func newTLSBroker(t *testing.T, clientCAs ...*testCA) *tlsBroker {
+	t.Helper()
+	pool := x509.NewCertPool()
+	for _, ca := range clientCAs {
+		pool.AddCert(ca.cert)
+	}
+	b := &tlsBroker{t: t, clients: make(chan string, 10)}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return b.cert.Load(), nil
+		},
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	b.addr = ln.Addr().String()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				tc := conn.(*tls.Conn)
+				if err := tc.Handshake(); err != nil {
+					return
+				}
+				b.clients <- tc.ConnectionState().PeerCertificates[0].SerialNumber.String()
+				// let the client finish its side before closing
+				conn.Read(make([]byte, 1))
+			}()
+		}
+	}()
+	return b
+}
+
+func (b *tlsBroker) serve(certPEM, keyPEM []byte) {
+	b.t.Helper()
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	b.cert.Store(&cert)
+}
+
+// handshake connects like a transport does and returns the serial number
+// of the client certificate the broker saw.
+func (b *tlsBroker) handshake(cfg *tls.Config) (string, error) {
+	cfg = cfg.Clone()
+	cfg.ServerName = "broker.test"
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", b.addr, cfg)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	select {
+	case serial := <-b.clients:
+		return serial, nil
+	case <-time.After(time.Second):
+		return "", os.ErrDeadlineExceeded
+	}
+}
+
+func serialOf(t *testing.T, certPEM []byte) string {
+	t.Helper()
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.SerialNumber.String()
+}
+
+func TestTLSConfigReloadsCA(t *testing.T) {
+	oldCA, newCA := newTestCA(t, "old CA"), newTestCA(t, "new CA")
+	broker := newTLSBroker(t, oldCA)
+	broker.serve(oldCA.issue(t, "broker.test", x509.ExtKeyUsageServerAuth))
+
+	dir := t.TempDir()
+	files := TLSFiles{
+		CAFile:   filepath.Join(dir, "ca.pem"),
+		CertFile: filepath.Join(dir, "client.pem"),
+		KeyFile:  filepath.Join(dir, "client-key.pem"),
+	}
+	writeFile(t, files.CAFile, oldCA.pem, 0)
+	clientCert, clientKey := oldCA.issue(t, "peril", x509.ExtKeyUsageClientAuth)
+	writeFile(t, files.CertFile, clientCert, 0)
+	writeFile(t, files.KeyFile, clientKey, 0)
+
+	cfg, err := NewTLSConfig(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := broker.handshake(cfg); err != nil {
+		t.Fatalf("handshake with the old CA failed: %v", err)
+	}
+
+	// the broker moves to a certificate from the new CA before the client
+	// trusts it
+	broker.serve(newCA.issue(t, "broker.test", x509.ExtKeyUsageServerAuth))
+	if _, err := broker.handshake(cfg); err == nil {
+		t.Fatal("handshake succeeded with a CA the client does not trust yet")
+	}
+
+	writeFile(t, files.CAFile, append(append([]byte{}, oldCA.pem...), newCA.pem...), 1)
+	if _, err := broker.handshake(cfg); err != nil {
+		t.Fatalf("handshake after rotating the CA file failed: %v", err)
+	}
+
+	// a broken CA file mid-rotation keeps the last good bundle
+	writeFile(t, files.CAFile, []byte("not a certificate"), 2)
+	if _, err := broker.handshake(cfg); err != nil {
+		t.Fatalf("handshake with a half-written CA file failed: %v", err)
+	}
+}
+
+func TestTLSConfigChecksHostName(t *testing.T) {
+	ca := newTestCA(t, "CA")
+	broker := newTLSBroker(t, ca)
+	broker.serve(ca.issue(t, "someone-else.test", x509.ExtKeyUsageServerAuth))
+
+	dir := t.TempDir()
+	files := TLSFiles{
+		CAFile:   filepath.Join(dir, "ca.pem"),
+		CertFile: filepath.Join(dir, "client.pem"),
+		KeyFile:  filepath.Join(dir, "client-key.pem"),
+	}
+	writeFile(t, files.CAFile, ca.pem, 0)
+	clientCert, clientKey := ca.issue(t, "peril", x509.ExtKeyUsageClientAuth)
+	writeFile(t, files.CertFile, clientCert, 0)
+	writeFile(t, files.KeyFile, clientKey, 0)
+
+	cfg, err := NewTLSConfig(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := broker.handshake(cfg); err == nil {
+		t.Fatal("handshake succeeded with a certificate for another host")
+	}
+}
+
+func TestTLSConfigReloadsClientCertificate(t *testing.T) {
+	ca := newTestCA(t, "CA")
+	broker := newTLSBroker(t, ca)
+	broker.serve(ca.issue(t, "broker.test", x509.ExtKeyUsageServerAuth))
+
+	dir := t.TempDir()
+	files := TLSFiles{
+		CAFile:   filepath.Join(dir, "ca.pem"),
+		CertFile: filepath.Join(dir, "client.pem"),
+		KeyFile:  filepath.Join(dir, "client-key.pem"),
+	}
+	writeFile(t, files.CAFile, ca.pem, 0)
+	firstCert, firstKey := ca.issue(t, "peril", x509.ExtKeyUsageClientAuth)
+	writeFile(t, files.CertFile, firstCert, 0)
+	writeFile(t, files.KeyFile, firstKey, 0)
+
+	cfg, err := NewTLSConfig(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := broker.handshake(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := serialOf(t, firstCert); serial != want {
+		t.Errorf("broker saw certificate %s, want %s", serial, want)
+	}
+
+	secondCert, secondKey := ca.issue(t, "peril", x509.ExtKeyUsageClientAuth)
+	writeFile(t, files.CertFile, secondCert, 1)
+	writeFile(t, files.KeyFile, secondKey, 1)
+	serial, err = broker.handshake(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := serialOf(t, secondCert); serial != want {
+		t.Errorf("after rotating, broker saw certificate %s, want %s", serial, want)
+	}
+}
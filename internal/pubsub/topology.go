@@ -0,0 +1,146 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/albsko/learn-pub-sub/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// DeclareTopology declares every exchange, queue and binding of t. It is
+// idempotent as long as the live broker matches t; an entity that exists
+// with other properties fails with the broker's PRECONDITION_FAILED error.
+func DeclareTopology(broker Broker, t routing.Topology) error {
+	ch, err := broker.Channel()
+	if err != nil {
+		return fmt.Errorf("could not create channel: %v", err)
+	}
+	defer ch.Close()
+
+	for _, ex := range t.Exchanges {
+		err := ch.ExchangeDeclare(
+			ex.Name,             // name
+			ex.Kind,             // kind
+			ex.Durable,          // durable
+			ex.AutoDelete,       // auto-delete
+			ex.Internal,         // internal
+			false,               // no-wait
+			amqp.Table(ex.Args), // args
+		)
+		if err != nil {
+			return fmt.Errorf("could not declare exchange %s: %v", ex.Name, err)
+		}
+	}
+
+	for _, q := range t.Queues {
+		_, err := ch.QueueDeclare(
+			q.Name,             // name
+			q.Durable,          // durable
+			q.AutoDelete,       // delete when unused
+			q.Exclusive,        // exclusive
+			false,              // no-wait
+			amqp.Table(q.Args), // args
+		)
+		if err != nil {
+			return fmt.Errorf("could not declare queue %s: %v", q.Name, err)
+		}
+	}
+
+	for _, b := range t.Bindings {
+		err := ch.QueueBind(
+			b.Queue,            // queue name
+			b.Key,              // routing key
+			b.Exchange,         // exchange
+			false,              // no-wait
+			amqp.Table(b.Args), // args
+		)
+		if err != nil {
+			return fmt.Errorf("could not bind queue %s to %s with %s: %v", b.Queue, b.Exchange, b.Key, err)
+		}
+	}
+	return nil
+}
+
+// TopologyDrift is one way the live broker differs from a topology.
+type TopologyDrift struct {
+	Kind    string
+	Name    string
+	Problem string
+}
+
+func (d TopologyDrift) String() string {
+	return fmt.Sprintf("%s %s: %s", d.Kind, d.Name, d.Problem)
+}
+
+// VerifyTopology checks that every exchange and queue of t exists with the
+// properties t gives it, without creating anything. Existence is checked
+// with a passive declare; properties by declaring again, which the broker
+// refuses with PRECONDITION_FAILED if they differ. AMQP has no way to list
+// bindings, so those are not checked.
+//
+// Drift is returned rather than treated as an error; the error is only set
+// when the broker could not be asked at all.
+func VerifyTopology(broker Broker, t routing.Topology) ([]TopologyDrift, error) {
+	var drift []TopologyDrift
+
+	for _, ex := range t.Exchanges {
+		problem, err := verifyEntity(broker, func(ch Channel) error {
+			return ch.ExchangeDeclarePassive(ex.Name, ex.Kind, ex.Durable, ex.AutoDelete, ex.Internal, false, amqp.Table(ex.Args))
+		}, func(ch Channel) error {
+			return ch.ExchangeDeclare(ex.Name, ex.Kind, ex.Durable, ex.AutoDelete, ex.Internal, false, amqp.Table(ex.Args))
+		})
+		if err != nil {
+			return drift, fmt.Errorf("could not verify exchange %s: %v", ex.Name, err)
+		}
+		if problem != "" {
+			drift = append(drift, TopologyDrift{Kind: "exchange", Name: ex.Name, Problem: problem})
+		}
+	}
+
+	for _, q := range t.Queues {
+		problem, err := verifyEntity(broker, func(ch Channel) error {
+			_, err := ch.QueueDeclarePassive(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, amqp.Table(q.Args))
+			return err
+		}, func(ch Channel) error {
+			_, err := ch.QueueDeclare(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, amqp.Table(q.Args))
+			return err
+		})
+		if err != nil {
+			return drift, fmt.Errorf("could not verify queue %s: %v", q.Name, err)
+		}
+		if problem != "" {
+			drift = append(drift, TopologyDrift{Kind: "queue", Name: q.Name, Problem: problem})
+		}
+	}
+
+	return drift, nil
+}
+
+// verifyEntity runs passive and then declare on channels of their own,
+// since the broker closes a channel whose declare fails.
+func verifyEntity(broker Broker, passive, declare func(Channel) error) (string, error) {
+	for i, check := range []func(Channel) error{passive, declare} {
+		ch, err := broker.Channel()
+		if err != nil {
+			return "", fmt.Errorf("could not create channel: %v", err)
+		}
+		err = check(ch)
+		ch.Close()
+
+		var amqpErr *amqp.Error
+		switch {
+		case err == nil:
+			continue
+		case !errors.As(err, &amqpErr):
+			return "", err
+		case amqpErr.Code == amqp.NotFound && i == 0:
+			return "missing", nil
+		case amqpErr.Code == amqp.PreconditionFailed, amqpErr.Code == amqp.ResourceLocked:
+			return amqpErr.Reason, nil
+		default:
+			return "", err
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,67 @@
+package pubsub
+
+import (
+	"testing"
+
+	"github.com/albsko/learn-pub-sub/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestVerifyTopology(t *testing.T) {
+	topology := routing.PerilTopology()
+
+	b := NewMemoryBroker()
+	if err := DeclareTopology(b.Connect(), topology); err != nil {
+		t.Fatal(err)
+	}
+	drift, err := VerifyTopology(b.Connect(), topology)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drift) != 0 {
+		t.Errorf("a declared topology drifted: %v", drift)
+	}
+}
+
+func TestVerifyTopologyDrift(t *testing.T) {
+	topology := routing.Topology{
+		Exchanges: []routing.Exchange{
+			{Name: "peril_topic", Kind: amqp.ExchangeTopic, Durable: true},
+			{Name: "peril_dlx", Kind: amqp.ExchangeTopic, Durable: true},
+		},
+		Queues: []routing.Queue{
+			{Name: "war", Durable: true, Args: map[string]interface{}{"x-dead-letter-exchange": "peril_dlx"}},
+			{Name: "game_logs", Durable: true},
+		},
+	}
+
+	b := NewMemoryBroker()
+	ch := memChannelFor(t, b)
+	declareExchange(t, ch, "peril_topic", amqp.ExchangeTopic)
+	// declared by an older version, without a dead-letter exchange
+	declareQueue(t, ch, "war", true, nil)
+	declareQueue(t, ch, "game_logs", true, nil)
+
+	drift, err := VerifyTopology(b.Connect(), topology)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]TopologyDrift{}
+	for _, d := range drift {
+		got[d.Kind+" "+d.Name] = d
+	}
+	if len(got) != 2 {
+		t.Fatalf("got drift %v, want the dead-letter exchange and the war queue", drift)
+	}
+	if d, ok := got["exchange peril_dlx"]; !ok || d.Problem != "missing" {
+		t.Errorf("missing exchange: got %v", d)
+	}
+	if d, ok := got["queue war"]; !ok || d.Problem == "" || d.Problem == "missing" {
+		t.Errorf("queue with other arguments: got %v", d)
+	}
+
+	// verifying declares nothing
+	if err := ch.ExchangeDeclarePassive("peril_dlx", amqp.ExchangeTopic, true, false, false, false, nil); err == nil {
+		t.Error("VerifyTopology created the missing exchange")
+	}
+}
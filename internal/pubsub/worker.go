@@ -0,0 +1,181 @@
+package pubsub
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type consumer[T any] struct {
+	ch          Channel
+	queueName   string
+	consumerTag string
+	handler     Handler[T]
+	opts        subscribeOptions
+	sub         *Subscription
+}
+
+// run feeds deliveries to the workers until the context is cancelled or the
+// broker closes the delivery channel. Every delivery is settled on its own
+// tag, so workers finishing out of order never ack each other's messages.
+func (c *consumer[T]) run(ctx context.Context, msgs <-chan amqp.Delivery) {
+	defer close(c.sub.done)
+	defer c.ch.Close()
+
+	workers := make([]chan amqp.Delivery, c.opts.concurrency)
+	shared := make(chan amqp.Delivery)
+	for i := range workers {
+		workers[i] = shared
+		if c.opts.orderingKey != nil {
+			workers[i] = make(chan amqp.Delivery, c.opts.prefetchCount)
+		}
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range workers {
+		wg.Add(1)
+		go func(jobs chan amqp.Delivery) {
+			defer wg.Done()
+			c.work(ctx, stop, jobs)
+		}(workers[i])
+	}
+	defer wg.Wait()
+	defer close(stop)
+
+	for {
+		var msg amqp.Delivery
+		var ok bool
+		select {
+		case <-ctx.Done():
+			c.ch.Cancel(c.consumerTag, false)
+			return
+		case msg, ok = <-msgs:
+		}
+		if !ok {
+			c.sub.fail(ErrDeliveriesClosed)
+			c.sub.cancel()
+			return
+		}
+
+		jobs := shared
+		if c.opts.orderingKey != nil {
+			h := fnv.New32a()
+			h.Write([]byte(c.opts.orderingKey(msg)))
+			jobs = workers[h.Sum32()%uint32(len(workers))]
+		}
+		select {
+		case jobs <- msg:
+		case <-ctx.Done():
+			c.ch.Cancel(c.consumerTag, false)
+			return
+		}
+	}
+}
+
+func (c *consumer[T]) work(ctx context.Context, stop <-chan struct{}, jobs <-chan amqp.Delivery) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		select {
+		case <-stop:
+			return
+		case msg := <-jobs:
+			c.handle(ctx, msg)
+		}
+	}
+}
+
+func (c *consumer[T]) handle(ctx context.Context, msg amqp.Delivery) {
+	sub := c.sub
+	target, err := decode[T](msg, c.opts.defaultCodec)
+	if err != nil {
+		sub.decodeFailures.Add(1)
+		c.settleUndecodable(msg, err)
+		return
+	}
+
+	attempt := attemptOf(msg)
+	delivery := Delivery[T]{
+		Envelope: envelopeOf(msg),
+		Body:     target,
+		Attempt:  attempt,
+		ctx:      ctx,
+	}
+	logger := c.opts.logger.With("queue", c.queueName, "message_id", msg.MessageId)
+	switch c.handler(delivery) {
+	case Ack:
+		c.ack(msg)
+		sub.acked.Add(1)
+		logger.Debug("settled delivery", "ack", Ack.String())
+	case NackDiscard:
+		c.nack(msg, false)
+		sub.nacked.Add(1)
+		logger.Debug("settled delivery", "ack", NackDiscard.String())
+	case NackRequeue:
+		sub.nacked.Add(1)
+		retry := c.opts.retry
+		switch {
+		case retry == nil:
+			c.nack(msg, true)
+			logger.Debug("settled delivery", "ack", NackRequeue.String())
+		case attempt >= retry.MaxAttempts:
+			c.nack(msg, false)
+			logger.Warn("giving up on delivery", "attempt", attempt)
+		default:
+			err := scheduleRetry(c.ch, c.queueName, msg, *retry, attempt)
+			if err != nil {
+				logger.Error("could not schedule retry, requeueing", "attempt", attempt, "error", err)
+				c.nack(msg, true)
+				return
+			}
+			c.ack(msg)
+			logger.Debug("scheduled retry", "attempt", attempt, "delay", retry.Delay(attempt))
+		}
+	}
+}
+
+// ack and nack settle msg, unless the broker already considered it settled
+// when it was sent.
+func (c *consumer[T]) ack(msg amqp.Delivery) {
+	if !c.opts.autoAck {
+		msg.Ack(false)
+	}
+}
+
+func (c *consumer[T]) nack(msg amqp.Delivery, requeue bool) {
+	if !c.opts.autoAck {
+		msg.Nack(false, requeue)
+	}
+}
+
+func (c *consumer[T]) settleUndecodable(msg amqp.Delivery, err error) {
+	if hook := c.opts.onDecodeFailure; hook != nil {
+		hook(msg, err)
+	}
+
+	logger := c.opts.logger.With("queue", c.queueName, "message_id", msg.MessageId, "error", err)
+	switch c.opts.decodeFailure {
+	case DecodeRequeue:
+		c.nack(msg, true)
+		logger.Warn("requeued undecodable delivery")
+	case DecodeQuarantine:
+		qerr := quarantine(c.ch, c.queueName, msg, err)
+		if qerr != nil {
+			// still better off in the dead-letter queue than redelivered
+			logger.Error("could not quarantine undecodable delivery, discarding it", "quarantine_error", qerr)
+			c.nack(msg, false)
+			return
+		}
+		c.ack(msg)
+		logger.Warn("quarantined undecodable delivery")
+	default:
+		c.nack(msg, false)
+		logger.Warn("discarded undecodable delivery")
+	}
+}
@@ -0,0 +1,160 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/albsko/learn-pub-sub/internal/routing"
+)
+
+func subscribeMoves(t *testing.T, b *MemoryBroker, handler Handler[int], opts ...SubscribeOption) {
+	t.Helper()
+	if err := DeclareTopology(b.Connect(), routing.PerilTopology()); err != nil {
+		t.Fatal(err)
+	}
+	opts = append([]SubscribeOption{WithDefaultCodec(JSONCodec)}, opts...)
+	sub, err := Subscribe(context.Background(), b.Connect(), routing.ExchangePerilTopic, "moves",
+		routing.ArmyMovesPrefix+".*", TransientSimpleQueue, handler, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sub.Close() })
+}
+
+func publishMoves(t *testing.T, b *MemoryBroker, key string, n int) {
+	t.Helper()
+	ch := memChannelFor(t, b)
+	for i := 0; i < n; i++ {
+		if err := PublishJSON(ch, routing.ExchangePerilTopic, key, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// running counts the handlers that have started and not yet returned.
+type running struct {
+	mu      sync.Mutex
+	now     int
+	max     int
+	started chan struct{}
+	release chan struct{}
+}
+
+func newRunning() *running {
+	return &running{started: make(chan struct{}, 100), release: make(chan struct{})}
+}
+
+func (r *running) handler(Delivery[int]) AckType {
+	r.mu.Lock()
+	r.now++
+	r.max = max(r.max, r.now)
+	r.mu.Unlock()
+	r.started <- struct{}{}
+
+	<-r.release
+	r.mu.Lock()
+	r.now--
+	r.mu.Unlock()
+	return Ack
+}
+
+func (r *running) wait(t *testing.T, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-r.started:
+		case <-time.After(time.Second):
+			t.Fatalf("only %d of %d handlers started", i, n)
+		}
+	}
+}
+
+func (r *running) expectNoMore(t *testing.T) {
+	t.Helper()
+	select {
+	case <-r.started:
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		t.Fatalf("%d handlers are running at once", r.now)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWorkersRunInParallel(t *testing.T) {
+	b := NewMemoryBroker()
+	r := newRunning()
+	subscribeMoves(t, b, r.handler, WithConcurrency(3))
+	defer close(r.release)
+
+	publishMoves(t, b, "army_moves.alice", 5)
+	r.wait(t, 3)
+	r.expectNoMore(t)
+}
+
+func TestPrefetchLimitsUnackedDeliveries(t *testing.T) {
+	b := NewMemoryBroker()
+	r := newRunning()
+	subscribeMoves(t, b, r.handler, WithConcurrency(5), WithPrefetch(2, 0))
+
+	publishMoves(t, b, "army_moves.alice", 5)
+	r.wait(t, 2)
+	r.expectNoMore(t)
+
+	close(r.release)
+	r.wait(t, 3)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.max > 2 {
+		t.Errorf("%d handlers ran at once with a prefetch count of 2", r.max)
+	}
+}
+
+func TestOrderingKeyKeepsKeyOrder(t *testing.T) {
+	b := NewMemoryBroker()
+	keys := []string{"army_moves.alice", "army_moves.bob", "army_moves.carol"}
+	const perKey = 30
+
+	var mu sync.Mutex
+	seen := map[string][]int{}
+	done := make(chan struct{}, len(keys)*perKey)
+	subscribeMoves(t, b, func(d Delivery[int]) AckType {
+		// later messages finish faster, so only the ordering key keeps them
+		// behind the earlier ones
+		time.Sleep(time.Duration(perKey-d.Body) * 100 * time.Microsecond)
+		mu.Lock()
+		seen[d.RoutingKey] = append(seen[d.RoutingKey], d.Body)
+		mu.Unlock()
+		done <- struct{}{}
+		return Ack
+	}, WithConcurrency(4), WithOrderingKey(OrderByRoutingKey))
+
+	for _, key := range keys {
+		publishMoves(t, b, key, perKey)
+	}
+	for i := 0; i < len(keys)*perKey; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d deliveries were handled", i)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, key := range keys {
+		if got, want := fmt.Sprint(seen[key]), fmt.Sprint(sequence(perKey)); got != want {
+			t.Errorf("%s handled in order %s", key, got)
+		}
+	}
+}
+
+func sequence(n int) []int {
+	s := make([]int, n)
+	for i := range s {
+		s[i] = i
+	}
+	return s
+}
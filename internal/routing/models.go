@@ -11,3 +11,19 @@ type GameLog struct {
 	Message     string
 	Username    string
 }
+
+type JoinRequest struct {
+	Username string
+}
+
+type LeaveRequest struct {
+	Username string
+}
+
+type PlayersRequest struct{}
+
+type PlayersResponse struct {
+	Players []string
+}
+
+type PauseStateRequest struct{}
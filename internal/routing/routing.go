@@ -10,7 +10,40 @@ const (
 	GameLogSlug = "game_logs"
 )
 
+// Requests the server answers over RPC, sent to ExchangePerilDirect. Each
+// key is also the name of the queue the server serves it from.
+const (
+	RPCJoinKey       = "rpc.join"
+	RPCLeaveKey      = "rpc.leave"
+	RPCPlayersKey    = "rpc.players"
+	RPCPauseStateKey = "rpc.pause_state"
+)
+
 const (
 	ExchangePerilDirect = "peril_direct"
 	ExchangePerilTopic  = "peril_topic"
+	ExchangePerilDLX    = "peril_dlx"
 )
+
+const DeadLetterQueuePrefix = "peril_dlq"
+
+// GameLogStream keeps a copy of every game log for a week, so the server
+// can read them again from any point in that window.
+const GameLogStream = "game_logs_stream"
+
+// QuarantineQueue holds messages no subscriber could decode, untouched.
+const QuarantineQueue = "peril_quarantine"
+
+// DeadLetterSources are the routing key prefixes that get their own
+// dead-letter queue. Dead-lettered messages keep their original routing key,
+// so each queue collects everything published under one prefix.
+var DeadLetterSources = []string{
+	ArmyMovesPrefix,
+	WarRecognitionsPrefix,
+	PauseKey,
+	GameLogSlug,
+}
+
+func DeadLetterQueue(source string) string {
+	return DeadLetterQueuePrefix + "." + source
+}
@@ -0,0 +1,111 @@
+package routing
+
+// Topology describes the exchanges, queues and bindings the game relies on.
+// Per-player queues and the queues subscriptions declare for themselves, such
+// as retry queues, are not part of it.
+type Topology struct {
+	Exchanges []Exchange
+	Queues    []Queue
+	Bindings  []Binding
+}
+
+type Exchange struct {
+	Name       string
+	Kind       string
+	Durable    bool
+	AutoDelete bool
+	Internal   bool
+	Args       map[string]interface{}
+}
+
+type Queue struct {
+	Name       string
+	Durable    bool
+	AutoDelete bool
+	Exclusive  bool
+	Args       map[string]interface{}
+}
+
+type Binding struct {
+	Queue    string
+	Exchange string
+	Key      string
+	Args     map[string]interface{}
+}
+
+// Merge returns a topology with the entities of t followed by those of other.
+func (t Topology) Merge(other Topology) Topology {
+	return Topology{
+		Exchanges: append(append([]Exchange{}, t.Exchanges...), other.Exchanges...),
+		Queues:    append(append([]Queue{}, t.Queues...), other.Queues...),
+		Bindings:  append(append([]Binding{}, t.Bindings...), other.Bindings...),
+	}
+}
+
+// DeadLetterArgs are the arguments of every queue a subscription declares,
+// pointing rejected and expired messages at ExchangePerilDLX.
+func DeadLetterArgs() map[string]interface{} {
+	return map[string]interface{}{
+		"x-dead-letter-exchange": ExchangePerilDLX,
+	}
+}
+
+// QuorumArgs are DeadLetterArgs for a quorum queue.
+func QuorumArgs() map[string]interface{} {
+	args := DeadLetterArgs()
+	args["x-queue-type"] = "quorum"
+	return args
+}
+
+// StreamMaxAge is how long stream queues keep messages.
+const StreamMaxAge = "7D"
+
+// StreamArgs are the arguments of every stream queue. Streams never
+// dead-letter, so they carry no DeadLetterArgs.
+func StreamArgs() map[string]interface{} {
+	return map[string]interface{}{
+		"x-queue-type": "stream",
+		"x-max-age":    StreamMaxAge,
+	}
+}
+
+// DeadLetterTopology is the dead-letter exchange plus one durable queue per
+// DeadLetterSources entry, collecting everything dead-lettered under it, and
+// the queue undecodable messages are quarantined in.
+func DeadLetterTopology() Topology {
+	t := Topology{
+		Exchanges: []Exchange{
+			{Name: ExchangePerilDLX, Kind: "topic", Durable: true},
+		},
+		Queues: []Queue{
+			{Name: QuarantineQueue, Durable: true},
+		},
+	}
+	for _, source := range DeadLetterSources {
+		t.Queues = append(t.Queues, Queue{Name: DeadLetterQueue(source), Durable: true})
+		t.Bindings = append(t.Bindings, Binding{
+			Queue:    DeadLetterQueue(source),
+			Exchange: ExchangePerilDLX,
+			Key:      source + ".#",
+		})
+	}
+	return t
+}
+
+// PerilTopology is everything the server and clients expect to exist.
+func PerilTopology() Topology {
+	return Topology{
+		Exchanges: []Exchange{
+			{Name: ExchangePerilDirect, Kind: "direct", Durable: true},
+			{Name: ExchangePerilTopic, Kind: "topic", Durable: true},
+		},
+		Queues: []Queue{
+			{Name: GameLogSlug, Durable: true, Args: DeadLetterArgs()},
+			{Name: GameLogStream, Durable: true, Args: StreamArgs()},
+		},
+		Bindings: []Binding{
+			{Queue: GameLogSlug, Exchange: ExchangePerilTopic, Key: GameLogSlug + ".*"},
+			{Queue: GameLogStream, Exchange: ExchangePerilTopic, Key: GameLogSlug + ".*"},
+		},
+	}.Merge(DeadLetterTopology())
+}
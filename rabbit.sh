@@ -3,7 +3,7 @@
 case "$1" in
     start)
         echo "Starting RabbitMQ container..."
-        docker run -d --rm --name rabbitmq -p 5672:5672 -p 15672:15672 -p 61613:61613 rabbitmq-stomp
+        docker run -d --rm --name rabbitmq -p 5672:5672 -p 15672:15672 -p 61613:61613 -p 1883:1883 rabbitmq-stomp
         ;;
     stop)
         echo "Stopping RabbitMQ container..."